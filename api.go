@@ -0,0 +1,411 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"server-manager/runner"
+)
+
+// tokenEnv holds the --serve API token when --serve-token is not given.
+const tokenEnv = "SERVER_MANAGER_TOKEN"
+
+// APIServer runs commands on request over a small JSON HTTP API:
+//
+//	POST   /runs             start a run, returns its ID
+//	GET    /runs/{id}        status and per-host results
+//	GET    /runs/{id}/stream results as JSON lines, as hosts complete
+//	DELETE /runs/{id}        cancel a run
+//
+// Every request must carry "Authorization: Bearer <Token>". Hosts are
+// limited to the configured targets, and all runs share the Runner's Slots.
+// Only the last Retention finished runs are kept.
+type APIServer struct {
+	Runner    *runner.Runner
+	Token     string
+	Retention int
+
+	mu    sync.Mutex
+	runs  map[string]*apiRun
+	order []string
+}
+
+// apiRunRequest is the body of POST /runs. Either Hosts or Group selects
+// the targets.
+type apiRunRequest struct {
+	Hosts   []string `json:"hosts"`
+	Group   string   `json:"group"`
+	Command string   `json:"command"`
+	Options struct {
+		Vars    map[string]string `json:"vars"`
+		Timeout string            `json:"timeout"`
+	} `json:"options"`
+}
+
+type apiRunStatus struct {
+	ID       string         `json:"id"`
+	Command  string         `json:"command"`
+	Hosts    []string       `json:"hosts"`
+	Status   string         `json:"status"`
+	Started  time.Time      `json:"started"`
+	Finished *time.Time     `json:"finished,omitempty"`
+	Results  []ndjsonResult `json:"results"`
+}
+
+// apiRun is a run in progress or kept after it finished. Readers wait on
+// changed, which is closed and replaced whenever a result arrives.
+type apiRun struct {
+	mu       sync.Mutex
+	id       string
+	command  string
+	hosts    []string
+	status   string
+	started  time.Time
+	finished time.Time
+	results  []ndjsonResult
+	changed  chan struct{}
+	cancel   context.CancelFunc
+}
+
+func (s *APIServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !s.authorized(req) {
+		writeAPIError(w, http.StatusUnauthorized, "missing or invalid token")
+		return
+	}
+
+	// Route /runs, /runs/{id} and /runs/{id}/stream
+	path := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "runs" && req.Method == http.MethodPost:
+		s.startRun(w, req)
+	case len(parts) == 2 && parts[0] == "runs" && req.Method == http.MethodGet:
+		s.withRun(w, parts[1], func(run *apiRun) { writeJSON(w, http.StatusOK, run.snapshot()) })
+	case len(parts) == 2 && parts[0] == "runs" && req.Method == http.MethodDelete:
+		s.withRun(w, parts[1], func(run *apiRun) {
+			run.cancel()
+			writeJSON(w, http.StatusAccepted, run.snapshot())
+		})
+	case len(parts) == 3 && parts[0] == "runs" && parts[2] == "stream" && req.Method == http.MethodGet:
+		s.withRun(w, parts[1], func(run *apiRun) { run.stream(w, req) })
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (s *APIServer) authorized(req *http.Request) bool {
+	token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) == 1
+}
+
+func (s *APIServer) withRun(w http.ResponseWriter, id string, fn func(run *apiRun)) {
+	s.mu.Lock()
+	run := s.runs[id]
+	s.mu.Unlock()
+	if run == nil {
+		writeAPIError(w, http.StatusNotFound, "no run with ID "+id)
+		return
+	}
+
+	fn(run)
+}
+
+func (s *APIServer) startRun(w http.ResponseWriter, req *http.Request) {
+	var body apiRunRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, req.Body, 1<<20)).Decode(&body); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid request body: "+err.Error())
+		return
+	}
+	if body.Command == "" {
+		writeAPIError(w, http.StatusBadRequest, "missing command")
+		return
+	}
+	if _, err := runner.ParseCommandTemplate(body.Command); err != nil {
+		writeAPIError(w, http.StatusBadRequest, "invalid command template: "+err.Error())
+		return
+	}
+	targets, err := s.selectTargets(body.Hosts, body.Group)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Options.Timeout != "" {
+		timeout, err := time.ParseDuration(body.Options.Timeout)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid timeout: "+err.Error())
+			return
+		}
+		for i := range targets {
+			targets[i].Timeout = timeout
+		}
+	}
+
+	// Request vars take precedence over --var
+	r := *s.Runner
+	r.Targets = targets
+	r.Vars = mergeStringMaps(s.Runner.Vars, body.Options.Vars)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	results, err := r.Stream(ctx, body.Command)
+	if err != nil {
+		cancel()
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	run := &apiRun{
+		id:      newRunID(),
+		command: body.Command,
+		hosts:   targetNames(targets),
+		status:  "running",
+		started: time.Now(),
+		changed: make(chan struct{}),
+		cancel:  cancel,
+	}
+	s.add(run)
+	slog.Info("Run started", "run_id", run.id, "hosts", len(targets))
+
+	go func() {
+		defer cancel()
+		for result := range results {
+			run.add(result)
+		}
+		run.finish(ctx.Err() != nil)
+		slog.Info("Run finished", "run_id", run.id, "status", run.snapshot().Status)
+		s.evict()
+	}()
+
+	writeJSON(w, http.StatusCreated, run.snapshot())
+}
+
+// selectTargets picks the configured targets by name, or those in group.
+func (s *APIServer) selectTargets(hosts []string, group string) ([]runner.Target, error) {
+	if (len(hosts) == 0) == (group == "") {
+		return nil, errors.New("exactly one of hosts and group is required")
+	}
+
+	var targets []runner.Target
+	if group != "" {
+		for _, target := range s.Runner.Targets {
+			for _, g := range target.Groups {
+				if g == group {
+					targets = append(targets, target)
+					break
+				}
+			}
+		}
+		if len(targets) == 0 {
+			return nil, fmt.Errorf("no hosts in group %q", group)
+		}
+		return targets, nil
+	}
+
+	known := make(map[string]runner.Target, len(s.Runner.Targets))
+	for _, target := range s.Runner.Targets {
+		known[target.Name] = target
+	}
+	for _, host := range hosts {
+		target, ok := known[host]
+		if !ok {
+			return nil, fmt.Errorf("unknown host %q", host)
+		}
+		targets = append(targets, target)
+	}
+
+	return targets, nil
+}
+
+func (s *APIServer) add(run *apiRun) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.runs == nil {
+		s.runs = make(map[string]*apiRun)
+	}
+	s.runs[run.id] = run
+	s.order = append(s.order, run.id)
+}
+
+// evict drops the oldest finished runs beyond the retention count. Runs in
+// progress are always kept.
+func (s *APIServer) evict() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	finished := 0
+	for _, id := range s.order {
+		if s.runs[id].done() {
+			finished++
+		}
+	}
+
+	kept := s.order[:0]
+	for _, id := range s.order {
+		if finished > s.Retention && s.runs[id].done() {
+			delete(s.runs, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	s.order = kept
+}
+
+// Shutdown cancels every run in progress.
+func (s *APIServer) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, run := range s.runs {
+		run.cancel()
+	}
+}
+
+// ListenAndServe serves the API on addr until SIGINT or SIGTERM, then
+// cancels the runs in progress.
+func (s *APIServer) ListenAndServe(addr string) error {
+	server := &http.Server{Addr: addr, Handler: s, ReadHeaderTimeout: 10 * time.Second}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		s.Shutdown()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Serving API", "addr", addr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+func (run *apiRun) add(result CommandResult) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	run.results = append(run.results, newNDJSONResult(result))
+	close(run.changed)
+	run.changed = make(chan struct{})
+}
+
+func (run *apiRun) finish(cancelled bool) {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	run.status = "finished"
+	if cancelled {
+		run.status = "cancelled"
+	}
+	run.finished = time.Now()
+	close(run.changed)
+}
+
+func (run *apiRun) done() bool {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	return run.status != "running"
+}
+
+func (run *apiRun) snapshot() apiRunStatus {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	status := apiRunStatus{
+		ID:      run.id,
+		Command: run.command,
+		Hosts:   run.hosts,
+		Status:  run.status,
+		Started: run.started,
+		Results: append([]ndjsonResult{}, run.results...),
+	}
+	if run.status != "running" {
+		finished := run.finished
+		status.Finished = &finished
+	}
+
+	return status
+}
+
+// stream writes the results as JSON lines, first those already in and then
+// each new one, until the run is done or the client goes away.
+func (run *apiRun) stream(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	sent := 0
+	for {
+		run.mu.Lock()
+		pending := run.results[sent:]
+		running := run.status == "running"
+		changed := run.changed
+		run.mu.Unlock()
+
+		for _, result := range pending {
+			if err := encoder.Encode(result); err != nil {
+				return
+			}
+		}
+		sent += len(pending)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !running {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+func targetNames(targets []runner.Target) []string {
+	names := make([]string, len(targets))
+	for i, target := range targets {
+		names[i] = target.Name
+	}
+
+	return names
+}
+
+func mergeStringMaps(base, override map[string]string) map[string]string {
+	merged := make(map[string]string, len(base)+len(override))
+	for name, value := range base {
+		merged[name] = value
+	}
+	for name, value := range override {
+		merged[name] = value
+	}
+
+	return merged
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
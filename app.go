@@ -1,155 +1,2011 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
-	"sync"
+	"regexp"
+	"slices"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"text/template"
 	"time"
 
-	"gopkg.in/yaml.v2"
 	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/term"
+
+	"server-manager/runner"
 )
 
-type Config struct {
-	Hosts []string `yaml:"hosts"`
-}
+// CommandResult is the outcome of running the command on a single host.
+type CommandResult = runner.Result
 
-type CommandResult struct {
-	Host   string
-	Output string
-	Error  error
-}
+// passwordEnv holds the keyboard-interactive password when --password is not
+// given, keeping it off the command line.
+const passwordEnv = "SERVER_MANAGER_PASSWORD"
+
+// webhookSecretEnv holds the --webhook-secret signing key when the flag is
+// not given.
+const webhookSecretEnv = "SERVER_MANAGER_WEBHOOK_SECRET"
+
+// maxRemoteStdin caps --command-stdin and --stdin, which are held in memory
+// for the whole run.
+const maxRemoteStdin = 64 << 20
 
 func main() {
 	// Parse command-line flags
-	serverAddressesFile := flag.String("server-addresses", "./hosts.yaml", "File containing server addresses in YAML format")
+	serverAddressesFile := flag.String("server-addresses", "./hosts.yaml", "File containing server addresses in YAML format, or - to read newline-separated hosts from stdin")
+	hostList := flag.String("hosts", "", "Comma-separated list of hosts or aliases, used instead of the hosts in --server-addresses")
 	command := flag.String("command", "", "Command to execute on the servers")
-	sshKey := flag.String("ssh-key", "~/.ssh/id_rsa", "Path to the private key for SSH authentication")
+	commandStdin := flag.String("command-stdin", "", "File to feed to the remote command's stdin on every host (- for local stdin)")
+	pipeStdin := flag.Bool("stdin", false, "Feed local stdin to the remote command on every host, same as --command-stdin -")
+	presetName := flag.String("preset", "", "Run the named command from the config file's commands map instead of --command")
+	listPresets := flag.Bool("list-presets", false, "Print the config file's command presets with their descriptions and exit")
+	commandFile := flag.String("command-file", "", "File containing the command to execute on the servers, or - to read it from stdin")
+	var sshKeys stringSliceFlag
+	flag.Var(&sshKeys, "ssh-key", "Private key for SSH authentication: a path, env:VAR for PEM content in an environment variable, or - for stdin (repeatable or comma-separated, tried in order; default ~/.ssh/id_rsa)")
+	tryAllKeys := flag.Bool("try-all-keys", false, "Offer each --ssh-key on a connection of its own, reconnecting with the next key when one is rejected (for servers with a low MaxAuthTries)")
+	sshCert := flag.String("ssh-cert", "", "SSH certificate for the --ssh-key (default <key>-cert.pub if present)")
+	password := flag.String("password", "", "Password for keyboard-interactive authentication (visible to other local users; prefer $"+passwordEnv+")")
+	var kiAnswers stringSliceFlag
+	flag.Var(&kiAnswers, "ki-answers", "Answer to a non-password keyboard-interactive prompt (repeatable, in the order the prompts are asked)")
+	forwardAgent := flag.Bool("forward-agent", false, "Forward the local SSH agent (SSH_AUTH_SOCK) to the remote command; only use with trusted hosts")
+	knownHostsFile := flag.String("known-hosts", "", "known_hosts file used to verify host keys (host keys are not verified when empty)")
+	knownHostsUpdate := flag.Bool("known-hosts-update", false, "Before running, add new or changed host keys to the --known-hosts file after confirmation")
+	knownHostsStrict := flag.Bool("ssh-known-hosts-strict", false, "Before running, check every host's key against --known-hosts and exit 1 listing the unknown or changed ones, without prompting (for CI)")
+	var trustedCAs stringSliceFlag
+	flag.Var(&trustedCAs, "ssh-trusted-ca-cert", "Public key of an SSH CA whose signed host certificates are accepted (repeatable); hosts with plain keys then need --known-hosts")
+	revokedKeysFile := flag.String("ssh-revoked-keys", "", "File of public keys (one per line) whose host certificates, or certificates signed by them, are rejected")
 	parallelRequests := flag.Int("parallel-requests", 4, "Number of parallel SSH requests to make")
 	sshTimeout := flag.Duration("ssh-timeout", 10*time.Second, "Timeout value for SSH connections")
+	commandTimeout := flag.Duration("command-timeout", 0, "Maximum time the command may take per host (0 for no limit; host command_timeout and the file's default_command_timeout apply when set)")
+	socks5Proxy := flag.String("socks5-proxy", "", "SOCKS5 proxy to connect through: socks5://[user:pass@]host:port (default $ALL_PROXY if it is socks5)")
+	preferFamily := flag.Int("prefer-family", 0, "Address family to dial first for dual-stack host names: 4 or 6 (0 leaves it to the resolver)")
+	ciphers := flag.String("ciphers", "", "Comma-separated SSH ciphers to offer, in order of preference (default: library defaults)")
+	kexAlgorithms := flag.String("kex-algorithms", "", "Comma-separated SSH key exchange algorithms to offer, in order of preference")
+	var sshCiphers, sshKex, sshMACs stringSliceFlag
+	flag.Var(&sshCiphers, "ssh-cipher", "SSH cipher to offer (repeatable, in order of preference, added after --ciphers)")
+	flag.Var(&sshKex, "ssh-kex", "SSH key exchange algorithm to offer (repeatable, in order of preference, added after --kex-algorithms)")
+	flag.Var(&sshMACs, "ssh-macs", "SSH MAC algorithms to offer, comma-separated (repeatable, in order of preference; default: library defaults)")
+	hostKeyAlgorithms := flag.String("host-key-algorithms", "", "Comma-separated host key algorithms to accept, in order of preference")
+	connectRate := flag.Float64("connect-rate", 0, "Maximum new SSH connections per second across all hosts, however many commands run in parallel (0 for no limit)")
+	connectBurst := flag.Int("connect-burst", 1, "Connections that may start at once before --connect-rate pacing kicks in")
+	connectTest := flag.Bool("connect-test", false, "Try a bare TCP connect to each host before SSH, so unreachable hosts fail with a distinct error")
+	maxOutputMBTotal := flag.Int64("max-output-mb-total", 0, "Output budget in MB across all hosts; once it is nearly used up, ask before starting more hosts (0 for no limit)")
+	maxCostAbort := flag.Bool("max-cost-abort", false, "Start no more hosts once --max-output-mb-total is nearly used up, instead of asking")
+	preflight := flag.Bool("preflight", false, "Probe every host's port with a bare TCP connect before any SSH, failing unreachable hosts right away")
+	preflightTimeout := flag.Duration("preflight-timeout", 1500*time.Millisecond, "How long each --preflight probe may take")
+	preflightParallel := flag.Int("preflight-parallel", 256, "Number of --preflight probes run at once")
+	preflightAttempt := flag.Bool("preflight-attempt-unreachable", false, "Still run on hosts that failed --preflight, with the full --ssh-timeout, instead of failing them")
+	connectTestTimeout := flag.Duration("connect-test-timeout", 2*time.Second, "How long the --connect-test TCP connect may take")
+	maxSessions := flag.Int("max-sessions", runner.DefaultMaxSessions, "Maximum concurrent sessions on one host's shared SSH connection (match the server's MaxSessions)")
+	keepaliveInterval := flag.Duration("keepalive-interval", 30*time.Second, "Interval between SSH keepalive requests (0 to disable)")
+	keepaliveMissed := flag.Int("keepalive-max-missed", 3, "Unanswered keepalives after which the connection is considered lost")
+	outputFormat := flag.String("output", "text", "Output format: text, ndjson for one JSON object per host as results arrive, or table for an aligned table once all hosts are done")
+	outputColumns := flag.String("output-columns", "", "Comma-separated columns of --output table: host, status, exit_code, duration, output, error (default host,status,exit_code,duration,output)")
+	truncateColumns := flag.Bool("truncate-columns", false, "Cut the output column of --output table short so rows fit the terminal width")
+	outputTemplate := flag.String("output-template", "", "Go text/template used to format each result")
+	outputTemplateFile := flag.String("output-template-file", "", "File containing a Go text/template used to format each result")
+	colorErrorsOnly := flag.Bool("color-errors-only", false, "Color failed hosts and their errors red in the text output, leaving successful ones uncolored")
+	noColor := flag.Bool("no-color", false, "Never color the output")
+	reportHTMLFile := flag.String("report-html", "", "Write a self-contained HTML report of the run to this file")
+	metricsTextfile := flag.String("metrics-textfile", "", "Write Prometheus metrics of the run to this file (node_exporter textfile collector format)")
+	metricsPushgateway := flag.String("metrics-pushgateway", "", "Push Prometheus metrics of the run to this Pushgateway URL")
+	metricsJob := flag.String("metrics-job", "server-manager", "Job label for --metrics-pushgateway")
+	metricsInstance := flag.String("metrics-instance", "", "Instance label for --metrics-pushgateway (default: local hostname)")
+	junitReportFile := flag.String("junit-report", "", "Write a JUnit XML report of the run to this file")
+	var envPairs stringSliceFlag
+	flag.Var(&envPairs, "env", "Environment variable KEY=VALUE to set in the remote session (repeatable; requires AcceptEnv on the server)")
+	envFile := flag.String("env-file", "", "File of KEY=VALUE lines to set in the remote session")
+	templateVarsFile := flag.String("template-vars-file", "", "JSON or YAML file with default template variables (overridden by host vars and --var)")
+	var templateVars stringSliceFlag
+	flag.Var(&templateVars, "var", "Template variable KEY=VALUE available to the command as {{.KEY}} (repeatable, overrides host vars)")
+	envExportFallback := flag.Bool("env-export-fallback", false, "Prefix the command with export statements when the server rejects environment variables")
+	remoteShell := flag.String("remote-shell", runner.RemoteShellNone, "Shell the command runs in: bash or sh (wrapped as exec <shell> -c '<command>', for hosts whose login shell is fish or csh), or none to leave it to the login shell")
+	execMode := flag.String("exec-mode", runner.ExecShell, "How the remote side parses the command: shell (pipes, globs and $VARS work) or exec (split into arguments and passed literally, nothing is expanded)")
+	maxOutputBytes := flag.Int64("max-output-bytes", 4<<20, "Keep at most the last this many bytes of output per host, discarding earlier output as it arrives and marking the result as truncated (0 for no limit)")
+	maxOutputError := flag.Bool("max-output-error", false, "Count hosts whose output went past --max-output-bytes as failed")
+	pty := flag.Bool("pty", false, "Allocate a pseudo-terminal for the command (stderr is merged into stdout)")
+	ptyRows := flag.Int("pty-rows", 24, "Rows of the pseudo-terminal allocated with --pty (default: the local terminal's, or 24)")
+	ptyCols := flag.Int("pty-cols", 80, "Columns of the pseudo-terminal allocated with --pty (default: the local terminal's, or 80)")
+	commandPipe := flag.String("command-pipe", "", "Pipe each host's output through this local shell command (e.g. 'grep ERROR | wc -l'), started once per host, and show what it prints instead")
+	outputDir := flag.String("output-dir", "", "Stream each host's whole output into <dir>/<host>.log as it arrives, including what --max-output-bytes leaves out of the results")
+	outputDirName := flag.String("output-dir-name", defaultOutputDirName, "File name template for --output-dir files, with the same variables as the command, e.g. '{{index .Groups 0}}/{{.Host}}-{{.Index}}.log'")
+	teeOutput := flag.String("tee-output", "", "Also write everything printed to stdout and stderr to this file (truncated first), like tee")
+	recordFile := flag.String("record", "", "Record the results as an asciinema v2 cast to this file")
+	diffMode := flag.Bool("diff", false, "Only show hosts whose output differs from the most common output, and exit 1 if any do")
+	diffFile := flag.String("diff-file", "", "Compare each host's output against a baseline saved with --output ndjson, show a unified diff for changed hosts, and exit 1 if any changed")
+	sortOutput := flag.String("sort-output", "", "Hold results until the run ends, then print them sorted by host, duration, status (failures last) or config (the file's order, even with --shuffle)")
+	groupOutput := flag.Bool("group-output", false, "Group hosts that returned identical output, most common output first")
+	groupMaxHosts := flag.Int("group-max-hosts", 5, "Hosts listed per group before summarizing the rest as \"... and N more\"")
+	groupVerbose := flag.Bool("group-verbose", false, "List every host of each group with --group-output")
+	expectPattern := flag.String("expect", "", "Fail hosts whose output does not match this regular expression, even if the command succeeded (exits 1 if any host fails it)")
+	expectNotPattern := flag.String("expect-not", "", "Fail hosts whose output matches this regular expression, even if the command succeeded (exits 1 if any host fails it)")
+	assertPattern := flag.String("assert", "", "Same as --expect")
+	assertNotPattern := flag.String("assert-not", "", "Same as --expect-not")
+	outputFilterPattern := flag.String("output-filter", "", "Don't print results whose output matches this regular expression (they still count in the summary)")
+	outputFilterInvert := flag.Bool("output-filter-invert", false, "Only print results whose output matches --output-filter")
+	hostFilter := flag.String("filter", "", "Only run on hosts whose name matches this regular expression")
+	hostsRegex := flag.String("hosts-regex", "", "Only run on hosts whose name matches this regular expression (applied before --hosts-regex-exclude)")
+	hostsRegexExclude := flag.String("hosts-regex-exclude", "", "Leave out hosts whose name matches this regular expression")
+	hostFilterGlob := flag.String("filter-glob", "", "Only run on hosts whose name matches this glob pattern")
+	allowEmpty := flag.Bool("allow-empty", false, "Don't fail when filtering leaves no hosts")
+	allowDuplicates := flag.Bool("allow-duplicates", false, "Run on every listed host, even several that connect to the same user, host and port")
+	var excludes stringSliceFlag
+	flag.Var(&excludes, "exclude", "Host name or glob to leave out of the run (repeatable)")
+	excludeFile := flag.String("exclude-file", "", "File listing host names or globs to leave out of the run, one per line")
+	limit := flag.Int("limit", 0, "Only run on the first N hosts left after filters and exclusions (0 for no limit)")
+	shuffle := flag.Bool("shuffle", false, "Randomize the host order before applying --limit and running")
+	shuffleSeed := flag.Int64("shuffle-seed", 0, "Seed for --shuffle, to repeat an earlier order (default: random, logged at the start of the run)")
+	flag.Int64Var(shuffleSeed, "seed", 0, "Same as --shuffle-seed")
+	listHosts := flag.Bool("list-hosts", false, "Print the hosts that would be targeted and exit")
+	checkConn := flag.Bool("check", false, "Only check that each host can be reached and logged into (dial, handshake, auth, session) instead of running a command")
+	factsMode := flag.Bool("facts", false, "Gather facts (hostname, kernel, OS, uptime, disk usage and the config file's facts) from each host instead of running a command")
+	factsFormat := flag.String("facts-format", "table", "Output format of --facts: table, or json for a document keyed by host")
+	copySource := flag.String("copy", "", "Upload this local file to every host (to --copy-dest) instead of running a command")
+	copyDest := flag.String("copy-dest", "", "Remote path --copy writes the file to")
+	copyVerify := flag.Bool("copy-verify", false, "Skip the --copy upload where the destination already has the same SHA-256, and check it after uploading")
+	checkHTTP := flag.Bool("check-http", false, "Check an HTTP health endpoint on each host instead of running a command over SSH")
+	httpScheme := flag.String("http-scheme", "http", "Scheme used by --check-http (http or https)")
+	httpPort := flag.Int("http-port", 80, "Port used by --check-http")
+	httpPath := flag.String("http-path", "/health", "Path requested by --check-http")
+	httpExpect := flag.String("http-expect", "", "String the --check-http response body must contain")
+	httpTimeout := flag.Duration("http-timeout", 10*time.Second, "Timeout for each --check-http request")
+	slackWebhook := flag.String("slack-webhook", "", "Slack incoming webhook URL to notify when the run completes")
+	slackOnFailureOnly := flag.Bool("slack-on-failure-only", false, "Only send the Slack notification when at least one host failed")
+	notifyURL := flag.String("notify-url", "", "URL to POST a JSON run summary to when the run completes")
+	webhookURL := flag.String("webhook-url", "", "Same as --notify-url")
+	webhookSecret := flag.String("webhook-secret", "", "Sign the --notify-url payload with HMAC-SHA256 in an X-Signature-256 header (default $"+webhookSecretEnv+")")
+	notifyTemplate := flag.String("notify-template", "", "Go template shaping the --notify-url payload (e.g. into a Slack message)")
+	notifyOn := flag.String("notify-on", "always", "When to send the --notify-url notification: failure or always")
+	pagerDutyKey := flag.String("pagerduty-key", "", "PagerDuty Events v2 integration key to trigger when too many hosts fail")
+	pagerDutyThreshold := flag.String("pagerduty-threshold", "50%", "Failure rate above which a PagerDuty incident is triggered")
+	hostsFromTFState := flag.String("hosts-from-tfstate", "", "Take the hosts from the instances in this terraform.tfstate file")
+	consulService := flag.String("consul-service", "", "Take the hosts from the healthy instances of this Consul service")
+	consulAddr := flag.String("consul-addr", "", "Consul HTTP API address for --consul-service (default $CONSUL_HTTP_ADDR or "+runner.DefaultConsulAddr+")")
+	consulToken := flag.String("consul-token", "", "Consul ACL token for --consul-service (default $CONSUL_HTTP_TOKEN)")
+	consulTag := flag.String("consul-tag", "", "Only take --consul-service instances with this tag")
+	consulServicePort := flag.Bool("consul-use-service-port", false, "Dial the --consul-service instances on their registered port instead of port 22")
+	var tfStateResourceTypes stringSliceFlag
+	flag.Var(&tfStateResourceTypes, "tfstate-resource-type", "Terraform resource type to take hosts from (repeatable, default: aws_instance, google_compute_instance, azurerm_linux_virtual_machine)")
+	syslogAddr := flag.String("syslog-addr", "", "Send each result to this syslog server as an RFC 5424 message, e.g. udp://logs.example.com:514 or tcp://...")
+	syslogTag := flag.String("syslog-tag", defaultSyslogTag, "Program name (APP-NAME) of the --syslog-addr messages")
+	resultsDBFile := flag.String("results-db", "", "Record the run and each host's result in this SQLite database, created on first use")
+	var history historyFlag
+	flag.Var(&history, "history", fmt.Sprintf("List the last runs recorded in --results-db and exit: --history for %d, --history=N for N", defaultHistoryRuns))
+	historyShow := flag.String("history-show", "", "Print the results of a run recorded in --results-db (by run ID or a unique prefix) and exit")
+	resultsDBMaxOutput := flag.Int("results-db-max-output", 64<<10, "Bytes of each host's output kept in --results-db (0 for all of it)")
+	auditLogFile := flag.String("audit-log", "", "Append a JSON line per run start and finish (user, command, hosts, results) to this file")
+	stateFile := flag.String("state-file", "", "File recording the per-host outcome of each run, for --retry-failed")
+	retryFailed := flag.Bool("retry-failed", false, "Only run on the hosts that failed in the run recorded in --state-file")
+	healthFile := flag.String("health-file", "", "File tracking how many runs in a row each host has failed, to skip hosts that keep failing (e.g. ~/.server-manager/host-health.json)")
+	healthSkipThreshold := flag.Int("health-skip-threshold", 3, "Skip hosts that failed more than this many runs in a row in --health-file (0 to never skip)")
+	resetHealth := flag.Bool("reset-health", false, "Clear the failure counters in --health-file before running")
+	force := flag.Bool("force", false, "With --retry-failed, allow a command different from the recorded one")
+	canary := flag.Bool("canary", false, "Run on one host first (the file's canary_host, or the first host) and ask before running on the rest")
+	noCanary := flag.Bool("no-canary", false, "Run on all hosts at once even if --canary is given (needed when stdin is not a terminal)")
+	serveAddr := flag.String("serve", "", "Serve a JSON HTTP API for starting runs on this address (e.g. :8080) instead of running --command")
+	serveToken := flag.String("serve-token", "", "Bearer token required by the --serve API (default $"+tokenEnv+")")
+	serveRetention := flag.Int("serve-retention", 100, "Finished runs the --serve API keeps in memory")
+	watch := flag.Duration("watch", 0, "Repeat the run at this interval until interrupted (e.g. 30s)")
+	watchClear := flag.Bool("watch-clear", false, "With --watch, clear the terminal before each iteration instead of appending")
+	hostFileWatch := flag.Bool("host-file-watch", false, "With --watch, reload --server-addresses when it changes, running later iterations on the hosts it lists then")
+	hostFileWatchDebounce := flag.Duration("host-file-watch-debounce", 500*time.Millisecond, "How long the hosts file must be left alone after a change before --host-file-watch reloads it")
+	dryRun := flag.Bool("dry-run", false, "Print the command and target hosts without connecting to any of them or resolving their names")
+	logLevel := flag.String("log-level", "info", "Log level on stderr: error, warn, info or debug (debug shows per-host connection events)")
+	logFormat := flag.String("log-format", "text", "Log format on stderr: text or json")
+	showProgress := flag.Bool("progress", true, "Show a live progress line on stderr while hosts are processed (only when stderr is a terminal and the output isn't ndjson; --progress=false to disable)")
 	flag.Parse()
 
+	// Route all diagnostics to stderr so stdout only carries command output
+	logger, err := newLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+
 	// Validate flag values
-	if *command == "" {
-		log.Fatal("Missing command flag")
+	if *keepaliveInterval > 0 && *keepaliveMissed < 1 {
+		fatal("Flag --keepalive-max-missed must be at least 1")
+	}
+	if *execMode != runner.ExecShell && *execMode != runner.ExecExec {
+		fatal("Flag --exec-mode must be shell or exec")
+	}
+	if !runner.ValidRemoteShell(*remoteShell) {
+		fatal("Flag --remote-shell must be bash, sh or none")
+	}
+	if *resultsDBMaxOutput < 0 {
+		fatal("Flag --results-db-max-output must not be negative")
+	}
+	if *maxOutputBytes < 0 {
+		fatal("Flag --max-output-bytes must not be negative")
+	}
+	if *maxOutputError && *maxOutputBytes == 0 {
+		fatal("Flag --max-output-error needs --max-output-bytes")
+	}
+	if *maxOutputMBTotal < 0 {
+		fatal("Flag --max-output-mb-total must not be negative")
+	}
+	if *maxCostAbort && *maxOutputMBTotal == 0 {
+		fatal("Flag --max-cost-abort needs --max-output-mb-total")
+	}
+	if *connectRate < 0 || *connectBurst < 1 {
+		fatal("Flag --connect-rate must not be negative and --connect-burst must be at least 1")
+	}
+	connectLimiter := runner.NewRateLimiter(*connectRate, *connectBurst)
+	if *preflightTimeout <= 0 || *preflightParallel < 1 {
+		fatal("Flag --preflight-timeout must be positive and --preflight-parallel at least 1")
+	}
+	var connectTestDuration time.Duration
+	if *connectTest {
+		if *connectTestTimeout <= 0 {
+			fatal("Flag --connect-test-timeout must be positive")
+		}
+		connectTestDuration = *connectTestTimeout
+	} else if setFlags["connect-test-timeout"] {
+		fatal("Flag --connect-test-timeout needs --connect-test")
+	}
+	if *preferFamily != 0 && *preferFamily != 4 && *preferFamily != 6 {
+		fatal("Flag --prefer-family must be 4 or 6")
+	}
+	proxyURL, err := selectProxy(*socks5Proxy)
+	if err != nil {
+		fatal("Invalid --socks5-proxy", "error", err)
+	}
+	algorithms := runner.Algorithms{
+		Ciphers:           splitCommaList(*ciphers),
+		KeyExchanges:      splitCommaList(*kexAlgorithms),
+		HostKeyAlgorithms: splitCommaList(*hostKeyAlgorithms),
+	}
+	for _, value := range sshCiphers {
+		algorithms.Ciphers = append(algorithms.Ciphers, splitCommaList(value)...)
+	}
+	for _, value := range sshKex {
+		algorithms.KeyExchanges = append(algorithms.KeyExchanges, splitCommaList(value)...)
+	}
+	for _, value := range sshMACs {
+		algorithms.MACs = append(algorithms.MACs, splitCommaList(value)...)
+	}
+	if err := algorithms.Validate(); err != nil {
+		fatal("Invalid SSH algorithms", "error", err)
+	}
+	if *limit < 0 {
+		fatal("Flag --limit must not be negative")
+	}
+	seeded := setFlags["shuffle-seed"] || setFlags["seed"]
+	if seeded && !*shuffle {
+		fatal("Flag --shuffle-seed needs --shuffle")
+	}
+	if *webhookURL != "" {
+		if *notifyURL != "" && *notifyURL != *webhookURL {
+			fatal("Flags --webhook-url and --notify-url are mutually exclusive")
+		}
+		*notifyURL = *webhookURL
+	}
+	if *webhookSecret == "" {
+		*webhookSecret = os.Getenv(webhookSecretEnv)
+	}
+	if *notifyOn != "always" && *notifyOn != "failure" {
+		fatal("Invalid --notify-on (expected failure or always)", "value", *notifyOn)
+	}
+	pagerDutyRate, err := parsePercent(*pagerDutyThreshold)
+	if err != nil {
+		fatal("Invalid --pagerduty-threshold", "error", err)
+	}
+	var notifyTmpl *template.Template
+	if *notifyTemplate != "" {
+		notifyTmpl, err = ParseNotifyTemplate(*notifyTemplate)
+		if err != nil {
+			fatal("Failed to parse notify template", "error", err)
+		}
+	}
+	if *retryFailed && *stateFile == "" {
+		fatal("Flag --retry-failed requires --state-file")
+	}
+	if *noCanary {
+		*canary = false
+	}
+	if *canary && !term.IsTerminal(int(os.Stdin.Fd())) {
+		fatal("Flag --canary needs a terminal on stdin to confirm; use --no-canary to run on all hosts without asking")
+	}
+	// The progress line is on by default and only an error when asked for
+	// explicitly in a mode it can't work with
+	if *canary && *showProgress {
+		if setFlags["progress"] {
+			fatal("Flags --canary and --progress are mutually exclusive")
+		}
+		*showProgress = false
+	}
+	if *watch < 0 {
+		fatal("Flag --watch must not be negative")
+	}
+	if *watch > 0 && !setFlags["progress"] {
+		*showProgress = false
+	}
+	if *watch > 0 && (*diffMode || *groupOutput || *canary || *showProgress || *junitReportFile != "") {
+		fatal("Flag --watch can't be combined with --diff, --group-output, --canary, --progress or --junit-report")
+	}
+	if *resetHealth && *healthFile == "" {
+		fatal("Flag --reset-health requires --health-file")
+	}
+	if *healthSkipThreshold < 0 {
+		fatal("Flag --health-skip-threshold must not be negative")
+	}
+	if *diffMode && *groupOutput {
+		fatal("Flags --diff and --group-output are mutually exclusive")
+	}
+	if *hostFileWatch {
+		switch {
+		case *watch == 0:
+			fatal("Flag --host-file-watch requires --watch")
+		case *serverAddressesFile == "-" || *hostList != "" || *hostsFromTFState != "" || *consulService != "":
+			fatal("Flag --host-file-watch needs the hosts to come from a --server-addresses file")
+		case *retryFailed || *limit > 0 || *shuffle:
+			fatal("Flag --host-file-watch can't be combined with --retry-failed, --limit or --shuffle")
+		}
+	} else if setFlags["host-file-watch-debounce"] {
+		fatal("Flag --host-file-watch-debounce needs --host-file-watch")
+	}
+	if *diffFile != "" && (*diffMode || *groupOutput || *watch > 0) {
+		fatal("Flag --diff-file can't be combined with --diff, --group-output or --watch")
+	}
+	if *sortOutput != "" && !slices.Contains(sortKeys, *sortOutput) {
+		fatal("Flag --sort-output must be one of " + strings.Join(sortKeys, ", "))
+	}
+	if *sortOutput != "" && (*diffMode || *groupOutput || *diffFile != "") {
+		fatal("Flag --sort-output can't be combined with --diff, --diff-file or --group-output")
+	}
+	if *outputFilterPattern != "" && (*diffMode || *groupOutput || *diffFile != "") {
+		fatal("Flag --output-filter can't be combined with --diff, --diff-file or --group-output")
+	}
+	// Everything after -- is the command's argument list, quoted word by word
+	// so spaces, quotes and $ reach the program literally
+	if args := flag.Args(); len(args) > 0 {
+		if *command != "" || *commandFile != "" || *presetName != "" {
+			fatal("Give the command either after -- or with --command, --command-file or --preset, not both")
+		}
+		*command = runner.QuoteArgs(args)
+	}
+	if *command != "" && *commandFile != "" {
+		fatal("Flags --command and --command-file are mutually exclusive")
+	}
+	if *presetName != "" && (*command != "" || *commandFile != "") {
+		fatal("Flag --preset can't be combined with --command or --command-file")
+	}
+	hostSources := 0
+	for _, source := range []string{*hostList, *hostsFromTFState, *consulService} {
+		if source != "" {
+			hostSources++
+		}
+	}
+	if hostSources > 1 {
+		fatal("Only one of --hosts, --hosts-from-tfstate and --consul-service can be given")
+	}
+	if *pipeStdin {
+		if *commandStdin != "" && *commandStdin != "-" {
+			fatal("Flags --stdin and --command-stdin are mutually exclusive")
+		}
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			fatal("Flag --stdin needs input piped in, stdin is a terminal")
+		}
+		*commandStdin = "-"
+	}
+	stdinReaders := 0
+	stdinSources := []string{*commandFile, *serverAddressesFile, *commandStdin}
+	for _, value := range sshKeys {
+		stdinSources = append(stdinSources, splitCommaList(value)...)
+	}
+	for _, name := range stdinSources {
+		if name == "-" {
+			stdinReaders++
+		}
+	}
+	if stdinReaders > 1 {
+		fatal("Only one of --command-file, --server-addresses, --command-stdin (or --stdin) and --ssh-key can read from stdin")
+	}
+	if *commandFile != "" {
+		var err error
+		*command, err = readCommandFile(*commandFile)
+		if err != nil {
+			fatal("Failed to read command file", "error", err)
+		}
+	}
+	if *httpScheme != "http" && *httpScheme != "https" {
+		fatal("Flag --http-scheme must be http or https")
+	}
+
+	// Load the host health counters, clearing them first if asked to
+	var healthStore *HostHealthStore
+	if *healthFile != "" {
+		path, err := expandTilde(*healthFile)
+		if err != nil {
+			fatal("Failed to expand health file path", "error", err)
+		}
+		*healthFile = path
+		if healthStore, err = LoadHostHealthStore(path); err != nil {
+			fatal("Failed to load host health", "error", err)
+		}
+		if *resetHealth {
+			healthStore.Reset()
+			if err := healthStore.Save(path); err != nil {
+				fatal("Failed to write host health", "error", err)
+			}
+			slog.Info("Host health counters cleared", "health_file", path)
+		}
+	}
+
+	if *serveAddr != "" {
+		if *command != "" {
+			fatal("Flag --serve takes commands from the API, not --command or --command-file")
+		}
+		if *serveToken == "" {
+			*serveToken = os.Getenv(tokenEnv)
+		}
+		if *serveToken == "" {
+			fatal("Flag --serve needs a token (--serve-token or $" + tokenEnv + ")")
+		}
+		if *serveRetention < 0 {
+			fatal("Flag --serve-retention must not be negative")
+		}
+	}
+	if *checkConn && (*checkHTTP || *command != "" || *presetName != "" || *serveAddr != "") {
+		fatal("Flag --check can't be combined with --check-http, --command, --preset or --serve")
+	}
+	if *serveAddr != "" && *presetName != "" {
+		fatal("Flag --serve takes commands from the API, not --preset")
+	}
+	if *factsMode {
+		if *checkConn || *checkHTTP || *command != "" || *presetName != "" || *serveAddr != "" || *watch > 0 {
+			fatal("Flag --facts can't be combined with --check, --check-http, --command, --preset, --serve or --watch")
+		}
+		if *factsFormat != "table" && *factsFormat != "json" {
+			fatal("Flag --facts-format must be table or json")
+		}
+	}
+	// The output column of tables fits the terminal, if there is one
+	tableWidth := 0
+	if *truncateColumns {
+		if *outputFormat != "table" {
+			fatal("Flag --truncate-columns needs --output table")
+		}
+		if width, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+			tableWidth = width
+		} else {
+			slog.Debug("Not truncating table columns, stdout is not a terminal", "error", err)
+		}
+	}
+	copyMode := *copySource != ""
+	if copyMode {
+		if *checkConn || *checkHTTP || *factsMode || *command != "" || *presetName != "" || *serveAddr != "" || *watch > 0 {
+			fatal("Flag --copy can't be combined with --check, --check-http, --facts, --command, --preset, --serve or --watch")
+		}
+		if *copyDest == "" {
+			fatal("Flag --copy needs --copy-dest")
+		}
+		if *outputFormat != "text" && *outputFormat != "ndjson" {
+			fatal("Flag --copy prints text or ndjson output")
+		}
+	} else if *copyDest != "" || *copyVerify {
+		fatal("Flags --copy-dest and --copy-verify need --copy")
+	}
+	// Show earlier runs from the results database instead of running
+	if history.Runs > 0 || *historyShow != "" {
+		if *resultsDBFile == "" {
+			fatal("Flags --history and --history-show read the --results-db database, which isn't set")
+		}
+		if history.Runs > 0 && *historyShow != "" {
+			fatal("Flags --history and --history-show are mutually exclusive")
+		}
+		if *command != "" || *presetName != "" || *serveAddr != "" || *factsMode || *checkConn || *checkHTTP {
+			fatal("Flags --history and --history-show don't run anything, drop the command")
+		}
+		formatter, err := newResultFormatter(*outputFormat, *outputTemplate, *outputTemplateFile, splitCommaList(*outputColumns), tableWidth)
+		if err != nil {
+			fatal("Failed to set up output formatting", "error", err)
+		}
+		db, err := OpenExistingResultsDB(*resultsDBFile)
+		if err != nil {
+			fatal("Failed to open results database", "error", err)
+		}
+		defer db.Close()
+		if *historyShow != "" {
+			run, results, err := db.RunResults(*historyShow)
+			if err != nil {
+				fatal("Failed to read run", "error", err)
+			}
+			printHistoryRun(os.Stdout, run, results, formatter)
+			return
+		}
+		runs, err := db.Runs(history.Runs)
+		if err != nil {
+			fatal("Failed to read history", "error", err)
+		}
+		if err := printHistory(os.Stdout, runs, *outputFormat); err != nil {
+			fatal("Failed to print history", "error", err)
+		}
+		return
+	}
+	if *outputDir != "" && (*checkHTTP || *checkConn || *factsMode || copyMode || *serveAddr != "") {
+		fatal("Flag --output-dir only applies to running a command")
+	}
+	if *outputDirName != defaultOutputDirName {
+		if *outputDir == "" {
+			fatal("Flag --output-dir-name needs --output-dir")
+		}
+		if _, err := runner.ParseCommandTemplate(*outputDirName); err != nil {
+			fatal("Invalid --output-dir-name template", "error", err)
+		}
+	}
+	if *commandPipe != "" && (*checkHTTP || *checkConn || *factsMode || copyMode || *serveAddr != "") {
+		fatal("Flag --command-pipe only applies to running a command")
+	}
+	if *command == "" && *presetName == "" && !*listPresets && !*listHosts && !*checkHTTP && !*checkConn && !*factsMode && !copyMode && *serveAddr == "" {
+		// --reset-health on its own only clears the counters
+		if *resetHealth {
+			return
+		}
+		fatal("Missing command flag (use --command, --command-file or --preset)")
+	}
+
+	// Read the remote stdin once; every host gets its own reader over it
+	var remoteStdin []byte
+	if *commandStdin != "" {
+		source := os.Stdin
+		if *commandStdin != "-" {
+			f, err := os.Open(*commandStdin)
+			if err != nil {
+				fatal("Failed to read command stdin", "error", err)
+			}
+			defer f.Close()
+			source = f
+		}
+		var err error
+		remoteStdin, err = ioutil.ReadAll(io.LimitReader(source, maxRemoteStdin+1))
+		if err != nil {
+			fatal("Failed to read command stdin", "error", err)
+		}
+		if len(remoteStdin) > maxRemoteStdin {
+			fatal(fmt.Sprintf("Command stdin is larger than %d MiB, copy the data to the hosts first", maxRemoteStdin>>20))
+		}
+		slog.Debug("Read command stdin", "bytes", len(remoteStdin))
+	}
+
+	// Collect environment variables, file first so --env can override
+	var env []runner.EnvVar
+	if *envFile != "" {
+		vars, err := readEnvFile(*envFile)
+		if err != nil {
+			fatal("Failed to read env file", "error", err)
+		}
+		env = append(env, vars...)
+	}
+	for _, pair := range envPairs {
+		v, err := parseEnvVar(pair)
+		if err != nil {
+			fatal(err.Error())
+		}
+		env = append(env, v)
+	}
+
+	// Parse the command template up front so syntax errors fail before connecting
+	if _, err := runner.ParseCommandTemplate(*command); err != nil {
+		fatal("Failed to parse command template", "error", err)
+	}
+	var fileVars map[string]string
+	if *templateVarsFile != "" {
+		fileVars, err = runner.ReadVarsFile(*templateVarsFile)
+		if err != nil {
+			fatal("Failed to read template vars file", "error", err)
+		}
+	}
+	globalVars := make(map[string]string)
+	for _, pair := range templateVars {
+		name, value, err := parseKeyValue(pair)
+		if err != nil {
+			fatal(err.Error())
+		}
+		globalVars[name] = value
+	}
+
+	// Compile the output expectations once for all hosts
+	if *expectPattern != "" && *assertPattern != "" || *expectNotPattern != "" && *assertNotPattern != "" {
+		fatal("Flags --expect and --expect-not replace --assert and --assert-not; use only one of each pair")
+	}
+	if *expectPattern == "" {
+		expectPattern = assertPattern
+	}
+	if *expectNotPattern == "" {
+		expectNotPattern = assertNotPattern
+	}
+	var assertRegexp, assertNotRegexp *regexp.Regexp
+	if *expectPattern != "" {
+		var err error
+		assertRegexp, err = regexp.Compile(*expectPattern)
+		if err != nil {
+			fatal("Invalid --expect", "error", err)
+		}
+	}
+	if *expectNotPattern != "" {
+		var err error
+		assertNotRegexp, err = regexp.Compile(*expectNotPattern)
+		if err != nil {
+			fatal("Invalid --expect-not", "error", err)
+		}
+	}
+
+	// Compile the output filter, which only affects what is printed
+	var outputFilterRegexp *regexp.Regexp
+	if *outputFilterPattern != "" {
+		var err error
+		outputFilterRegexp, err = regexp.Compile(*outputFilterPattern)
+		if err != nil {
+			fatal("Invalid --output-filter", "error", err)
+		}
+	}
+	if *outputFilterInvert && outputFilterRegexp == nil {
+		fatal("Flag --output-filter-invert requires --output-filter")
+	}
+
+	// Compile the host filter before anything connects
+	var hostFilterRegexp *regexp.Regexp
+	if *hostFilter != "" {
+		var err error
+		hostFilterRegexp, err = regexp.Compile(*hostFilter)
+		if err != nil {
+			fatal("Invalid --filter", "error", err)
+		}
+	}
+	var hostsRegexp, hostsExcludeRegexp *regexp.Regexp
+	if *hostsRegex != "" {
+		var err error
+		hostsRegexp, err = regexp.Compile(*hostsRegex)
+		if err != nil {
+			fatal("Invalid --hosts-regex", "error", err)
+		}
+	}
+	if *hostsRegexExclude != "" {
+		var err error
+		hostsExcludeRegexp, err = regexp.Compile(*hostsRegexExclude)
+		if err != nil {
+			fatal("Invalid --hosts-regex-exclude", "error", err)
+		}
+	}
+	if _, err := path.Match(*hostFilterGlob, ""); err != nil {
+		fatal("Invalid --filter-glob", "error", err)
+	}
+
+	// Collect exclusions
+	if *excludeFile != "" {
+		patterns, err := readPatternFile(*excludeFile)
+		if err != nil {
+			fatal("Failed to read exclude file", "error", err)
+		}
+		excludes = append(excludes, patterns...)
 	}
 
 	// Read server addresses from YAML file
 	config, err := readConfig(*serverAddressesFile)
 	if err != nil {
-		log.Fatalf("Failed to read server addresses: %v", err)
+		// The file is only needed for aliases when hosts come from elsewhere
+		if hostSources == 0 || !errors.Is(err, os.ErrNotExist) {
+			fatal("Failed to read server addresses", "error", err)
+		}
+		config = &runner.Config{}
 	}
 
-	// Expand tilde (~) in SSH key path
-	expandedKeyPath, err := expandTilde(*sshKey)
-	if err != nil {
-		log.Fatalf("Failed to expand SSH key path: %v", err)
+	if *listPresets {
+		printPresets(os.Stdout, config)
+		return
+	}
+	// Run a preset as if it had been given with --command
+	var preset runner.Preset
+	if *presetName != "" {
+		preset, err = config.Preset(*presetName)
+		if err != nil {
+			fatal("Failed to select preset", "error", err)
+		}
+		*command = preset.Command
+		if _, err := runner.ParseCommandTemplate(*command); err != nil {
+			fatal("Failed to parse preset command template", "preset", *presetName, "error", err)
+		}
+		if *commandTimeout == 0 {
+			*commandTimeout = preset.Timeout
+		}
 	}
 
-	// Create a limited concurrency parallelism pattern
-	// using the specified number of parallel requests
-	semaphore := make(chan struct{}, *parallelRequests)
+	// Fill in the flags that weren't given from the defaults section
+	settings := applyDefaults(config, setFlags, defaultableFlags{
+		sshKeys:          &sshKeys,
+		parallelRequests: parallelRequests,
+		sshTimeout:       sshTimeout,
+		commandTimeout:   commandTimeout,
+		output:           outputFormat,
+		knownHosts:       knownHostsFile,
+	})
+	if len(trustedCAs) > 0 {
+		for i := range settings {
+			if settings[i].Name == "known_hosts" && *knownHostsFile == "" {
+				settings[i].Value = "none (only CA-signed host certificates accepted)"
+			}
+		}
+		settings = append(settings, setting{Name: "ssh_trusted_ca", Value: strings.Join(trustedCAs, ","), Source: "flag --ssh-trusted-ca-cert"})
+	}
+	logSettings(settings)
+	if *pty {
+		// Size the remote terminals like the local one
+		if cols, rows, err := term.GetSize(int(os.Stdout.Fd())); err == nil {
+			if !setFlags["pty-rows"] {
+				*ptyRows = rows
+			}
+			if !setFlags["pty-cols"] {
+				*ptyCols = cols
+			}
+		}
+		if *parallelRequests > 1 {
+			slog.Warn("Each host gets its own terminal with --pty; with --parallel-requests above 1 their output isn't laid out for the local screen", "parallel_requests", *parallelRequests)
+		}
+	}
+	if *knownHostsUpdate && *knownHostsFile == "" {
+		fatal("Flag --known-hosts-update requires --known-hosts")
+	}
+	if *knownHostsStrict && (*knownHostsFile == "" || *knownHostsUpdate) {
+		fatal("Flag --ssh-known-hosts-strict requires --known-hosts and can't be combined with --known-hosts-update")
+	}
 
-	// Execute command on each server concurrently
-	results := make(chan CommandResult)
-	var wg sync.WaitGroup
+	// Select the result formatter
+	formatter, err := newResultFormatter(*outputFormat, *outputTemplate, *outputTemplateFile, splitCommaList(*outputColumns), tableWidth)
+	if err != nil {
+		fatal("Failed to set up output formatting", "error", err)
+	}
+	if *colorErrorsOnly {
+		if *noColor {
+			fatal("Flags --color-errors-only and --no-color are mutually exclusive")
+		}
+		if _, ok := formatter.(textFormatter); !ok {
+			fatal("Flag --color-errors-only only applies to the plain text output, drop --output ndjson and output templates")
+		}
+		formatter = ColorPrinter{ErrorsOnly: true}
+	}
 
-	for _, host := range config.Hosts {
-		wg.Add(1)
-		go func(host string) {
-			defer wg.Done()
+	// Load the baseline before running so a bad file fails early
+	var baseline []CommandResult
+	if *diffFile != "" {
+		baseline, err = readBaseline(*diffFile)
+		if err != nil {
+			fatal("Failed to read --diff-file baseline", "error", err)
+		}
+	}
 
-			semaphore <- struct{}{} // Acquire a semaphore slot
-			output, err := executeCommand(host, *command, expandedKeyPath, *sshTimeout)
-			<-semaphore // Release the semaphore slot
+	// Copy the console output into --tee-output, opening it before any host
+	// is contacted. Errors are logged on stderr, so that is copied as well.
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if *teeOutput != "" {
+		teeFile, err := os.Create(*teeOutput)
+		if err != nil {
+			fatal("Failed to create --tee-output file", "error", err)
+		}
+		defer teeFile.Close()
+		stdout = io.MultiWriter(os.Stdout, teeFile)
+		stderr = io.MultiWriter(os.Stderr, teeFile)
+		logger, _ := newLogger(stderr, *logLevel, *logFormat)
+		slog.SetDefault(logger)
+	}
+	if *hostList != "" {
+		// Keep the vars of hosts that are also listed in the file
+		known := make(map[string]runner.HostEntry)
+		for _, entry := range config.Hosts {
+			known[entry.Host] = entry
+		}
 
-			results <- CommandResult{
-				Host:   host,
-				Output: output,
-				Error:  err,
+		config.Hosts = nil
+		for _, host := range strings.Split(*hostList, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				entry, ok := known[host]
+				if !ok {
+					entry = runner.HostEntry{Host: host}
+				}
+				config.Hosts = append(config.Hosts, entry)
 			}
-		}(host)
+		}
 	}
 
-	// Wait for all goroutines to finish and close the results channel
-	go func() {
-		wg.Wait()
-		close(results)
-	}()
+	if *hostsFromTFState != "" {
+		data, err := ioutil.ReadFile(*hostsFromTFState)
+		if err != nil {
+			fatal("Failed to read Terraform state", "error", err)
+		}
+		parser := &runner.TerraformStateParser{ResourceTypes: tfStateResourceTypes}
+		config.Hosts, err = parser.Parse(data)
+		if err != nil {
+			fatal("Failed to parse Terraform state", "error", err)
+		}
+	}
 
-	// Collect and display results
-	for result := range results {
-		if result.Error != nil {
-			log.Printf("Failed to execute command on %s: %v", result.Host, result.Error)
-		} else {
-			fmt.Printf("Output from %s:\n%s\n", result.Host, result.Output)
+	if *consulService != "" {
+		if *consulAddr == "" {
+			*consulAddr = os.Getenv("CONSUL_HTTP_ADDR")
+		}
+		if *consulToken == "" {
+			*consulToken = os.Getenv("CONSUL_HTTP_TOKEN")
+		}
+		var discovery runner.HostDiscovery = &runner.ConsulDiscovery{
+			Addr:           *consulAddr,
+			Token:          *consulToken,
+			Service:        *consulService,
+			Tag:            *consulTag,
+			UseServicePort: *consulServicePort,
+			Client:         &http.Client{Timeout: 30 * time.Second},
+		}
+		config.Hosts, err = discovery.Discover(context.Background())
+		if err != nil {
+			fatal("Failed to discover hosts from Consul", "service", *consulService, "error", err)
 		}
+		slog.Debug("Discovered hosts", "source", "consul", "service", *consulService, "hosts", len(config.Hosts))
 	}
-}
 
-func readConfig(filename string) (*Config, error) {
-	data, err := ioutil.ReadFile(filename)
+	// Pick the previously failed hosts when retrying
+	var runState *RunState
+	if *retryFailed {
+		runState, err = LoadRunState(*stateFile)
+		if err != nil {
+			fatal("Failed to load state", "error", err)
+		}
+		if runState.Command != *command && !*force {
+			fatal("Command differs from the recorded run; use --force to retry anyway", "recorded", runState.Command)
+		}
+
+		failed := runState.FailedHosts()
+		if len(failed) == 0 {
+			slog.Info("No failed hosts recorded, nothing to retry", "state_file", *stateFile)
+			return
+		}
+		config.Hosts = selectFailedHosts(config.Hosts, failed)
+	}
+
+	// Narrow the host list down with the filters
+	var filtered []runner.HostEntry
+	config.Hosts, filtered, err = filterHosts(config.Hosts, hostFilterRegexp, *hostFilterGlob)
 	if err != nil {
-		return nil, err
+		fatal("Failed to filter hosts", "error", err)
+	}
+	if hostsRegexp != nil || hostsExcludeRegexp != nil {
+		var dropped []runner.HostEntry
+		config.Hosts, dropped = filterEntriesByRegex(config.Hosts, hostsRegexp, hostsExcludeRegexp)
+		filtered = append(filtered, dropped...)
+	}
+	if len(config.Hosts) == 0 && len(filtered) > 0 && !*allowEmpty {
+		fatal("No hosts match the host filter (use --allow-empty to allow this)")
 	}
 
-	config := &Config{}
-	err = yaml.Unmarshal(data, config)
+	// Leave out excluded hosts, warning about exclusions that look like typos
+	var excluded []runner.HostEntry
+	var unusedExcludes []string
+	config.Hosts, excluded, unusedExcludes, err = excludeHosts(config.Hosts, excludes)
 	if err != nil {
-		return nil, err
+		fatal("Failed to exclude hosts", "error", err)
+	}
+	for _, pattern := range unusedExcludes {
+		slog.Warn("Exclusion does not match any host", "pattern", pattern)
 	}
 
-	return config, nil
-}
+	// Skip hosts that keep failing
+	var unhealthy []runner.HostEntry
+	if healthStore != nil {
+		config.Hosts, unhealthy = skipUnhealthyHosts(config.Hosts, healthStore, *healthSkipThreshold)
+		for _, entry := range unhealthy {
+			health := healthStore.Hosts[entry.Host]
+			slog.Warn("Skipping unhealthy host (use --reset-health to retry it)", "host", entry.Host, "failures", health.Failures, "last_error", health.LastError)
+		}
+	}
 
-func executeCommand(host, command, keyPath string, timeout time.Duration) (string, error) {
-	// Read private key file
-	keyBytes, err := ioutil.ReadFile(keyPath)
+	// Shuffle, then cap the number of hosts
+	configOrder := make(map[string]int, len(config.Hosts))
+	for i, entry := range config.Hosts {
+		configOrder[entry.Host] = i
+	}
+	if *shuffle {
+		if !seeded {
+			*shuffleSeed = time.Now().UnixNano()
+		}
+		slog.Info("Shuffling hosts (repeat this order with --shuffle-seed)", "seed", *shuffleSeed)
+		rng := rand.New(rand.NewSource(*shuffleSeed))
+		rng.Shuffle(len(config.Hosts), func(i, j int) {
+			config.Hosts[i], config.Hosts[j] = config.Hosts[j], config.Hosts[i]
+		})
+	}
+	var unselected []runner.HostEntry
+	if *limit > 0 && *limit < len(config.Hosts) {
+		unselected = config.Hosts[*limit:]
+		config.Hosts = config.Hosts[:*limit]
+		slog.Warn("Running on a subset of the hosts because of --limit", "limit", *limit, "skipped", len(unselected))
+	}
+	targets, err := buildTargets(config, *commandTimeout)
 	if err != nil {
-		return "", err
+		fatal("Failed to set up hosts", "error", err)
 	}
 
-	// Parse private key
-	signer, err := ssh.ParsePrivateKey(keyBytes)
-	if err != nil {
-		return "", err
+	// Run once on hosts listed twice or reached under different names
+	var duplicates int
+	if !*allowDuplicates {
+		config.Hosts, targets, duplicates = dropDuplicateHosts(config.Hosts, targets)
 	}
+	hosts := runner.HostNames(config.Hosts)
 
-	// SSH configuration
-	config := &ssh.ClientConfig{
-		User: "root",
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
-		Timeout:         timeout,
+	// Built-in fact probes, replaced or extended by the config file's
+	var factProbes []runner.FactProbe
+	if *factsMode {
+		factProbes, err = runner.MergeFactProbes(runner.DefaultFactProbes, config.Facts)
+		if err != nil {
+			fatal("Invalid facts in config", "error", err)
+		}
 	}
 
-	// SSH connection
-	conn, err := ssh.Dial("tcp", host+":22", config)
-	if err != nil {
-		return "", err
+	if *listHosts {
+		for _, host := range hosts {
+			fmt.Fprintln(stdout, host)
+		}
+		return
 	}
-	defer conn.Close()
 
-	// SSH session
-	session, err := conn.NewSession()
-	if err != nil {
-		return "", err
+	// Report every problem with the config at once, before anything runs;
+	// a dry run doesn't even resolve the host names
+	if !*checkHTTP {
+		lookup := runner.LookupFunc(net.DefaultResolver.LookupHost)
+		if *dryRun {
+			lookup = nil
+		}
+		problems := runner.ValidateConfig(config, runner.Options{Timeout: *sshTimeout, Proxy: proxyURL}, lookup)
+		check := &runner.Runner{Targets: targets, Vars: globalVars, DefaultVars: fileVars}
+		problems = append(problems, check.ValidateCommand(*command)...)
+		for _, problem := range problems {
+			slog.Error("Invalid config", "host", problem.Host, "error", problem.Err)
+		}
+		if len(problems) > 0 {
+			fatal("Config validation failed", "problems", len(problems))
+		}
 	}
-	defer session.Close()
 
-	// Execute the command
-	output, err := session.CombinedOutput(command)
-	if err != nil {
-		return "", err
+	if *dryRun {
+		preview := &runner.Runner{Targets: targets, Vars: globalVars, DefaultVars: fileVars, Options: runner.Options{ExecMode: *execMode, RemoteShell: *remoteShell, Sudo: preset.Sudo}}
+		printDryRun(stdout, *command, env, settings, preview)
+		return
+	}
+
+	// Expand tilde (~) in the SSH key paths and parse each key once for all
+	// hosts, with per-host keys from the config replacing the global ones
+	var keys []runner.Key
+	var keyboardInteractive *runner.KeyboardInteractive
+	if !*checkHTTP {
+		// Keyboard-interactive auth is only offered when answers were given
+		if *password == "" {
+			*password = os.Getenv(passwordEnv)
+		}
+		if *password != "" || len(kiAnswers) > 0 {
+			keyboardInteractive = &runner.KeyboardInteractive{Password: *password, Answers: kiAnswers}
+		}
+
+		var keyPaths []string
+		for _, value := range sshKeys {
+			keyPaths = append(keyPaths, splitCommaList(value)...)
+		}
+
+		needGlobal := len(keyPaths) > 0
+		hostKeys := make(map[string][]runner.Key)
+		for i, entry := range config.Hosts {
+			if entry.Key == "" {
+				needGlobal = true
+				continue
+			}
+			id := entry.Key + "\x00" + entry.Cert
+			if _, ok := hostKeys[id]; !ok {
+				hostKeys[id] = loadKeys([]string{entry.Key}, entry.Cert)
+			}
+			targets[i].Keys = hostKeys[id]
+		}
+
+		if needGlobal {
+			if len(keyPaths) == 0 {
+				keyPaths = []string{"~/.ssh/id_rsa"}
+				// Devices that only do keyboard-interactive need no key
+				if path, err := expandTilde(keyPaths[0]); err == nil && keyboardInteractive != nil {
+					if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+						keyPaths = nil
+					}
+				}
+			}
+			if *sshCert != "" && len(keyPaths) > 1 {
+				fatal("Flag --ssh-cert needs exactly one --ssh-key")
+			}
+			keys = loadKeys(keyPaths, *sshCert)
+		}
+	}
+
+	// Connect to the local agent for forwarding, only when explicitly asked to
+	var forwardedAgent agent.Agent
+	if *forwardAgent && !*checkHTTP {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			fatal("Flag --forward-agent needs a running SSH agent (SSH_AUTH_SOCK is not set)")
+		}
+		agentConn, err := net.Dial("unix", socket)
+		if err != nil {
+			fatal("Failed to connect to SSH agent", "error", err)
+		}
+		defer agentConn.Close()
+		forwardedAgent = agent.NewClient(agentConn)
+	}
+
+	// Verify host keys against known_hosts, recording new keys first if asked to
+	var hostKeyCallback ssh.HostKeyCallback
+	if *knownHostsFile != "" {
+		path, err := expandTilde(*knownHostsFile)
+		if err != nil {
+			fatal("Failed to expand known_hosts path", "error", err)
+		}
+
+		scanOpts := runner.Options{Timeout: *sshTimeout, Proxy: proxyURL, ConnectLimiter: connectLimiter, Algorithms: algorithms, PreferFamily: *preferFamily}
+		if *knownHostsUpdate {
+			if err := updateKnownHosts(context.Background(), path, targets, *parallelRequests, scanOpts); err != nil {
+				fatal("Failed to update known_hosts", "error", err)
+			}
+		}
+		if *knownHostsStrict {
+			if err := checkKnownHostsStrict(context.Background(), path, targets, *parallelRequests, scanOpts); err != nil {
+				fatal("Strict host key check failed", "error", err)
+			}
+		}
+
+		hostKeyCallback, err = knownhosts.New(path)
+		if err != nil {
+			fatal("Failed to load known_hosts", "error", err)
+		}
+	}
+
+	// Accept host certificates signed by a trusted CA, with known_hosts (if
+	// any) for hosts that present plain keys
+	if len(trustedCAs) > 0 {
+		caPaths := make([]string, len(trustedCAs))
+		for i, value := range trustedCAs {
+			if caPaths[i], err = expandTilde(value); err != nil {
+				fatal("Failed to expand SSH CA path", "error", err)
+			}
+		}
+		cas, err := runner.ReadPublicKeys(caPaths)
+		if err != nil {
+			fatal("Failed to load SSH CA keys", "error", err)
+		}
+		if len(cas) == 0 {
+			fatal("No SSH CA keys found in --ssh-trusted-ca-cert files")
+		}
+		var revoked []ssh.PublicKey
+		if *revokedKeysFile != "" {
+			path, err := expandTilde(*revokedKeysFile)
+			if err != nil {
+				fatal("Failed to expand revoked keys path", "error", err)
+			}
+			if revoked, err = runner.ReadPublicKeys([]string{path}); err != nil {
+				fatal("Failed to load revoked keys", "error", err)
+			}
+		}
+		hostKeyCallback = runner.CertHostKeyCallback(cas, revoked, hostKeyCallback)
+	} else if *revokedKeysFile != "" {
+		fatal("Flag --ssh-revoked-keys needs --ssh-trusted-ca-cert")
+	}
+
+	// Set up the JUnit report
+	var junitReport *JUnitReport
+	if *junitReportFile != "" {
+		junitReport = NewJUnitReport(*command, config.Hosts)
+		for _, entry := range filtered {
+			junitReport.Skip(entry, "excluded by host filter")
+		}
+		for _, entry := range excluded {
+			junitReport.Skip(entry, "excluded")
+		}
+		for _, entry := range unhealthy {
+			junitReport.Skip(entry, "skipped as unhealthy")
+		}
+		for _, entry := range unselected {
+			junitReport.Skip(entry, "not selected by --limit")
+		}
+	}
+
+	// Set up the session recording
+	var recorder *AsciinemaRecorder
+	var recordOutput *os.File
+	if *recordFile != "" {
+		recordOutput, err = os.Create(*recordFile)
+		if err != nil {
+			fatal("Failed to create recording", "error", err)
+		}
+		defer recordOutput.Close()
+
+		width, height, _ := term.GetSize(int(os.Stdout.Fd()))
+		recorder = NewAsciinemaRecorder(*command, time.Now(), width, height)
+		if err := recorder.WriteHeader(recordOutput); err != nil {
+			fatal("Failed to write recording", "error", err)
+		}
+	}
+
+	// Probe every host before SSH, so dead hosts don't hold slots for the
+	// whole --ssh-timeout
+	if *preflight && !*checkHTTP {
+		unreachable := runner.Preflight(context.Background(), targets, *preflightParallel, *preflightTimeout, runner.Options{Proxy: proxyURL, PreferFamily: *preferFamily})
+		for i, err := range unreachable {
+			if *preflightAttempt {
+				slog.Warn("Host failed preflight, trying it anyway", "host", targets[i].Name, "error", err)
+				continue
+			}
+			targets[i].Unreachable = err
+		}
+		slog.Info("Preflight finished", "reachable", len(targets)-len(unreachable), "unreachable", len(unreachable))
+	}
+
+	// Set up the progress bar, routing all other console output around it
+	output := stdout
+	var progress *ProgressReporter
+	if *showProgress && *outputFormat != "ndjson" && term.IsTerminal(int(os.Stderr.Fd())) {
+		progress = NewProgressReporter(os.Stderr, len(hosts), *parallelRequests)
+		output = progress.Wrap(stdout)
+		logger, _ := newLogger(progress.Wrap(stderr), *logLevel, *logFormat)
+		slog.SetDefault(logger)
+		progress.Start()
+	}
+
+	r := &runner.Runner{
+		Targets:     targets,
+		Parallelism: *parallelRequests,
+		GroupSlots:  runner.NewGroupSlots(config.GroupLimits()),
+		Vars:        globalVars,
+		DefaultVars: fileVars,
+		Options: runner.Options{
+			Keys:                keys,
+			KeyboardInteractive: keyboardInteractive,
+			TryAllKeys:          *tryAllKeys,
+			Timeout:             *sshTimeout,
+			Env:                 env,
+			EnvExportFallback:   *envExportFallback,
+			Stdin:               remoteStdin,
+			PTY:                 *pty,
+			PTYRows:             *ptyRows,
+			PTYCols:             *ptyCols,
+			ExecMode:            *execMode,
+			RemoteShell:         *remoteShell,
+			Sudo:                preset.Sudo,
+			MaxOutputBytes:      *maxOutputBytes,
+			MaxOutputError:      *maxOutputError,
+			KeepaliveInterval:   *keepaliveInterval,
+			KeepaliveMissed:     *keepaliveMissed,
+			Algorithms:          algorithms,
+			PreferFamily:        *preferFamily,
+			Proxy:               proxyURL,
+			ConnectLimiter:      connectLimiter,
+			ConnectTest:         connectTestDuration,
+			ForwardAgent:        forwardedAgent,
+			HostKeyCallback:     hostKeyCallback,
+		},
+	}
+	if progress != nil {
+		r.OnStart = func(runner.Target) { progress.Started() }
+	}
+
+	// Stop for a decision before the output received gets past the budget
+	if *maxOutputMBTotal > 0 {
+		r.Budget = runner.NewOutputBudget(*maxOutputMBTotal<<20, func(used, limit int64) bool {
+			slog.Warn("Output budget nearly used up", "received_mb", used>>20, "budget_mb", limit>>20)
+			if *maxCostAbort {
+				return false
+			}
+			proceed, err := confirm(fmt.Sprintf("Received %d of %d MB of output, continue with another %d MB?", used>>20, limit>>20, *maxOutputMBTotal))
+			if err != nil {
+				slog.Error("Failed to confirm, starting no more hosts", "error", err)
+			}
+			return proceed
+		})
+	}
+
+	if *checkHTTP {
+		r.Executor = &runner.HTTPExecutor{
+			Scheme: *httpScheme,
+			Port:   *httpPort,
+			Path:   *httpPath,
+			Expect: *httpExpect,
+			Client: &http.Client{Timeout: *httpTimeout},
+		}
+	} else if *factsMode {
+		r.Executor = &runner.FactsExecutor{Options: r.Options, Probes: factProbes}
+	} else if copyMode {
+		sum, err := runner.FileSHA256(*copySource)
+		if err != nil {
+			fatal("Failed to read --copy file", "error", err)
+		}
+		r.Executor = &runner.CopyExecutor{Options: r.Options, Source: *copySource, Dest: *copyDest, SHA256: sum, Verify: *copyVerify}
+	} else if *checkConn {
+		// Dial each host afresh, a shared connection would hide failures
+		r.Executor = &runner.CheckExecutor{Options: r.Options}
+	} else {
+		// Share one connection per host between all of its sessions
+		conns := runner.NewConnManager(r.Options, *maxSessions)
+		defer conns.Close()
+		r.Executor = &runner.SSHExecutor{Conns: conns}
+		if *outputDir != "" {
+			if err := os.MkdirAll(*outputDir, 0755); err != nil {
+				fatal("Failed to create --output-dir", "error", err)
+			}
+			r.OutputSink = outputDirSink(*outputDir, *outputDirName, r)
+		}
+		if *commandPipe != "" {
+			r.Executor = pipeExecutor{Executor: r.Executor, Command: *commandPipe}
+		}
+	}
+
+	// Serve the API, with --parallel-requests applying across all its runs
+	if *serveAddr != "" {
+		r.Slots = make(chan struct{}, *parallelRequests)
+		api := &APIServer{Runner: r, Token: *serveToken, Retention: *serveRetention}
+		if err := api.ListenAndServe(*serveAddr); err != nil {
+			fatal("Failed to serve API", "error", err)
+		}
+		return
+	}
+
+	// Print the facts of every host instead of running a command
+	if *factsMode {
+		results, err := r.Stream(context.Background(), "")
+		if err != nil {
+			fatal(err.Error())
+		}
+		var gathered []CommandResult
+		for result := range results {
+			if result.Error != nil {
+				slog.Error("Failed to gather facts", "host", result.Host, "error", result.Error)
+			}
+			gathered = append(gathered, result)
+		}
+		if err := writeFacts(stdout, *factsFormat, hosts, factProbes, collectFacts(gathered)); err != nil {
+			fatal("Failed to write facts", "error", err)
+		}
+		return
+	}
+
+	// Upload the file to every host instead of running a command
+	if copyMode {
+		start := time.Now()
+		results, err := r.Stream(context.Background(), "")
+		if err != nil {
+			fatal(err.Error())
+		}
+		var records []copyRecord
+		for result := range results {
+			record := newCopyRecord(result)
+			if err := printCopyRecord(output, record, *outputFormat); err != nil {
+				slog.Error("Failed to print copy result", "error", err)
+			}
+			records = append(records, record)
+			if progress != nil {
+				progress.Update(result)
+			}
+		}
+		if progress != nil {
+			progress.Finish()
+		}
+		slices.SortFunc(records, func(a, b copyRecord) int { return configOrder[a.Host] - configOrder[b.Host] })
+		if *outputFormat == "text" {
+			if err := printCopySummary(stdout, records, time.Since(start)); err != nil {
+				fatal("Failed to print copy summary", "error", err)
+			}
+		}
+		return
+	}
+
+	if preset.Confirm {
+		proceed, err := confirm(fmt.Sprintf("Run preset %q on %d hosts?", *presetName, len(targets)))
+		if err != nil {
+			fatal("Failed to confirm preset", "error", err)
+		}
+		if !proceed {
+			slog.Info("Aborted, preset not run", "preset", *presetName)
+			return
+		}
+	}
+
+	// Record the run in the audit log before anything is executed
+	var auditLog *AuditLog
+	if *auditLogFile != "" {
+		addrs := make([]string, len(targets))
+		for i, target := range targets {
+			addrs[i] = target.Addr
+		}
+		auditLog = NewAuditLog(*auditLogFile, *command, addrs)
+		if err := auditLog.Started(); err != nil {
+			slog.Warn("Failed to write audit log", "error", err)
+		}
+	}
+
+	var resultsDB *ResultsDB
+	if *resultsDBFile != "" {
+		var err error
+		resultsDB, err = OpenResultsDB(*resultsDBFile)
+		if err != nil {
+			fatal("Failed to open results database", "error", err)
+		}
+		resultsDB.MaxOutput = *resultsDBMaxOutput
+		if err := resultsDB.Started(*command, settings); err != nil {
+			fatal("Failed to record run in results database", "error", err)
+		}
+	}
+
+	// Connect the result sinks before anything is executed
+	var sinks []ResultSink
+	if *syslogAddr != "" {
+		sink, err := NewSyslogSink(*syslogAddr, *syslogTag, *command)
+		if err != nil {
+			fatal("Failed to connect to syslog", "error", err)
+		}
+		defer sink.Close()
+		sinks = append(sinks, sink)
+	}
+
+	// On SIGINT or SIGTERM, start no more hosts but let running commands
+	// finish, so no host is left half-changed; a second signal aborts
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	// Closed (before stopSignals runs) when main returns normally
+	returned := make(chan struct{})
+	defer close(returned)
+	go func() {
+		<-ctx.Done()
+		select {
+		case <-returned:
+			return
+		default:
+		}
+		stopSignals()
+		slog.Warn("Interrupted, waiting for running commands to finish (press Ctrl+C again to abort)")
+	}()
+	r.Graceful = true
+
+	// Execute command on each server concurrently
+	summary := Summary{Command: *command, Excluded: len(excluded), Unhealthy: len(unhealthy), Duplicates: duplicates, Expectations: assertRegexp != nil || assertNotRegexp != nil}
+	if len(unselected) > 0 {
+		summary.LimitedFrom = len(config.Hosts) + len(unselected)
+	}
+	start := time.Now()
+
+	// Collect and display results
+	var collected []CommandResult
+	var finished []CommandResult
+	var held []CommandResult
+	if runState == nil {
+		runState = NewRunState(*command)
+	}
+	handleResult := func(result CommandResult) {
+		result.Error = AssertResult(result, assertRegexp, assertNotRegexp)
+		if result.Error != nil && result.ErrorKind == "" {
+			result.ErrorKind = runner.ErrorKindCommandFailed
+		}
+		summary.Add(result)
+		runState.Record(result)
+		if healthStore != nil {
+			healthStore.Record(result)
+		}
+		if *diffMode || *groupOutput || baseline != nil {
+			collected = append(collected, result)
+		} else if *sortOutput != "" {
+			held = append(held, result)
+		} else if !shouldPrintResult(result, outputFilterRegexp, *outputFilterInvert) {
+			slog.Debug("Result hidden by --output-filter", "host", result.Host)
+		} else if err := formatter.WriteResult(output, result); err != nil {
+			slog.Error("Failed to format result", "error", err)
+		}
+		finished = append(finished, result)
+		if progress != nil {
+			progress.Update(result)
+		}
+		if junitReport != nil {
+			junitReport.Add(result)
+		}
+		if resultsDB != nil {
+			if err := resultsDB.WriteResult(result); err != nil {
+				slog.Error("Failed to record result in results database", "host", result.Host, "error", err)
+			}
+		}
+		if recorder != nil {
+			if err := recorder.WriteResult(recordOutput, result); err != nil {
+				slog.Error("Failed to write recording", "error", err)
+			}
+		}
+		for _, sink := range sinks {
+			if err := sink.WriteResult(result); err != nil {
+				slog.Warn("Failed to send result", "host", result.Host, "error", err)
+			}
+		}
+	}
+
+	// Run on the canary host alone first, then ask before touching the rest
+	remaining := make([]int, 0, len(targets))
+	canaryIndex := -1
+	if *canary {
+		canaryIndex = selectCanary(targets, config.CanaryHost)
+	}
+	for i := range targets {
+		if i != canaryIndex {
+			remaining = append(remaining, i)
+		}
+	}
+	if canaryIndex >= 0 {
+		slog.Info("Running on canary host first", "host", targets[canaryIndex].Name)
+		canaryResults, err := r.StreamTargets(ctx, *command, []int{canaryIndex})
+		if err != nil {
+			fatal(err.Error())
+		}
+		for result := range canaryResults {
+			handleResult(result)
+			// Show the canary result even when output is only printed at the end
+			if *diffMode || *groupOutput || baseline != nil || *sortOutput != "" {
+				if err := formatter.WriteResult(output, result); err != nil {
+					slog.Error("Failed to format result", "error", err)
+				}
+			}
+		}
+		flushResults(output, formatter)
+
+		if len(remaining) > 0 {
+			proceed, err := confirm(fmt.Sprintf("Proceed with remaining %d hosts?", len(remaining)))
+			if err != nil {
+				fatal("Failed to read confirmation", "error", err)
+			}
+			if !proceed {
+				slog.Warn("Stopped after the canary host", "skipped", len(remaining))
+				remaining = nil
+			}
+		}
+	}
+
+	// Pick up changes to the hosts file between --watch iterations, narrowed
+	// down and checked the same way as at the start
+	var hostsChanged <-chan struct{}
+	reloadTargets := func() ([]runner.Target, error) {
+		cfg, err := readConfig(*serverAddressesFile)
+		if err != nil {
+			return nil, err
+		}
+		if cfg.Hosts, _, err = filterHosts(cfg.Hosts, hostFilterRegexp, *hostFilterGlob); err != nil {
+			return nil, err
+		}
+		if hostsRegexp != nil || hostsExcludeRegexp != nil {
+			cfg.Hosts, _ = filterEntriesByRegex(cfg.Hosts, hostsRegexp, hostsExcludeRegexp)
+		}
+		if cfg.Hosts, _, _, err = excludeHosts(cfg.Hosts, excludes); err != nil {
+			return nil, err
+		}
+		if healthStore != nil {
+			cfg.Hosts, _ = skipUnhealthyHosts(cfg.Hosts, healthStore, *healthSkipThreshold)
+		}
+		if problems := runner.ValidateConfig(cfg, runner.Options{Timeout: *sshTimeout, Proxy: proxyURL}, net.DefaultResolver.LookupHost); len(problems) > 0 {
+			for _, problem := range problems {
+				slog.Error("Invalid config", "host", problem.Host, "error", problem.Err)
+			}
+			return nil, fmt.Errorf("config validation failed with %d problems", len(problems))
+		}
+
+		reloaded, err := buildTargets(cfg, *commandTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if !*allowDuplicates {
+			cfg.Hosts, reloaded, _ = dropDuplicateHosts(cfg.Hosts, reloaded)
+		}
+		for i, entry := range cfg.Hosts {
+			if entry.Key != "" {
+				if reloaded[i].Keys, err = readKeys([]string{entry.Key}, entry.Cert); err != nil {
+					return nil, fmt.Errorf("host %s: %w", entry.Host, err)
+				}
+			}
+		}
+
+		return reloaded, nil
+	}
+	if *hostFileWatch {
+		hostsChanged, err = watchHostFile(ctx, *serverAddressesFile, *hostFileWatchDebounce)
+		if err != nil {
+			fatal("Failed to watch hosts file", "error", err)
+		}
+	}
+
+	// Repeat the run every --watch interval, reusing the targets and their
+	// connections, until interrupted
+	baseSummary := summary
+	for iteration := 1; ; iteration++ {
+		if *watch > 0 {
+			if iteration > 1 {
+				summary, collected, finished, start = baseSummary, nil, nil, time.Now()
+				// Fresh lists, so hosts failing this time don't add to the base's
+				summary.FailedByKind = make(map[runner.ErrorKind][]string, len(baseSummary.FailedByKind))
+				for kind, hosts := range baseSummary.FailedByKind {
+					summary.FailedByKind[kind] = slices.Clip(hosts)
+				}
+			}
+			select {
+			case <-hostsChanged:
+				reloaded, err := reloadTargets()
+				if err != nil {
+					slog.Error("Failed to reload hosts file, keeping the current hosts", "error", err)
+					break
+				}
+				slog.Info("Reloaded hosts file", "old_hosts", len(r.Targets), "new_hosts", len(reloaded))
+				r.Targets = reloaded
+				remaining = make([]int, len(reloaded))
+				clear(configOrder)
+				for i, target := range reloaded {
+					remaining[i] = i
+					configOrder[target.Name] = i
+				}
+			default:
+			}
+			startWatchIteration(output, iteration, *watchClear, *outputFormat == "text")
+			if f, ok := formatter.(*NDJSONFormatter); ok {
+				f.Iteration = iteration
+			}
+		}
+
+		results, err := r.StreamTargets(ctx, *command, remaining)
+		if err != nil {
+			fatal(err.Error())
+		}
+		for result := range results {
+			handleResult(result)
+		}
+		summary.Duration = time.Since(start)
+
+		// Print the held results in order once every host is done
+		for _, result := range sortResults(held, *sortOutput, configOrder) {
+			if !shouldPrintResult(result, outputFilterRegexp, *outputFilterInvert) {
+				slog.Debug("Result hidden by --output-filter", "host", result.Host)
+			} else if err := formatter.WriteResult(output, result); err != nil {
+				slog.Error("Failed to format result", "error", err)
+			}
+		}
+		held = nil
+		flushResults(output, formatter)
+
+		// Hosts that never started mean the run was cut short
+		expected := len(remaining)
+		if canaryIndex >= 0 {
+			expected++
+		}
+		summary.Interrupted = summary.Total < expected
+		if *watch == 0 || ctx.Err() != nil {
+			break
+		}
+
+		slog.Info("Summary", "iteration", iteration, "run", summary)
+		select {
+		case <-ctx.Done():
+		case <-time.After(*watch):
+			continue
+		}
+		break
+	}
+	// Leave the final progress line on screen above the summary
+	if progress != nil {
+		progress.Finish()
+	}
+
+	if *stateFile != "" {
+		if err := runState.Save(*stateFile); err != nil {
+			slog.Error("Failed to write state file", "error", err)
+		}
+	}
+	if healthStore != nil {
+		if err := healthStore.Save(*healthFile); err != nil {
+			slog.Error("Failed to write host health", "error", err)
+		}
+	}
+
+	// A report that can't be written fails the run, but the notifications
+	// and records below still go out
+	exitStatus := 0
+	if junitReport != nil {
+		if err := junitReport.WriteFile(*junitReportFile); err != nil {
+			slog.Error("Failed to write JUnit report", "error", err)
+			exitStatus = 1
+		}
+	}
+
+	if *reportHTMLFile != "" {
+		if err := writeHTMLReport(*reportHTMLFile, summary, finished); err != nil {
+			slog.Error("Failed to write HTML report", "error", err)
+			exitStatus = 1
+		}
+	}
+
+	if *groupOutput {
+		printGroups(output, groupResults(collected), *groupMaxHosts, *groupVerbose)
+	}
+
+	if *metricsTextfile != "" || *metricsPushgateway != "" {
+		metrics := formatMetrics(summary, finished, time.Now())
+		if *metricsTextfile != "" {
+			if err := writeMetricsTextfile(*metricsTextfile, metrics); err != nil {
+				slog.Error("Failed to write metrics", "error", err)
+			}
+		}
+		if *metricsPushgateway != "" {
+			instance := *metricsInstance
+			if instance == "" {
+				instance, _ = os.Hostname()
+			}
+			if err := pushMetrics(&http.Client{Timeout: 10 * time.Second}, *metricsPushgateway, *metricsJob, instance, metrics); err != nil {
+				slog.Error("Failed to push metrics", "error", err)
+			}
+		}
+	}
+
+	if *diffMode && printDiff(output, collected) > 0 {
+		exitStatus = 1
+	}
+	if baseline != nil {
+		diffs := diffResults(baseline, collected)
+		printBaselineDiff(output, diffs, len(collected))
+		if len(diffs) > 0 {
+			exitStatus = 1
+		}
+	}
+	if len(summary.ExpectFailedHosts) > 0 {
+		exitStatus = 1
+	}
+	if r.Budget.Exhausted() {
+		slog.Error("Output budget exhausted, hosts were not started", "received_bytes", r.Budget.Used())
+		exitStatus = 1
+	}
+	if summary.Interrupted {
+		// The POSIX convention for a run stopped by SIGINT
+		exitStatus = 130
+	}
+
+	slog.Info("Summary", "run", summary)
+
+	if *pagerDutyKey != "" {
+		notifier := &PagerDutyNotifier{
+			RoutingKey: *pagerDutyKey,
+			Threshold:  pagerDutyRate,
+			Client:     &http.Client{Timeout: 10 * time.Second},
+		}
+		if err := notifier.Notify(summary); err != nil {
+			slog.Error("Failed to send PagerDuty event", "error", err)
+		}
+	}
+
+	if *slackWebhook != "" {
+		notifier := &SlackNotifier{WebhookURL: *slackWebhook, OnFailureOnly: *slackOnFailureOnly, Client: &http.Client{Timeout: 10 * time.Second}}
+		if err := notifier.Notify(summary); err != nil {
+			slog.Error("Failed to send Slack notification", "error", err)
+		}
+	}
+
+	if *notifyURL != "" && (summary.Failed > 0 || exitStatus != 0 || *notifyOn == "always") {
+		notifier := &WebhookNotifier{URL: *notifyURL, Template: notifyTmpl, Secret: *webhookSecret, Client: newWebhookClient(10 * time.Second)}
+		if err := notifier.Notify(summary, exitStatus); err != nil {
+			slog.Warn("Failed to send notification", "error", err)
+		}
+	}
+
+	if auditLog != nil {
+		if err := auditLog.Finished(finished, exitStatus); err != nil {
+			slog.Warn("Failed to write audit log", "error", err)
+		}
+	}
+	if resultsDB != nil {
+		if err := resultsDB.Finished(summary, exitStatus); err != nil {
+			slog.Error("Failed to record run in results database", "error", err)
+		}
+	}
+
+	if exitStatus != 0 {
+		os.Exit(exitStatus)
+	}
+}
+
+func readConfig(filename string) (*runner.Config, error) {
+	if filename == "-" {
+		return readStdinConfig(os.Stdin)
+	}
+
+	return runner.ReadConfig(filename)
+}
+
+func readStdinConfig(stdin *os.File) (*runner.Config, error) {
+	// Refuse to wait on an interactive terminal that will never send a host list
+	if term.IsTerminal(int(stdin.Fd())) {
+		return nil, errors.New("expected a host list on stdin, but stdin is a terminal")
+	}
+
+	config, err := runner.ParseHostList(stdin)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.Hosts) == 0 {
+		return nil, errors.New("no hosts read from stdin")
+	}
+
+	return config, nil
+}
+
+// readCommandFile reads a command script, normalizing CRLF line endings to LF
+// and dropping trailing newlines; inner newlines are kept as-is.
+func readCommandFile(filename string) (string, error) {
+	var data []byte
+	var err error
+	if filename == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(filename)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	command := strings.ReplaceAll(string(data), "\r\n", "\n")
+	command = strings.TrimRight(command, "\n")
+	if strings.TrimSpace(command) == "" {
+		return "", errors.New("command file is empty")
+	}
+
+	return command, nil
+}
+
+// printDryRun prints the command as rendered for each of r's targets.
+func printDryRun(w io.Writer, command string, env []runner.EnvVar, settings []setting, r *runner.Runner) {
+	fmt.Fprintf(w, "Command:\n%s\n\n", command)
+	printSettings(w, settings)
+	if len(env) > 0 {
+		fmt.Fprintf(w, "Environment:\n")
+		for _, v := range env {
+			fmt.Fprintf(w, "  %s=%s\n", v.Name, v.Value)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "Hosts (%d):\n", len(r.Targets))
+	for i, target := range r.Targets {
+		if target.Addr != target.Name {
+			fmt.Fprintf(w, "  %s (%s)\n", target.Name, target.Addr)
+		} else {
+			fmt.Fprintf(w, "  %s\n", target.Name)
+		}
+		if rendered, err := r.CommandLine(i, command); err != nil {
+			fmt.Fprintf(w, "    failed to render command: %v\n", err)
+		} else if rendered != command {
+			fmt.Fprintf(w, "    $ %s\n", rendered)
+		}
+	}
+}
+
+// printPresets lists the config's presets, one per line with its
+// description and the settings that change how it runs.
+func printPresets(w io.Writer, config *runner.Config) {
+	if len(config.Commands) == 0 {
+		fmt.Fprintln(w, "No presets defined (add a commands: map to the config file)")
+		return
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	for _, name := range config.PresetNames() {
+		preset := config.Commands[name]
+		var flags []string
+		if preset.Sudo {
+			flags = append(flags, "sudo")
+		}
+		if preset.Timeout > 0 {
+			flags = append(flags, "timeout "+preset.Timeout.String())
+		}
+		if preset.Confirm {
+			flags = append(flags, "confirm")
+		}
+		description := preset.Description
+		if len(flags) > 0 {
+			description = strings.TrimSpace(description + " (" + strings.Join(flags, ", ") + ")")
+		}
+		fmt.Fprintf(tw, "%s\t%s\n", name, description)
+	}
+	tw.Flush()
+}
+
+// startWatchIteration marks the start of a --watch iteration on stdout, when
+// the output is plain text, and in the log.
+func startWatchIteration(w io.Writer, iteration int, clear, text bool) {
+	now := time.Now()
+	slog.Info("Watch iteration", "iteration", iteration)
+	if !text {
+		return
+	}
+
+	if clear && term.IsTerminal(int(os.Stdout.Fd())) {
+		fmt.Fprint(w, "\033[H\033[2J")
+	}
+	fmt.Fprintf(w, "=== Iteration %d at %s ===\n", iteration, now.Format(time.RFC3339))
+}
+
+// buildTargets makes the targets of the config's hosts, resolving aliases
+// and applying the defaults section. Per-host keys are left to the caller.
+func buildTargets(config *runner.Config, commandTimeout time.Duration) ([]runner.Target, error) {
+	hosts := runner.HostNames(config.Hosts)
+
+	// Resolve aliases to the addresses we actually dial
+	dialAddrs := make([]string, len(config.Hosts))
+	for i, entry := range config.Hosts {
+		dialAddrs[i] = entry.DialAddr()
+	}
+	addrs, err := runner.ExpandAliases(dialAddrs, config.Aliases)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve host aliases: %w", err)
+	}
+	for i := range addrs {
+		addrs[i] = runner.ApplyAddrDefaults(addrs[i], config.Defaults.User, config.Defaults.Port)
+		if addrs[i] != hosts[i] {
+			slog.Debug("Host address", "host", hosts[i], "addr", addrs[i])
+		}
+	}
+
+	targets := make([]runner.Target, len(config.Hosts))
+	for i, entry := range config.Hosts {
+		targets[i] = runner.Target{Name: entry.Host, Addr: addrs[i], Vars: entry.Vars, Groups: entry.Groups, Algorithms: entry.Algorithms, RemoteShell: entry.RemoteShell}
+		if err := entry.Algorithms.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid SSH algorithms for %s: %w", entry.Host, err)
+		}
+
+		// Host command_timeout beats --command-timeout beats the file's default
+		switch {
+		case entry.CommandTimeout > 0:
+			targets[i].Timeout = entry.CommandTimeout
+		case commandTimeout > 0:
+			targets[i].Timeout = commandTimeout
+		default:
+			targets[i].Timeout = config.DefaultCommandTimeout
+		}
+	}
+
+	return targets, nil
+}
+
+// selectCanary returns the index of the target named canaryHost, or of the
+// first target when it is empty. Naming a host that is not being run on is
+// fatal, since the canary would silently be a different host.
+func selectCanary(targets []runner.Target, canaryHost string) int {
+	if len(targets) == 0 {
+		return -1
+	}
+	if canaryHost == "" {
+		return 0
+	}
+
+	for i, target := range targets {
+		if target.Name == canaryHost {
+			return i
+		}
+	}
+	fatal("Canary host is not among the hosts of this run", "canary_host", canaryHost)
+	return -1
+}
+
+// splitCommaList splits a comma-separated flag value, dropping empty items.
+func splitCommaList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// selectProxy parses the --socks5-proxy value, falling back to $ALL_PROXY
+// or $all_proxy. Those are shared with other tools, so a non-SOCKS5 value
+// there is ignored rather than fatal.
+func selectProxy(flagValue string) (*url.URL, error) {
+	if flagValue != "" {
+		return runner.ParseProxyURL(flagValue)
+	}
+
+	for _, name := range []string{"ALL_PROXY", "all_proxy"} {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		proxyURL, err := runner.ParseProxyURL(value)
+		if err != nil {
+			slog.Warn("Ignoring proxy from environment", "env", name, "error", err)
+			return nil, nil
+		}
+		slog.Debug("Using proxy from environment", "env", name, "proxy", proxyURL.Redacted())
+		return proxyURL, nil
+	}
+
+	return nil, nil
+}
+
+// loadKeys expands and parses the private keys at paths, exiting on any
+// unreadable or invalid key so a bad key fails the run before it starts.
+// cert, if set, is the certificate for the only key.
+func loadKeys(paths []string, cert string) []runner.Key {
+	keys, err := readKeys(paths, cert)
+	if err != nil {
+		fatal("Failed to load SSH key", "error", err)
+	}
+
+	return keys
+}
+
+// readKeys is loadKeys returning the error, for reloads that must not exit.
+func readKeys(paths []string, cert string) ([]runner.Key, error) {
+	if cert != "" {
+		var err error
+		if cert, err = expandTilde(cert); err != nil {
+			return nil, fmt.Errorf("failed to expand SSH certificate path: %w", err)
+		}
+	}
+
+	keys := make([]runner.Key, len(paths))
+	for i, path := range paths {
+		// Keys from the environment or stdin never touch the disk
+		if path == "-" || strings.HasPrefix(path, "env:") {
+			data, err := readKeySource(path)
+			if err != nil {
+				return nil, err
+			}
+			if keys[i], err = runner.ParseKey(path, data, cert); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		path, err := expandTilde(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand SSH key path: %w", err)
+		}
+		if keys[i], err = runner.LoadKey(path, cert); err != nil {
+			return nil, err
+		}
+	}
+
+	return keys, nil
+}
+
+// readKeySource reads key material from stdin ("-") or from the environment
+// variable named by an "env:NAME" source.
+func readKeySource(source string) ([]byte, error) {
+	if source == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+
+	name := strings.TrimPrefix(source, "env:")
+	value, ok := os.LookupEnv(name)
+	if !ok || value == "" {
+		return nil, fmt.Errorf("environment variable %s is not set", name)
 	}
 
-	return string(output), nil
+	return []byte(value), nil
 }
 
 func expandTilde(path string) (string, error) {
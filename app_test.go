@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"server-manager/runner"
+)
+
+// TestPrintDryRunBuiltins renders every built-in next to user vars, both in
+// the command the dry run prints and in the --output-dir-name path.
+func TestPrintDryRunBuiltins(t *testing.T) {
+	r := &runner.Runner{
+		Targets: []runner.Target{
+			{Name: "web1", Addr: "deploy@web1.example.com:2222", Groups: []string{"web", "prod"}, Vars: map[string]string{"service": "nginx"}},
+			{Name: "db1", Addr: "10.0.0.5", Vars: map[string]string{"service": "postgres"}},
+			{Name: "v6", Addr: "admin@[2001:db8::10]:2200"},
+		},
+		Vars:        map[string]string{"env": "prod"},
+		DefaultVars: map[string]string{"service": "none"},
+	}
+	command := `echo {{.Index}}/{{.Total}} {{.Host}} {{.User}}@{{.Address}}:{{.Port}} {{.Groups}} {{.env}} {{.service}}`
+	outputName := "{{.env}}/{{.Index}}-of-{{.Total}}-{{.Host}}-{{.User}}@{{.Address}}_{{.Port}}-{{range .Groups}}{{.}}.{{end}}{{.service}}.log"
+
+	var out bytes.Buffer
+	printDryRun(&out, command, nil, []setting{{Name: "parallel", Value: "10", Source: "default"}}, r)
+	want := strings.Join([]string{
+		"Hosts (3):",
+		"  web1 (deploy@web1.example.com:2222)",
+		"    $ echo 1/3 web1 deploy@web1.example.com:2222 [web prod] prod nginx",
+		"  db1 (10.0.0.5)",
+		"    $ echo 2/3 db1 root@10.0.0.5:22 [] prod postgres",
+		"  v6 (admin@[2001:db8::10]:2200)",
+		"    $ echo 3/3 v6 admin@2001:db8::10:2200 [] prod none",
+		"",
+	}, "\n")
+	if got := out.String(); !strings.HasSuffix(got, want) {
+		t.Errorf("dry run printed\n%s\nwant it to end with\n%s", got, want)
+	}
+
+	paths := []string{
+		"out/prod/1-of-3-web1-deploy@web1.example.com_2222-web.prod.nginx.log",
+		"out/prod/2-of-3-db1-root@10.0.0.5_22-postgres.log",
+	}
+	for i, want := range paths {
+		got, err := outputDirPath("out", outputName, r, i)
+		if err != nil {
+			t.Errorf("outputDirPath(%d): %v", i, err)
+			continue
+		}
+		if got != filepath.FromSlash(want) {
+			t.Errorf("outputDirPath(%d) = %s, want %s", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	asciinemaDefaultWidth  = 80
+	asciinemaDefaultHeight = 24
+)
+
+type asciinemaHeader struct {
+	Version   int    `json:"version"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	Timestamp int64  `json:"timestamp"`
+	Command   string `json:"command"`
+	Title     string `json:"title,omitempty"`
+}
+
+// AsciinemaRecorder writes results as an asciinema v2 cast, one "o" frame per
+// output line, timed relative to the start of the run.
+type AsciinemaRecorder struct {
+	command string
+	start   time.Time
+	width   int
+	height  int
+}
+
+func NewAsciinemaRecorder(command string, start time.Time, width, height int) *AsciinemaRecorder {
+	if width <= 0 || height <= 0 {
+		width, height = asciinemaDefaultWidth, asciinemaDefaultHeight
+	}
+
+	return &AsciinemaRecorder{command: command, start: start, width: width, height: height}
+}
+
+func (a *AsciinemaRecorder) WriteHeader(w io.Writer) error {
+	return writeJSONLine(w, asciinemaHeader{
+		Version:   2,
+		Width:     a.width,
+		Height:    a.height,
+		Timestamp: a.start.Unix(),
+		Command:   a.command,
+		Title:     "server-manager: " + a.command,
+	})
+}
+
+func (a *AsciinemaRecorder) WriteResult(w io.Writer, r CommandResult) error {
+	var text string
+	if r.Error != nil {
+		text = fmt.Sprintf("Failed to execute command on %s: %v\n", r.Host, r.Error)
+	} else {
+		text = fmt.Sprintf("Output from %s:\n%s\n", r.Host, r.Output)
+	}
+
+	offset := time.Since(a.start).Seconds()
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if line == "" {
+			continue
+		}
+
+		// Terminals need a carriage return to start the next line at column 0
+		line = strings.TrimSuffix(line, "\n")
+		if err := writeJSONLine(w, []interface{}{offset, "o", line + "\r\n"}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeJSONLine(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
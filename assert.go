@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// ErrExpectationFailed is wrapped by the errors of hosts whose output failed
+// --expect or --expect-not (or --assert, --assert-not).
+var ErrExpectationFailed = errors.New("expectation failed")
+
+// AssertResult checks a successful result's output, without trailing
+// newlines (so "^active$" matches), against the --expect and --expect-not
+// patterns; either may be nil. Failed results are returned as they are.
+func AssertResult(result CommandResult, assert, assertNot *regexp.Regexp) error {
+	if result.Error != nil {
+		return result.Error
+	}
+
+	output := strings.TrimRight(result.Output, "\n")
+	if assert != nil && !assert.MatchString(output) {
+		return fmt.Errorf("%w: output does not match %q: %q", ErrExpectationFailed, assert.String(), output)
+	}
+	if assertNot != nil && assertNot.MatchString(output) {
+		return fmt.Errorf("%w: output matches %q: %q", ErrExpectationFailed, assertNot.String(), output)
+	}
+
+	return nil
+}
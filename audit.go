@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/user"
+	"time"
+)
+
+// AuditLog appends one JSON line per event of a run: "run_started" before
+// any host is contacted, so aborted runs are still traceable, and
+// "run_finished" with the per-host results.
+type AuditLog struct {
+	Path    string
+	RunID   string
+	User    string
+	Command string
+	Hosts   []string
+	start   time.Time
+}
+
+type auditHostResult struct {
+	Host     string `json:"host"`
+	Status   string `json:"status"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+}
+
+type auditRecord struct {
+	Event     string            `json:"event"`
+	RunID     string            `json:"run_id"`
+	Timestamp time.Time         `json:"timestamp"`
+	User      string            `json:"user"`
+	Command   string            `json:"command"`
+	Hosts     []string          `json:"hosts"`
+	Results   []auditHostResult `json:"results,omitempty"`
+	Result    string            `json:"result,omitempty"`
+	Duration  float64           `json:"duration_seconds,omitempty"`
+}
+
+// newRunID returns a random ID to tell runs apart.
+func newRunID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return hex.EncodeToString(id)
+}
+
+func NewAuditLog(path, command string, hosts []string) *AuditLog {
+	return &AuditLog{
+		Path:    path,
+		RunID:   newRunID(),
+		User:    currentUser(),
+		Command: command,
+		Hosts:   hosts,
+	}
+}
+
+func (a *AuditLog) Started() error {
+	a.start = time.Now()
+	return a.append(auditRecord{Event: "run_started", Timestamp: a.start})
+}
+
+func (a *AuditLog) Finished(results []CommandResult, exitStatus int) error {
+	record := auditRecord{
+		Event:     "run_finished",
+		Timestamp: time.Now(),
+		Result:    "success",
+		Duration:  time.Since(a.start).Seconds(),
+	}
+	for _, r := range results {
+		result := auditHostResult{Host: r.Host, Status: "ok", ExitCode: r.ExitCode}
+		if r.Error != nil {
+			result.Status = "failed"
+			result.Error = r.Error.Error()
+			record.Result = "failure"
+		}
+		record.Results = append(record.Results, result)
+	}
+	if exitStatus != 0 {
+		record.Result = "failure"
+	}
+
+	return a.append(record)
+}
+
+// append writes a single record with O_APPEND, so concurrent runs sharing
+// the log never interleave within a line.
+func (a *AuditLog) append(record auditRecord) error {
+	record.RunID = a.RunID
+	record.User = a.User
+	record.Command = a.Command
+	record.Hosts = a.Hosts
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(a.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return os.Getenv("USER")
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// encodingBase64 marks JSON records whose output is base64-encoded.
+const encodingBase64 = "base64"
+
+// isBinary reports whether output can't be shown or put in JSON as text: it
+// holds NUL bytes or isn't valid UTF-8. A character cut in half at the end,
+// as a command killed mid-write may leave, doesn't count.
+func isBinary(output string) bool {
+	return strings.IndexByte(output, 0) >= 0 || !utf8.ValidString(trimPartialRune(output))
+}
+
+func trimPartialRune(s string) string {
+	for i := 1; i < utf8.UTFMax && i <= len(s); i++ {
+		if utf8.RuneStart(s[len(s)-i]) {
+			if !utf8.FullRuneInString(s[len(s)-i:]) {
+				return s[:len(s)-i]
+			}
+			break
+		}
+	}
+
+	return s
+}
+
+// encodeOutput returns output as it goes into a JSON record, with the
+// encoding when it had to be base64-encoded; text is left as is.
+func encodeOutput(output string) (string, string) {
+	if !isBinary(output) {
+		return output, ""
+	}
+
+	return base64.StdEncoding.EncodeToString([]byte(output)), encodingBase64
+}
+
+// decodeOutput reverses encodeOutput.
+func decodeOutput(output, encoding string) (string, error) {
+	switch encoding {
+	case "":
+		return output, nil
+	case encodingBase64:
+		data, err := base64.StdEncoding.DecodeString(output)
+		if err != nil {
+			return "", fmt.Errorf("invalid base64 output: %w", err)
+		}
+		return string(data), nil
+	}
+
+	return "", fmt.Errorf("unknown output encoding %q", encoding)
+}
+
+// printableOutput prepares binary output for the console: every run of
+// unprintable bytes becomes a summary like [12 binary bytes], followed by a
+// hint on getting the raw bytes. Text output is returned untouched.
+func printableOutput(output string) string {
+	if !isBinary(output) {
+		return output
+	}
+
+	var b strings.Builder
+	run := 0
+	flush := func() {
+		if run > 0 {
+			fmt.Fprintf(&b, "[%d binary bytes]", run)
+			run = 0
+		}
+	}
+	for i := 0; i < len(output); {
+		r, size := utf8.DecodeRuneInString(output[i:])
+		if (r == utf8.RuneError && size == 1) || !(unicode.IsPrint(r) || r == '\n' || r == '\t') {
+			run += size
+		} else {
+			flush()
+			b.WriteString(output[i : i+size])
+		}
+		i += size
+	}
+	flush()
+	if !strings.HasSuffix(b.String(), "\n") {
+		b.WriteByte('\n')
+	}
+
+	return b.String() + "(binary output shortened; use --output ndjson to get the raw bytes, base64-encoded)\n"
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsBinary(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   bool
+	}{
+		{name: "empty", output: "", want: false},
+		{name: "ascii", output: "load average: 0.10\n", want: false},
+		{name: "utf-8", output: "température 21°C ✓ 日本語\n", want: false},
+		{name: "control characters", output: "\x1b[31mred\x1b[0m\r\n", want: false},
+		{name: "cut multibyte rune at end", output: "21°C ✓"[:len("21°C ✓")-1], want: false},
+		{name: "nul byte", output: "a\x00b", want: true},
+		{name: "invalid utf-8", output: "ok \xff\xfe", want: true},
+		{name: "invalid rune in the middle", output: "a\xe2\x82b", want: true},
+		{name: "gzip header", output: "\x1f\x8b\x08\x00", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isBinary(tt.output); got != tt.want {
+				t.Errorf("isBinary(%q) = %v, want %v", tt.output, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintableOutputText(t *testing.T) {
+	for _, output := range []string{"", "plain\n", "no newline", "température 21°C ✓\n日本語\n", "tab\tseparated\n"} {
+		if got := printableOutput(output); got != output {
+			t.Errorf("printableOutput(%q) = %q, want it untouched", output, got)
+		}
+	}
+}
+
+func TestPrintableOutputMixed(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{name: "binary run between text", output: "header\n\x00\x01\x02\xfftrailer\n", want: "header\n[4 binary bytes]trailer\n"},
+		{name: "several runs", output: "a\x00b\x00\x00c", want: "a[1 binary bytes]b[2 binary bytes]c\n"},
+		{name: "utf-8 kept next to binary", output: "✓\x00°", want: "✓[1 binary bytes]°\n"},
+		{name: "all binary", output: "\x1f\x8b\x08\x00", want: "[4 binary bytes]\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := printableOutput(tt.output)
+			body, hint, ok := strings.Cut(got, "(binary output shortened")
+			if !ok {
+				t.Fatalf("printableOutput(%q) = %q, want the raw bytes hint", tt.output, got)
+			}
+			if body != tt.want {
+				t.Errorf("printableOutput(%q) = %q, want %q", tt.output, body, tt.want)
+			}
+			if !strings.HasSuffix(hint, "\n") {
+				t.Errorf("hint %q doesn't end the line", hint)
+			}
+		})
+	}
+}
+
+func TestEncodeOutputRoundTrip(t *testing.T) {
+	for _, output := range []string{"", "text ✓\n", "mixed\x00\xff bytes", "\x1f\x8b\x08\x00"} {
+		encoded, encoding := encodeOutput(output)
+		if !isBinary(output) && (encoded != output || encoding != "") {
+			t.Errorf("encodeOutput(%q) = %q, %q, want text untouched", output, encoded, encoding)
+		}
+		decoded, err := decodeOutput(encoded, encoding)
+		if err != nil {
+			t.Errorf("decodeOutput(%q, %q): %v", encoded, encoding, err)
+			continue
+		}
+		if decoded != output {
+			t.Errorf("round trip of %q gave %q", output, decoded)
+		}
+	}
+
+	if _, err := decodeOutput("x", "gzip"); err == nil {
+		t.Error("unknown encoding accepted")
+	}
+}
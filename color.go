@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+const (
+	colorRed   = "\033[31m"
+	colorGreen = "\033[32m"
+	colorReset = "\033[0m"
+)
+
+// ColorPrinter prints results like the text output, with failed hosts as a
+// red "Failed on <host>: <error>" line in the output rather than a log entry.
+// Successful hosts get a green name, or with ErrorsOnly no color at all.
+type ColorPrinter struct {
+	ErrorsOnly bool
+}
+
+func (p ColorPrinter) WriteResult(w io.Writer, r CommandResult) error {
+	if r.Error != nil {
+		_, err := fmt.Fprintf(w, "%sFailed on %s: %v%s\n\n", colorRed, r.Host, r.Error, colorReset)
+		return err
+	}
+	if p.ErrorsOnly {
+		return textFormatter{}.WriteResult(w, r)
+	}
+
+	r.Host = colorGreen + r.Host + colorReset
+	return textFormatter{}.WriteResult(w, r)
+}
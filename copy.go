@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	"server-manager/runner"
+)
+
+// copyRecord is a host's --copy result, as printed with --output ndjson.
+type copyRecord struct {
+	Host            string  `json:"host"`
+	Status          string  `json:"status"`
+	Bytes           int64   `json:"bytes"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	TransferSeconds float64 `json:"transfer_seconds,omitempty"`
+	BytesPerSecond  float64 `json:"bytes_per_second,omitempty"`
+	Error           *string `json:"error"`
+}
+
+func newCopyRecord(result CommandResult) copyRecord {
+	record := copyRecord{Host: result.Host, Status: "failed", DurationSeconds: result.Duration.Seconds()}
+	var report runner.CopyReport
+	if result.Output != "" && json.Unmarshal([]byte(result.Output), &report) == nil {
+		record.Status, record.Bytes, record.TransferSeconds = report.Status, report.Bytes, report.TransferSeconds
+		if report.TransferSeconds > 0 {
+			record.BytesPerSecond = float64(report.Bytes) / report.TransferSeconds
+		}
+	}
+	if result.Error != nil {
+		msg := result.Error.Error()
+		record.Error = &msg
+	}
+
+	return record
+}
+
+// printCopyRecord prints a host's upload as it finishes.
+func printCopyRecord(w io.Writer, record copyRecord, format string) error {
+	if format == "ndjson" {
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", line)
+		return err
+	}
+
+	if record.Error != nil {
+		slog.Error("Failed to copy", "host", record.Host, "status", record.Status, "error", *record.Error)
+		return nil
+	}
+	_, err := fmt.Fprintf(w, "%s: %s\n", record.Host, describeCopy(record))
+	return err
+}
+
+// printCopySummary lists every host's transfer size, time and throughput, for
+// capacity planning, and logs the totals.
+func printCopySummary(w io.Writer, records []copyRecord, elapsed time.Duration) error {
+	var uploaded, skipped, failed int
+	var total int64
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "HOST\tSTATUS\tSIZE\tDURATION\tTHROUGHPUT")
+	for _, record := range records {
+		throughput := "-"
+		if record.BytesPerSecond > 0 {
+			throughput = formatBytes(int64(record.BytesPerSecond)) + "/s"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", record.Host, record.Status, formatBytes(record.Bytes),
+			(time.Duration(record.DurationSeconds * float64(time.Second))).Round(time.Millisecond), throughput)
+
+		total += record.Bytes
+		switch {
+		case record.Error != nil:
+			failed++
+		case record.Status == runner.CopySkipped:
+			skipped++
+		default:
+			uploaded++
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	slog.Info("Copy summary", "uploaded", uploaded, "skipped", skipped, "failed", failed, "bytes", total, "duration", elapsed.Round(time.Millisecond))
+	return nil
+}
+
+func describeCopy(record copyRecord) string {
+	if record.Status != runner.CopyUploaded {
+		return record.Status
+	}
+	description := fmt.Sprintf("uploaded %s in %s", formatBytes(record.Bytes), (time.Duration(record.TransferSeconds * float64(time.Second))).Round(time.Millisecond))
+	if record.BytesPerSecond > 0 {
+		description += fmt.Sprintf(" (%s/s)", formatBytes(int64(record.BytesPerSecond)))
+	}
+
+	return description
+}
+
+// formatBytes renders n in the largest binary unit that keeps it above 1.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 4 {
+		value /= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exp])
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"server-manager/runner"
+)
+
+// setting is an effective run setting and where its value came from: a
+// flag, the config file's defaults section, a preset or the built-in value.
+type setting struct {
+	Name   string
+	Value  string
+	Source string
+}
+
+// defaultableFlags are the flags the defaults section can stand in for.
+type defaultableFlags struct {
+	sshKeys          *stringSliceFlag
+	parallelRequests *int
+	sshTimeout       *time.Duration
+	commandTimeout   *time.Duration
+	output           *string
+	knownHosts       *string
+}
+
+// applyDefaults fills the flags that weren't given on the command line from
+// the config file's defaults section, and reports where each setting came
+// from. setFlags holds the names of the flags that were given.
+func applyDefaults(config *runner.Config, setFlags map[string]bool, f defaultableFlags) []setting {
+	d := config.Defaults
+	source := func(name string, fromDefaults bool) string {
+		switch {
+		case setFlags[name]:
+			return "flag --" + name
+		case fromDefaults:
+			return "defaults"
+		}
+		return "built-in"
+	}
+
+	var settings []setting
+	add := func(name, value, src string) {
+		settings = append(settings, setting{Name: name, Value: value, Source: src})
+	}
+
+	if !setFlags["ssh-key"] && d.Key != "" {
+		*f.sshKeys = stringSliceFlag{d.Key}
+	}
+	keys := strings.Join(*f.sshKeys, ",")
+	if keys == "" {
+		keys = "~/.ssh/id_rsa"
+	}
+	add("key", keys, source("ssh-key", d.Key != ""))
+
+	if !setFlags["parallel-requests"] && d.ParallelRequests > 0 {
+		*f.parallelRequests = d.ParallelRequests
+	}
+	add("parallel_requests", strconv.Itoa(*f.parallelRequests), source("parallel-requests", d.ParallelRequests > 0))
+
+	if !setFlags["ssh-timeout"] && d.SSHTimeout > 0 {
+		*f.sshTimeout = d.SSHTimeout
+	}
+	add("ssh_timeout", f.sshTimeout.String(), source("ssh-timeout", d.SSHTimeout > 0))
+
+	// A preset's timeout is applied like the flag; the defaults section's
+	// (or default_command_timeout) comes after host command_timeout
+	switch {
+	case setFlags["command-timeout"]:
+		add("command_timeout", f.commandTimeout.String(), "flag --command-timeout")
+	case *f.commandTimeout > 0:
+		add("command_timeout", f.commandTimeout.String(), "preset")
+	case config.DefaultCommandTimeout > 0:
+		add("command_timeout", config.DefaultCommandTimeout.String(), "defaults")
+	default:
+		add("command_timeout", "none", "built-in")
+	}
+
+	if !setFlags["output"] && d.Output != "" {
+		*f.output = d.Output
+	}
+	add("output", *f.output, source("output", d.Output != ""))
+
+	if !setFlags["known-hosts"] && d.KnownHosts != "" {
+		*f.knownHosts = d.KnownHosts
+	}
+	knownHosts := *f.knownHosts
+	if knownHosts == "" {
+		knownHosts = "none (host keys not verified)"
+	}
+	add("known_hosts", knownHosts, source("known-hosts", d.KnownHosts != ""))
+
+	// Hosts with their own user@ or :port keep them
+	user, userSource := "root", "built-in"
+	if d.User != "" {
+		user, userSource = d.User, "defaults"
+	}
+	add("user", user, userSource)
+	port, portSource := runner.DefaultPort, "built-in"
+	if d.Port > 0 {
+		port, portSource = d.Port, "defaults"
+	}
+	add("port", strconv.Itoa(port), portSource)
+
+	return settings
+}
+
+// printSettings lists the effective settings and their sources.
+func printSettings(w io.Writer, settings []setting) {
+	fmt.Fprintf(w, "Settings:\n")
+	for _, s := range settings {
+		fmt.Fprintf(w, "  %s=%s (%s)\n", s.Name, s.Value, s.Source)
+	}
+	fmt.Fprintln(w)
+}
+
+func logSettings(settings []setting) {
+	for _, s := range settings {
+		slog.Debug("Effective setting", "name", s.Name, "value", s.Value, "source", s.Source)
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const diffContextLines = 3
+
+// maxDiffCells caps the LCS table unifiedDiff builds, 4M cells or 16 MB.
+const maxDiffCells = 4 << 20
+
+// normalizeOutput drops trailing whitespace on every line and trailing blank
+// lines, so outputs that only differ there compare equal.
+func normalizeOutput(output string) string {
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+
+	return strings.TrimRight(strings.Join(lines, "\n"), "\n")
+}
+
+// computeBaseline returns the most common normalized output among the
+// successful results. Ties go to the lexically smallest output so the
+// baseline doesn't depend on the order hosts finished in.
+func computeBaseline(results []CommandResult) string {
+	counts := make(map[string]int)
+	for _, result := range results {
+		if result.Error == nil {
+			counts[normalizeOutput(result.Output)]++
+		}
+	}
+
+	var baseline string
+	best := 0
+	for output, count := range counts {
+		if count > best || (count == best && output < baseline) {
+			baseline, best = output, count
+		}
+	}
+
+	return baseline
+}
+
+// printDiff prints every host whose output differs from the baseline, along
+// with a unified diff, and reports how many hosts differed.
+func printDiff(w io.Writer, results []CommandResult) int {
+	baseline := computeBaseline(results)
+
+	var matching int
+	var differing []CommandResult
+	for _, result := range results {
+		if result.Error == nil && normalizeOutput(result.Output) == baseline {
+			matching++
+		} else {
+			differing = append(differing, result)
+		}
+	}
+
+	fmt.Fprintf(w, "Baseline output (%d of %d hosts):\n%s\n", matching, len(results), baseline)
+	for _, result := range differing {
+		fmt.Fprintln(w)
+		if result.Error != nil {
+			fmt.Fprintf(w, "%s: failed: %v\n", result.Host, result.Error)
+			continue
+		}
+		fmt.Fprint(w, unifiedDiff(baseline, normalizeOutput(result.Output), "baseline", result.Host))
+	}
+
+	return len(differing)
+}
+
+// unifiedDiff returns a line-based unified diff between a and b. Lines the
+// outputs start and end with in common are set aside first; when what is
+// left would need more than maxDiffCells of LCS table, only the line counts
+// are reported, so huge outputs can't exhaust memory.
+func unifiedDiff(a, b, aName, bName string) string {
+	aLines := strings.Split(a, "\n")
+	bLines := strings.Split(b, "\n")
+
+	type diffLine struct {
+		op   byte
+		text string
+		a, b int
+	}
+	var lines []diffLine
+
+	prefix := 0
+	for prefix < len(aLines) && prefix < len(bLines) && aLines[prefix] == bLines[prefix] {
+		lines = append(lines, diffLine{' ', aLines[prefix], prefix, prefix})
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(aLines)-prefix && suffix < len(bLines)-prefix && aLines[len(aLines)-1-suffix] == bLines[len(bLines)-1-suffix] {
+		suffix++
+	}
+	aMid := aLines[prefix : len(aLines)-suffix]
+	bMid := bLines[prefix : len(bLines)-suffix]
+
+	if int64(len(aMid)+1)*int64(len(bMid)+1) > maxDiffCells {
+		return fmt.Sprintf("--- %s\n+++ %s\n[outputs differ: %d and %d lines, too many to diff]\n", aName, bName, len(aLines), len(bLines))
+	}
+
+	// Longest common subsequence table, lcs[i][j] covers aMid[i:] and bMid[j:]
+	lcs := make([][]int32, len(aMid)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(bMid)+1)
+	}
+	for i := len(aMid) - 1; i >= 0; i-- {
+		for j := len(bMid) - 1; j >= 0; j-- {
+			if aMid[i] == bMid[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(aMid) || j < len(bMid) {
+		switch {
+		case i < len(aMid) && j < len(bMid) && aMid[i] == bMid[j]:
+			lines = append(lines, diffLine{' ', aMid[i], prefix + i, prefix + j})
+			i++
+			j++
+		case j < len(bMid) && (i == len(aMid) || lcs[i][j+1] > lcs[i+1][j]):
+			lines = append(lines, diffLine{'+', bMid[j], prefix + i, prefix + j})
+			j++
+		default:
+			lines = append(lines, diffLine{'-', aMid[i], prefix + i, prefix + j})
+			i++
+		}
+	}
+	for k := 0; k < suffix; k++ {
+		lines = append(lines, diffLine{' ', aLines[prefix+i+k], prefix + i + k, prefix + j + k})
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- %s\n+++ %s\n", aName, bName)
+
+	// Group changes into hunks with a few lines of context around them
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+
+		first := start - diffContextLines
+		if first < 0 {
+			first = 0
+		}
+		last := start
+		for k := start; k < len(lines) && k <= last+2*diffContextLines; k++ {
+			if lines[k].op != ' ' {
+				last = k
+			}
+		}
+		end := last + diffContextLines + 1
+		if end > len(lines) {
+			end = len(lines)
+		}
+
+		var aCount, bCount int
+		for _, line := range lines[first:end] {
+			if line.op != '+' {
+				aCount++
+			}
+			if line.op != '-' {
+				bCount++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(lines[first].a, aCount), hunkRange(lines[first].b, bCount))
+		for _, line := range lines[first:end] {
+			fmt.Fprintf(&out, "%c%s\n", line.op, line.text)
+		}
+
+		start = end
+	}
+
+	return out.String()
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// Host diff statuses from diffResults.
+const (
+	hostChanged = "changed"
+	hostNew     = "new"
+	hostMissing = "missing"
+)
+
+// HostDiff is a host whose result differs from a saved baseline run.
+type HostDiff struct {
+	Host   string
+	Status string
+	// Diff is the unified diff from the baseline output, for changed hosts.
+	Diff string
+}
+
+// diffResults compares current against baseline host by host: hosts whose
+// output (or failure) changed, hosts new since the baseline, then hosts
+// missing from the current run. Unchanged hosts are left out.
+func diffResults(baseline, current []CommandResult) []HostDiff {
+	previous := make(map[string]CommandResult, len(baseline))
+	for _, result := range baseline {
+		previous[result.Host] = result
+	}
+	seen := make(map[string]bool, len(current))
+
+	var diffs []HostDiff
+	for _, result := range current {
+		seen[result.Host] = true
+		before, ok := previous[result.Host]
+		if !ok {
+			diffs = append(diffs, HostDiff{Host: result.Host, Status: hostNew})
+			continue
+		}
+		a, b := comparableOutput(before), comparableOutput(result)
+		if a != b {
+			diffs = append(diffs, HostDiff{Host: result.Host, Status: hostChanged, Diff: unifiedDiff(a, b, "baseline", result.Host)})
+		}
+	}
+	for _, result := range baseline {
+		if !seen[result.Host] {
+			diffs = append(diffs, HostDiff{Host: result.Host, Status: hostMissing})
+		}
+	}
+
+	return diffs
+}
+
+// comparableOutput is the normalized output, with the error as a last line
+// so a host that started or stopped failing counts as changed.
+func comparableOutput(result CommandResult) string {
+	output := normalizeOutput(result.Output)
+	if result.Error == nil {
+		return output
+	}
+	if output != "" {
+		output += "\n"
+	}
+
+	return output + "[failed: " + result.Error.Error() + "]"
+}
+
+// printBaselineDiff prints the hosts that changed since the baseline run,
+// and then those that are new or missing.
+func printBaselineDiff(w io.Writer, diffs []HostDiff, total int) {
+	var added, missing []string
+	changed := 0
+	for _, diff := range diffs {
+		switch diff.Status {
+		case hostChanged:
+			changed++
+			fmt.Fprint(w, diff.Diff)
+			fmt.Fprintln(w)
+		case hostNew:
+			added = append(added, diff.Host)
+		case hostMissing:
+			missing = append(missing, diff.Host)
+		}
+	}
+
+	fmt.Fprintf(w, "Changed since baseline: %d of %d hosts\n", changed, total)
+	if len(added) > 0 {
+		fmt.Fprintf(w, "New (not in baseline): %s\n", strings.Join(added, ", "))
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(w, "Missing (in baseline only): %s\n", strings.Join(missing, ", "))
+	}
+}
+
+// readBaseline loads the results of an earlier run as written by
+// --output ndjson, one JSON object per line. A JSON array of the same
+// objects is accepted too.
+func readBaseline(path string) ([]CommandResult, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []ndjsonResult
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &records); err != nil {
+			return nil, fmt.Errorf("invalid baseline: %w", err)
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		for {
+			var record ndjsonResult
+			if err := decoder.Decode(&record); err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, fmt.Errorf("invalid baseline: %w", err)
+			}
+			records = append(records, record)
+		}
+	}
+
+	// With --watch output, a later iteration's record replaces the earlier
+	results := make([]CommandResult, 0, len(records))
+	index := make(map[string]int)
+	for _, record := range records {
+		if record.Host == "" {
+			return nil, errors.New("invalid baseline: record without a host")
+		}
+		output, err := decodeOutput(record.Output, record.Encoding)
+		if err != nil {
+			return nil, fmt.Errorf("invalid baseline record for %s: %w", record.Host, err)
+		}
+		result := CommandResult{Host: record.Host, Output: output, ExitCode: record.ExitCode}
+		if record.Error != nil {
+			result.Error = errors.New(*record.Error)
+		}
+		if i, ok := index[record.Host]; ok {
+			results[i] = result
+			continue
+		}
+		index[record.Host] = len(results)
+		results = append(results, result)
+	}
+
+	return results, nil
+}
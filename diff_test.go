@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want string
+	}{
+		{
+			name: "changed line",
+			a:    "a\nb\nc",
+			b:    "a\nB\nc",
+			want: "@@ -1,3 +1,3 @@\n a\n-b\n+B\n c\n",
+		},
+		{
+			name: "added at end",
+			a:    "a\nb",
+			b:    "a\nb\nc",
+			want: "@@ -1,2 +1,3 @@\n a\n b\n+c\n",
+		},
+		{
+			name: "removed at start",
+			a:    "a\nb\nc",
+			b:    "b\nc",
+			want: "@@ -1,3 +1,2 @@\n-a\n b\n c\n",
+		},
+		{
+			name: "context is cut to three lines",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9",
+			b:    "1\n2\n3\n4\nfive\n6\n7\n8\n9",
+			want: "@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+five\n 6\n 7\n 8\n",
+		},
+		{
+			name: "separate hunks",
+			a:    "a\n1\n2\n3\n4\n5\n6\n7\n8\nb",
+			b:    "A\n1\n2\n3\n4\n5\n6\n7\n8\nB",
+			want: "@@ -1,4 +1,4 @@\n-a\n+A\n 1\n 2\n 3\n@@ -7,4 +7,4 @@\n 6\n 7\n 8\n-b\n+B\n",
+		},
+		{
+			name: "from empty",
+			a:    "",
+			b:    "x",
+			want: "@@ -1 +1 @@\n-\n+x\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := unifiedDiff(tt.a, tt.b, "baseline", "web1")
+			want := "--- baseline\n+++ web1\n" + tt.want
+			if got != want {
+				t.Errorf("unifiedDiff() =\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func numberedLines(n int, format string) string {
+	lines := make([]string, n)
+	for i := range lines {
+		lines[i] = fmt.Sprintf(format, i)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestUnifiedDiffLongOutputs(t *testing.T) {
+	a := numberedLines(200000, "line %d")
+	b := strings.Replace(a, "line 100000\n", "changed\n", 1)
+
+	got := unifiedDiff(a, b, "baseline", "web1")
+	want := "--- baseline\n+++ web1\n@@ -99998,7 +99998,7 @@\n line 99997\n line 99998\n line 99999\n-line 100000\n+changed\n line 100001\n line 100002\n line 100003\n"
+	if got != want {
+		t.Errorf("unifiedDiff() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestUnifiedDiffTooLong(t *testing.T) {
+	a := numberedLines(100000, "a %d")
+	b := numberedLines(100000, "b %d")
+
+	got := unifiedDiff(a, b, "baseline", "web1")
+	if want := "--- baseline\n+++ web1\n[outputs differ: 100000 and 100000 lines, too many to diff]\n"; got != want {
+		t.Errorf("unifiedDiff() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"server-manager/runner"
+)
+
+func parseEnvVar(pair string) (runner.EnvVar, error) {
+	name, value, err := parseKeyValue(pair)
+	if err != nil {
+		return runner.EnvVar{}, err
+	}
+	if err := runner.ValidateEnvName(name); err != nil {
+		return runner.EnvVar{}, err
+	}
+
+	return runner.EnvVar{Name: name, Value: value}, nil
+}
+
+// readEnvFile reads KEY=VALUE lines, skipping blank lines and # comments.
+func readEnvFile(filename string) ([]runner.EnvVar, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var vars []runner.EnvVar
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		v, err := parseEnvVar(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", filename, lineNo, err)
+		}
+		vars = append(vars, v)
+	}
+
+	return vars, scanner.Err()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseEnvVar(t *testing.T) {
+	valid := map[string]string{
+		"FOO=bar":          "FOO",
+		"_private=1":       "_private",
+		"PATH2=/usr/bin":   "PATH2",
+		"EMPTY=":           "EMPTY",
+		"EQ=a=b":           "EQ",
+		"QUOTED='$(id)' x": "QUOTED",
+	}
+	for pair, name := range valid {
+		v, err := parseEnvVar(pair)
+		if err != nil {
+			t.Errorf("parseEnvVar(%q): %v", pair, err)
+			continue
+		}
+		if v.Name != name || name+"="+v.Value != pair {
+			t.Errorf("parseEnvVar(%q) = %+v", pair, v)
+		}
+	}
+
+	for _, pair := range []string{"novalue", "=value", "1ABC=x", "A-B=x", "A B=x", "A;rm -rf /;B=x", "$(id)=x", "ÄB=x", "A.B=x"} {
+		if v, err := parseEnvVar(pair); err == nil {
+			t.Errorf("parseEnvVar(%q) = %+v, want an error", pair, v)
+		}
+	}
+}
+
+func TestReadEnvFileRejectsBadNames(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deploy.env")
+	if err := ioutil.WriteFile(path, []byte("# comment\nGOOD=1\n\nBAD NAME=2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := readEnvFile(path)
+	if err == nil || !strings.Contains(err.Error(), "deploy.env:4:") {
+		t.Errorf("err = %v, want one for line 4", err)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"server-manager/runner"
+)
+
+// factsReport is the --facts-format json document entry for one host. Error
+// is set when the host couldn't be reached or every probe failed.
+type factsReport struct {
+	runner.HostFacts
+	Error string `json:"error,omitempty"`
+}
+
+// collectFacts decodes the facts of each result, keyed by host.
+func collectFacts(results []CommandResult) map[string]factsReport {
+	reports := make(map[string]factsReport, len(results))
+	for _, result := range results {
+		var report factsReport
+		if result.Output != "" {
+			if err := json.Unmarshal([]byte(result.Output), &report.HostFacts); err != nil {
+				report.Error = "invalid facts: " + err.Error()
+			}
+		}
+		if result.Error != nil {
+			report.Error = result.Error.Error()
+		}
+		reports[result.Host] = report
+	}
+
+	return reports
+}
+
+// writeFacts prints the facts as a JSON document keyed by host, or as a
+// table with a column per probe in hosts order.
+func writeFacts(w io.Writer, format string, hosts []string, probes []runner.FactProbe, reports map[string]factsReport) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(reports)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := []string{"HOST"}
+	for _, probe := range probes {
+		header = append(header, strings.ToUpper(probe.Name))
+	}
+	fmt.Fprintln(tw, strings.Join(append(header, "ERROR"), "\t"))
+
+	for _, host := range hosts {
+		report, ok := reports[host]
+		if !ok {
+			continue
+		}
+		row := []string{host}
+		for _, probe := range probes {
+			row = append(row, formatFact(report.Facts[probe.Name]))
+		}
+		// Name the failed probes when the host itself was reachable
+		errText := report.Error
+		if errText == "" && len(report.Errors) > 0 {
+			var failed []string
+			for name := range report.Errors {
+				failed = append(failed, name)
+			}
+			sort.Strings(failed)
+			errText = "failed: " + strings.Join(failed, ", ")
+		}
+		fmt.Fprintln(tw, strings.Join(append(row, errText), "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// formatFact renders a fact value for a table cell; maps (like df usage)
+// become sorted key=value pairs.
+func formatFact(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "-"
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		pairs := make([]string, len(keys))
+		for i, key := range keys {
+			pairs[i] = fmt.Sprintf("%s=%v", key, v[key])
+		}
+		return strings.Join(pairs, ",")
+	case float64:
+		// JSON numbers decode as float64; facts are whole numbers
+		return fmt.Sprintf("%.0f", v)
+	}
+
+	return fmt.Sprint(value)
+}
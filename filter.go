@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"path"
+	"regexp"
+	"strings"
+
+	"server-manager/runner"
+)
+
+// filterHosts keeps the entries whose host matches both the regular
+// expression and the glob (either may be unset) and returns the rest separately.
+func filterHosts(entries []runner.HostEntry, re *regexp.Regexp, glob string) (kept, dropped []runner.HostEntry, err error) {
+	for _, entry := range entries {
+		match := re == nil || re.MatchString(entry.Host)
+		if match && glob != "" {
+			if match, err = path.Match(glob, entry.Host); err != nil {
+				return nil, nil, err
+			}
+		}
+
+		if match {
+			kept = append(kept, entry)
+		} else {
+			dropped = append(dropped, entry)
+		}
+	}
+
+	return kept, dropped, nil
+}
+
+// filterHostsByRegex keeps the hosts that match include and then drops those
+// that match exclude. Either may be nil.
+func filterHostsByRegex(hosts []string, include, exclude *regexp.Regexp) []string {
+	var kept []string
+	for _, host := range hosts {
+		if include != nil && !include.MatchString(host) {
+			continue
+		}
+		if exclude != nil && exclude.MatchString(host) {
+			continue
+		}
+		kept = append(kept, host)
+	}
+
+	return kept
+}
+
+// filterEntriesByRegex keeps the entries whose host filterHostsByRegex keeps
+// and returns the rest separately.
+func filterEntriesByRegex(entries []runner.HostEntry, include, exclude *regexp.Regexp) (kept, dropped []runner.HostEntry) {
+	matched := make(map[string]bool)
+	for _, host := range filterHostsByRegex(runner.HostNames(entries), include, exclude) {
+		matched[host] = true
+	}
+	for _, entry := range entries {
+		if matched[entry.Host] {
+			kept = append(kept, entry)
+		} else {
+			dropped = append(dropped, entry)
+		}
+	}
+
+	return kept, dropped
+}
+
+// excludeHosts drops the entries whose host equals or glob-matches one of
+// the patterns. Patterns that match nothing are returned as unused.
+func excludeHosts(entries []runner.HostEntry, patterns []string) (kept, excluded []runner.HostEntry, unused []string, err error) {
+	used := make([]bool, len(patterns))
+	for _, entry := range entries {
+		match := false
+		for i, pattern := range patterns {
+			ok, err := path.Match(pattern, entry.Host)
+			if err != nil {
+				return nil, nil, nil, fmt.Errorf("invalid exclusion %q: %w", pattern, err)
+			}
+			if ok || pattern == entry.Host {
+				used[i] = true
+				match = true
+			}
+		}
+
+		if match {
+			excluded = append(excluded, entry)
+		} else {
+			kept = append(kept, entry)
+		}
+	}
+
+	for i, pattern := range patterns {
+		if !used[i] {
+			unused = append(unused, pattern)
+		}
+	}
+
+	return kept, excluded, unused, nil
+}
+
+// readPatternFile reads one pattern per line, skipping blank lines and # comments.
+func readPatternFile(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			patterns = append(patterns, line)
+		}
+	}
+
+	return patterns, nil
+}
+
+// entrySource says where a host entry came from, for warnings: its line and
+// groups, whichever are known.
+func entrySource(entry runner.HostEntry) string {
+	var parts []string
+	if entry.Line > 0 {
+		parts = append(parts, fmt.Sprintf("line %d", entry.Line))
+	}
+	if len(entry.Groups) > 0 {
+		parts = append(parts, "groups "+strings.Join(entry.Groups, ","))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// dropDuplicateHosts leaves out the hosts that connect to the same user,
+// host and port as an earlier one, warning about each, and returns how many
+// were dropped. entries and targets go together by position.
+func dropDuplicateHosts(entries []runner.HostEntry, targets []runner.Target) ([]runner.HostEntry, []runner.Target, int) {
+	kept, duplicates := runner.DedupeTargets(targets)
+	if len(duplicates) == 0 {
+		return entries, targets, 0
+	}
+
+	dropped := make(map[int]bool, len(duplicates))
+	for _, dup := range duplicates {
+		dropped[dup.Index] = true
+		entry, first := entries[dup.Index], entries[dup.Of]
+		args := []any{"host", entry.Host, "endpoint", targets[dup.Index].Endpoint(), "same_as", first.Host}
+		if from := entrySource(entry); from != "" {
+			args = append(args, "from", from)
+		}
+		if from := entrySource(first); from != "" {
+			args = append(args, "first_from", from)
+		}
+		slog.Warn("Dropping duplicate host (use --allow-duplicates to run on it again)", args...)
+	}
+	keptEntries := make([]runner.HostEntry, 0, len(kept))
+	for i, entry := range entries {
+		if !dropped[i] {
+			keptEntries = append(keptEntries, entry)
+		}
+	}
+
+	return keptEntries, kept, len(duplicates)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"server-manager/runner"
+)
+
+func TestFilterHostsByRegex(t *testing.T) {
+	hosts := []string{"web-01.prod", "web-02.prod", "db-01.prod", "web-01.stage", "cache-01.stage", "10.0.0.5", "deploy@web-03.prod:2222"}
+	tests := []struct {
+		name             string
+		include, exclude string
+		want             []string
+	}{
+		{name: "no patterns", want: hosts},
+		{name: "prefix", include: `^web-`, want: []string{"web-01.prod", "web-02.prod", "web-01.stage"}},
+		{name: "suffix", include: `\.stage$`, want: []string{"web-01.stage", "cache-01.stage"}},
+		{name: "numbered", include: `-0[12]\.`, want: []string{"web-01.prod", "web-02.prod", "db-01.prod", "web-01.stage", "cache-01.stage"}},
+		{name: "alternation", include: `^(db|cache)-`, want: []string{"db-01.prod", "cache-01.stage"}},
+		{name: "ip address", include: `^\d+\.\d+\.\d+\.\d+$`, want: []string{"10.0.0.5"}},
+		{name: "unanchored matches user and port", include: `web-03`, want: []string{"deploy@web-03.prod:2222"}},
+		{name: "exclude only", exclude: `\.prod`, want: []string{"web-01.stage", "cache-01.stage", "10.0.0.5"}},
+		{name: "include then exclude", include: `^web-`, exclude: `\.stage$`, want: []string{"web-01.prod", "web-02.prod"}},
+		{name: "exclude everything included", include: `^db-`, exclude: `prod`, want: nil},
+		{name: "no match", include: `^mail-`, want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var include, exclude *regexp.Regexp
+			if tt.include != "" {
+				include = regexp.MustCompile(tt.include)
+			}
+			if tt.exclude != "" {
+				exclude = regexp.MustCompile(tt.exclude)
+			}
+
+			got := filterHostsByRegex(hosts, include, exclude)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("filterHostsByRegex() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropDuplicateHosts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.yaml")
+	yaml := `hosts:
+  - web1
+  - db1
+  - host: web1
+    groups: [web]
+  - root@db1:22
+  - web2
+`
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config, err := runner.ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := buildTargets(config, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var logs bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+
+	entries, kept, dropped := dropDuplicateHosts(config.Hosts, targets)
+	if dropped != 2 {
+		t.Errorf("dropped %d hosts, want 2", dropped)
+	}
+	if got, want := runner.HostNames(entries), []string{"web1", "db1", "web2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept entries %v, want %v", got, want)
+	}
+	if len(kept) != len(entries) {
+		t.Errorf("kept %d targets for %d entries", len(kept), len(entries))
+	}
+
+	// The flat list entry plus its copy in a group, and a copy-paste
+	// duplicate spelled differently
+	warnings := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	if len(warnings) != 2 {
+		t.Fatalf("logged %q, want two warnings", logs.String())
+	}
+	for i, want := range []string{
+		`host=web1 endpoint=root@web1:22 same_as=web1 from="line 4, groups web" first_from="line 2"`,
+		`host=root@db1:22 endpoint=root@db1:22 same_as=db1 from="line 6" first_from="line 3"`,
+	} {
+		if !strings.Contains(warnings[i], want) {
+			t.Errorf("warning %q doesn't contain %q", warnings[i], want)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// stringSliceFlag collects the values of a flag that may be given multiple times.
+type stringSliceFlag []string
+
+func (f *stringSliceFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringSliceFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// parseKeyValue splits a KEY=VALUE pair, keeping the value verbatim.
+func parseKeyValue(pair string) (string, string, error) {
+	name, value, ok := strings.Cut(pair, "=")
+	if !ok || name == "" {
+		return "", "", fmt.Errorf("invalid value %q, expected KEY=VALUE", pair)
+	}
+
+	return name, value, nil
+}
+
+// defaultHistoryRuns is how many runs a bare --history lists.
+const defaultHistoryRuns = 10
+
+// historyFlag is the value of --history, which may be given bare like a
+// boolean flag or with a number of runs as --history=N.
+type historyFlag struct {
+	Runs int
+}
+
+func (f *historyFlag) String() string {
+	if f == nil || f.Runs == 0 {
+		return ""
+	}
+
+	return strconv.Itoa(f.Runs)
+}
+
+func (f *historyFlag) Set(value string) error {
+	if value == "true" {
+		f.Runs = defaultHistoryRuns
+		return nil
+	}
+	runs, err := strconv.Atoi(value)
+	if err != nil || runs < 1 {
+		return fmt.Errorf("expected a number of runs, got %q", value)
+	}
+	f.Runs = runs
+
+	return nil
+}
+
+func (f *historyFlag) IsBoolFlag() bool {
+	return true
+}
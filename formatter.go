@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"regexp"
+	"sync"
+	"text/template"
+)
+
+const defaultOutputTemplate = "{{.Host}}: {{.Output}}"
+
+// ResultFormatter renders a single CommandResult as it arrives.
+type ResultFormatter interface {
+	WriteResult(w io.Writer, r CommandResult) error
+}
+
+// flushingFormatter is a ResultFormatter that holds results back until
+// Flush, e.g. to align them.
+type flushingFormatter interface {
+	ResultFormatter
+	Flush(w io.Writer) error
+}
+
+// flushResults prints what the formatter holds back, if it does.
+func flushResults(w io.Writer, formatter ResultFormatter) {
+	if f, ok := formatter.(flushingFormatter); ok {
+		if err := f.Flush(w); err != nil {
+			slog.Error("Failed to format results", "error", err)
+		}
+	}
+}
+
+// newResultFormatter picks the formatter requested on the command line.
+// columns and width only apply to the table format.
+func newResultFormatter(format, text, file string, columns []string, width int) (ResultFormatter, error) {
+	if format != "table" && len(columns) > 0 {
+		return nil, errors.New("--output-columns needs --output table")
+	}
+	switch format {
+	case "text":
+	case "ndjson", "table":
+		if text != "" || file != "" {
+			return nil, fmt.Errorf("--output %s cannot be combined with an output template", format)
+		}
+		if format == "table" {
+			return NewTableFormatter(columns, width)
+		}
+		return &NDJSONFormatter{}, nil
+	default:
+		return nil, fmt.Errorf("unknown output format %q (expected text, ndjson or table)", format)
+	}
+
+	if text != "" && file != "" {
+		return nil, errors.New("--output-template and --output-template-file are mutually exclusive")
+	}
+	if text == "" && file == "" {
+		return textFormatter{}, nil
+	}
+
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		text = string(data)
+	}
+
+	return NewTemplateFormatter(text)
+}
+
+// textFormatter prints results in the classic "Output from <host>" layout.
+type textFormatter struct{}
+
+func (textFormatter) WriteResult(w io.Writer, r CommandResult) error {
+	if r.Error != nil {
+		slog.Error("Failed to execute command", "host", r.Host, "kind", r.ErrorKind, "error", r.Error)
+		return nil
+	}
+
+	output := printableOutput(r.Output)
+	if r.Truncated {
+		output = fmt.Sprintf("[output truncated, last %d of %d bytes]\n", len(r.Output), r.OutputBytes) + output
+	}
+
+	_, err := fmt.Fprintf(w, "Output from %s:\n%s\n", r.Host, output)
+	return err
+}
+
+// TemplateFormatter renders each result through a text/template.
+type TemplateFormatter struct {
+	tmpl *template.Template
+}
+
+func NewTemplateFormatter(text string) (*TemplateFormatter, error) {
+	if text == "" {
+		text = defaultOutputTemplate
+	}
+
+	tmpl, err := template.New("output").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TemplateFormatter{tmpl: tmpl}, nil
+}
+
+func (f *TemplateFormatter) WriteResult(w io.Writer, r CommandResult) error {
+	// Render into a buffer so a failing template doesn't leave partial output
+	var buf bytes.Buffer
+	if err := f.tmpl.Execute(&buf, r); err != nil {
+		return fmt.Errorf("template error for %s: %w", r.Host, err)
+	}
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// NDJSONFormatter writes each result as one JSON object per line, as soon as
+// it arrives. It is safe for concurrent use. A non-zero Iteration (under
+// --watch) is included in every record.
+type NDJSONFormatter struct {
+	Iteration int
+
+	mu sync.Mutex
+}
+
+type ndjsonResult struct {
+	Host            string  `json:"host"`
+	Output          string  `json:"output"`
+	Encoding        string  `json:"encoding,omitempty"`
+	Error           *string `json:"error"`
+	ErrorKind       string  `json:"error_kind,omitempty"`
+	ExitCode        int     `json:"exit_code"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Iteration       int     `json:"iteration,omitempty"`
+	Truncated       bool    `json:"truncated,omitempty"`
+	OutputBytes     int64   `json:"output_bytes,omitempty"`
+}
+
+func newNDJSONResult(r CommandResult) ndjsonResult {
+	record := ndjsonResult{
+		Host:            r.Host,
+		ExitCode:        r.ExitCode,
+		DurationSeconds: r.Duration.Seconds(),
+	}
+	// JSON strings must be UTF-8, binary output goes in as base64
+	record.Output, record.Encoding = encodeOutput(r.Output)
+	if r.Truncated {
+		record.Truncated = true
+		record.OutputBytes = r.OutputBytes
+	}
+	if r.Error != nil {
+		msg := r.Error.Error()
+		record.Error = &msg
+		record.ErrorKind = string(r.ErrorKind)
+	}
+
+	return record
+}
+
+func (f *NDJSONFormatter) WriteResult(w io.Writer, r CommandResult) error {
+	record := newNDJSONResult(r)
+	record.Iteration = f.Iteration
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	// One Write per line so concurrent results never interleave
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, err = w.Write(append(line, '\n'))
+	return err
+}
+
+// shouldPrintResult reports whether a result is printed under --output-filter:
+// results whose output matches the filter are hidden, or with invert they are
+// the only ones shown. A nil filter prints everything.
+func shouldPrintResult(result CommandResult, filter *regexp.Regexp, invert bool) bool {
+	if filter == nil {
+		return true
+	}
+
+	return filter.MatchString(result.Output) == invert
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestShouldPrintResult(t *testing.T) {
+	ok := regexp.MustCompile(`^OK$`)
+	tests := []struct {
+		name   string
+		output string
+		filter *regexp.Regexp
+		invert bool
+		want   bool
+	}{
+		{name: "nil filter", output: "OK", want: true},
+		{name: "nil filter inverted", output: "OK", invert: true, want: true},
+		{name: "match is hidden", output: "OK", filter: ok, want: false},
+		{name: "no match is printed", output: "disk full", filter: ok, want: true},
+		{name: "inverted match is printed", output: "OK", filter: ok, invert: true, want: true},
+		{name: "inverted no match is hidden", output: "disk full", filter: ok, invert: true, want: false},
+		{name: "multiline output", output: "load 0.1\nOK\n", filter: regexp.MustCompile(`(?m)^OK$`), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := shouldPrintResult(CommandResult{Host: "web1", Output: tt.output}, tt.filter, tt.invert)
+			if got != tt.want {
+				t.Errorf("shouldPrintResult(%q) = %v, want %v", tt.output, got, tt.want)
+			}
+		})
+	}
+}
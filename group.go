@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// ResultGroup is a set of hosts that returned identical output (or failed
+// with the identical error).
+type ResultGroup struct {
+	Output string
+	Error  string
+	Hosts  []string
+}
+
+// groupResults groups results by output, most common group first. Hosts
+// within a group are sorted so the listing is stable between runs.
+func groupResults(results []CommandResult) []ResultGroup {
+	type groupKey struct{ output, err string }
+
+	index := make(map[groupKey]int)
+	var groups []ResultGroup
+	for _, result := range results {
+		key := groupKey{output: result.Output}
+		if result.Error != nil {
+			key.err = result.Error.Error()
+		}
+
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, ResultGroup{Output: key.output, Error: key.err})
+		}
+		groups[i].Hosts = append(groups[i].Hosts, result.Host)
+	}
+
+	for _, group := range groups {
+		sort.Strings(group.Hosts)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if len(groups[i].Hosts) != len(groups[j].Hosts) {
+			return len(groups[i].Hosts) > len(groups[j].Hosts)
+		}
+		return groups[i].Output+groups[i].Error < groups[j].Output+groups[j].Error
+	})
+
+	return groups
+}
+
+// printGroups prints one line per group, listing at most maxHosts hosts
+// unless verbose is set.
+func printGroups(w io.Writer, groups []ResultGroup, maxHosts int, verbose bool) {
+	if verbose {
+		maxHosts = 0
+	}
+
+	for _, group := range groups {
+		var value string
+		if group.Error != "" {
+			value = "failed: " + group.Error
+			if output := strings.TrimRight(printableOutput(group.Output), "\n"); output != "" {
+				value += "\n" + output
+			}
+		} else {
+			value = strings.TrimRight(printableOutput(group.Output), "\n")
+		}
+
+		fmt.Fprintf(w, "%s =>", summarizeHosts(group.Hosts, maxHosts))
+		if strings.Contains(value, "\n") {
+			fmt.Fprintf(w, "\n%s\n", value)
+		} else {
+			fmt.Fprintf(w, " %s\n", value)
+		}
+	}
+}
+
+func summarizeHosts(hosts []string, maxHosts int) string {
+	if maxHosts <= 0 || len(hosts) <= maxHosts {
+		return "[" + strings.Join(hosts, ", ") + "]"
+	}
+
+	return fmt.Sprintf("[%s, ... and %d more]", strings.Join(hosts[:maxHosts], ", "), len(hosts)-maxHosts)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"server-manager/runner"
+)
+
+// HostHealthStore tracks how many runs in a row each host has failed, so
+// hosts that keep failing can be skipped instead of slowing down every run.
+type HostHealthStore struct {
+	Hosts map[string]HostHealth `json:"hosts"`
+}
+
+type HostHealth struct {
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastFailure time.Time `json:"last_failure"`
+}
+
+// LoadHostHealthStore reads the store at path; a missing file is an empty
+// store.
+func LoadHostHealthStore(path string) (*HostHealthStore, error) {
+	store := &HostHealthStore{}
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, store); err != nil {
+			return nil, err
+		}
+	}
+	if store.Hosts == nil {
+		store.Hosts = make(map[string]HostHealth)
+	}
+
+	return store, nil
+}
+
+// Record counts a failure for the host, or resets its counter on success. A
+// host the output budget kept from starting didn't fail, so its counter is
+// left as it is.
+func (s *HostHealthStore) Record(r CommandResult) {
+	if r.Error == nil {
+		delete(s.Hosts, r.Host)
+		return
+	}
+	if errors.Is(r.Error, runner.ErrOutputBudget) {
+		return
+	}
+
+	health := s.Hosts[r.Host]
+	health.Failures++
+	health.LastError = r.Error.Error()
+	health.LastFailure = time.Now()
+	s.Hosts[r.Host] = health
+}
+
+// Reset clears the counters of all hosts.
+func (s *HostHealthStore) Reset() {
+	s.Hosts = make(map[string]HostHealth)
+}
+
+// Save writes the store atomically, creating its directory if needed.
+func (s *HostHealthStore) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	return runner.WriteFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// skipUnhealthyHosts splits entries into the hosts to run on and those that
+// failed more than threshold runs in a row. A threshold of 0 skips nothing.
+func skipUnhealthyHosts(entries []runner.HostEntry, store *HostHealthStore, threshold int) ([]runner.HostEntry, []runner.HostEntry) {
+	if threshold <= 0 {
+		return entries, nil
+	}
+
+	var healthy, unhealthy []runner.HostEntry
+	for _, entry := range entries {
+		if store.Hosts[entry.Host].Failures > threshold {
+			unhealthy = append(unhealthy, entry)
+		} else {
+			healthy = append(healthy, entry)
+		}
+	}
+
+	return healthy, unhealthy
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"server-manager/runner"
+)
+
+func TestHostHealthStoreRecord(t *testing.T) {
+	store := &HostHealthStore{Hosts: map[string]HostHealth{}}
+	failed := CommandResult{Host: "web1", Error: errors.New("connection refused"), ExitCode: -1}
+
+	store.Record(failed)
+	store.Record(failed)
+	store.Record(CommandResult{Host: "web1", Error: runner.ErrOutputBudget, ExitCode: -1})
+	store.Record(CommandResult{Host: "web2", Error: runner.ErrOutputBudget, ExitCode: -1})
+	if got := store.Hosts["web1"]; got.Failures != 2 || got.LastError != "connection refused" {
+		t.Errorf("web1 = %+v, want 2 failures and the refused connection", got)
+	}
+	if _, ok := store.Hosts["web2"]; ok {
+		t.Error("a host the output budget kept from starting was counted")
+	}
+
+	path := filepath.Join(t.TempDir(), "health", "hosts.json")
+	if err := store.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadHostHealthStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.Record(CommandResult{Host: "web1"})
+	if len(loaded.Hosts) != 0 {
+		t.Errorf("hosts = %v after web1 succeeded", loaded.Hosts)
+	}
+
+	healthy, unhealthy := skipUnhealthyHosts([]runner.HostEntry{{Host: "web1"}, {Host: "web2"}}, store, 1)
+	if len(healthy) != 1 || healthy[0].Host != "web2" || len(unhealthy) != 1 || unhealthy[0].Host != "web1" {
+		t.Errorf("healthy %v, unhealthy %v", healthy, unhealthy)
+	}
+}
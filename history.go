@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+)
+
+// historyCommandWidth is how much of the command --history shows.
+const historyCommandWidth = 50
+
+type historyRecord struct {
+	HistoryRun
+	DurationSeconds *float64 `json:"duration_seconds"`
+}
+
+// printHistory lists runs as a table, or with ndjson as one JSON object per
+// run. Runs that never finished have no duration.
+func printHistory(w io.Writer, runs []HistoryRun, format string) error {
+	if format == "ndjson" {
+		for _, run := range runs {
+			record := historyRecord{HistoryRun: run}
+			if !run.Finished.IsZero() {
+				seconds := run.Finished.Sub(run.Started).Seconds()
+				record.DurationSeconds = &seconds
+			}
+			line, err := json.Marshal(record)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "%s\n", line); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if len(runs) == 0 {
+		fmt.Fprintln(w, "No runs recorded yet")
+		return nil
+	}
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RUN\tSTARTED\tDURATION\tHOSTS\tFAILED\tCOMMAND")
+	for _, run := range runs {
+		duration := "unfinished"
+		if !run.Finished.IsZero() {
+			duration = run.Finished.Sub(run.Started).Round(time.Millisecond).String()
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%d\t%s\n", run.ID, run.Started.Local().Format("2006-01-02 15:04:05"), duration, run.Hosts, run.Failed, shortenCommand(run.Command))
+	}
+
+	return tw.Flush()
+}
+
+// printHistoryRun prints a recorded run's results the way a live run does,
+// ending with its summary.
+func printHistoryRun(w io.Writer, run HistoryRun, results []CommandResult, formatter ResultFormatter) {
+	summary := Summary{Command: run.Command}
+	for _, result := range results {
+		summary.Add(result)
+		if err := formatter.WriteResult(w, result); err != nil {
+			slog.Error("Failed to format result", "error", err)
+		}
+	}
+	flushResults(w, formatter)
+	if run.Finished.IsZero() {
+		summary.Interrupted = true
+	} else {
+		summary.Duration = run.Finished.Sub(run.Started)
+	}
+
+	slog.Info("Summary", "run_id", run.ID, "started", run.Started, "run", summary)
+}
+
+// shortenCommand puts a command on one line of at most historyCommandWidth
+// characters.
+func shortenCommand(command string) string {
+	runes := []rune(command)
+	for i, r := range runes {
+		if r == '\n' || r == '\t' {
+			runes[i] = ' '
+		}
+	}
+	if len(runes) > historyCommandWidth {
+		return string(runes[:historyCommandWidth-3]) + "..."
+	}
+
+	return string(runes)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+
+	"server-manager/runner"
+)
+
+//go:embed templates/report.html
+var reportTemplates embed.FS
+
+var htmlReportTemplate = template.Must(template.ParseFS(reportTemplates, "templates/report.html"))
+
+type htmlReportRow struct {
+	Host           string
+	Status         string
+	Failed         bool
+	Duration       string
+	DurationMillis int64
+	ExitCode       int
+	Preview        string
+	Output         string
+	Error          string
+}
+
+type htmlReport struct {
+	Summary   Summary
+	Generated string
+	Duration  string
+	Rows      []htmlReportRow
+}
+
+// writeHTMLReport writes a self-contained HTML report of the results, sorted
+// by host. html/template escapes the command output.
+func writeHTMLReport(path string, summary Summary, results []CommandResult) error {
+	report := htmlReport{
+		Summary:   summary,
+		Generated: time.Now().Format(time.RFC1123),
+		Duration:  summary.Duration.Round(time.Millisecond).String(),
+	}
+
+	sorted := append([]CommandResult(nil), results...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Host < sorted[j].Host })
+	for _, r := range sorted {
+		row := htmlReportRow{
+			Host:           r.Host,
+			Status:         "ok",
+			Duration:       r.Duration.Round(time.Millisecond).String(),
+			DurationMillis: r.Duration.Milliseconds(),
+			ExitCode:       r.ExitCode,
+			Output:         r.Output,
+			Preview:        outputPreview(r.Output),
+		}
+		if r.Error != nil {
+			row.Status = "failed"
+			row.Failed = true
+			row.Error = r.Error.Error()
+			row.Preview = outputPreview(row.Error)
+		}
+		report.Rows = append(report.Rows, row)
+	}
+
+	var b bytes.Buffer
+	if err := htmlReportTemplate.Execute(&b, report); err != nil {
+		return err
+	}
+
+	return runner.WriteFileAtomic(path, b.Bytes(), 0644)
+}
+
+// outputPreview returns the first line of output, truncated for the table.
+func outputPreview(output string) string {
+	line := strings.TrimSpace(output)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i] + " …"
+	}
+	if runes := []rune(line); len(runes) > 80 {
+		line = string(runes[:80]) + "…"
+	}
+	if line == "" {
+		line = "(no output)"
+	}
+
+	return line
+}
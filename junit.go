@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"server-manager/runner"
+)
+
+// junitClassName is the classname of hosts that aren't in any group.
+const junitClassName = "server-manager"
+
+type junitTestSuite struct {
+	XMLName   xml.Name        `xml:"testsuite"`
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	TestCases []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// JUnitReport collects results for a run and writes them as a JUnit testsuite.
+// Hosts that never produced a result are reported as skipped.
+type JUnitReport struct {
+	mu      sync.Mutex
+	name    string
+	start   time.Time
+	hosts   []string
+	groups  map[string][]string
+	results map[string]CommandResult
+	skipped map[string]string
+}
+
+func NewJUnitReport(name string, entries []runner.HostEntry) *JUnitReport {
+	r := &JUnitReport{
+		name:    name,
+		start:   time.Now(),
+		groups:  make(map[string][]string),
+		results: make(map[string]CommandResult),
+		skipped: make(map[string]string),
+	}
+	for _, entry := range entries {
+		r.hosts = append(r.hosts, entry.Host)
+		r.groups[entry.Host] = entry.Groups
+	}
+
+	return r
+}
+
+func (r *JUnitReport) Add(result CommandResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.results[result.Host] = result
+}
+
+// Skip records a host that was deliberately not run, with the reason why.
+func (r *JUnitReport) Skip(entry runner.HostEntry, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.hosts = append(r.hosts, entry.Host)
+	r.groups[entry.Host] = entry.Groups
+	r.skipped[entry.Host] = reason
+}
+
+func (r *JUnitReport) WriteFile(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	suite := junitTestSuite{
+		Name:      r.name,
+		Tests:     len(r.hosts),
+		Time:      junitSeconds(time.Since(r.start)),
+		Timestamp: r.start.Format(time.RFC3339),
+	}
+
+	for _, host := range r.hosts {
+		testCase := junitTestCase{
+			Name:      host,
+			ClassName: r.className(host),
+		}
+
+		result, ok := r.results[host]
+		reason, skipped := r.skipped[host]
+		switch {
+		case skipped:
+			testCase.Time = junitSeconds(0)
+			testCase.Skipped = &junitSkipped{Message: reason}
+			suite.Skipped++
+		case !ok:
+			testCase.Time = junitSeconds(0)
+			testCase.Skipped = &junitSkipped{Message: "run aborted before host completed"}
+			suite.Skipped++
+		case result.Error != nil:
+			testCase.Time = junitSeconds(result.Duration)
+			testCase.Failure = &junitFailure{
+				Message: result.Error.Error(),
+				Type:    fmt.Sprintf("exit code %d", result.ExitCode),
+				Body:    result.Output,
+			}
+			suite.Failures++
+		default:
+			testCase.Time = junitSeconds(result.Duration)
+			testCase.SystemOut = result.Output
+		}
+
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
+
+// className is the JUnit classname for host: its groups, or junitClassName.
+func (r *JUnitReport) className(host string) string {
+	if groups := r.groups[host]; len(groups) > 0 {
+		return strings.Join(groups, ",")
+	}
+
+	return junitClassName
+}
+
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
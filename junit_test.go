@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"server-manager/runner"
+)
+
+func TestJUnitReportClassName(t *testing.T) {
+	report := NewJUnitReport("uptime", []runner.HostEntry{
+		{Host: "web1", Groups: []string{"web"}},
+		{Host: "db1", Groups: []string{"db", "prod"}},
+		{Host: "bare"},
+	})
+	report.Skip(runner.HostEntry{Host: "cache1", Groups: []string{"cache"}}, "excluded")
+	report.Add(CommandResult{Host: "web1", Output: "ok"})
+	report.Add(CommandResult{Host: "db1", Error: errors.New("boom"), ExitCode: 1})
+	report.Add(CommandResult{Host: "bare", Output: "ok"})
+
+	path := filepath.Join(t.TempDir(), "report.xml")
+	if err := report.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var suite junitTestSuite
+	if err := xml.Unmarshal(data, &suite); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"web1": "web", "db1": "db,prod", "bare": junitClassName, "cache1": "cache"}
+	if len(suite.TestCases) != len(want) {
+		t.Fatalf("got %d testcases, want %d", len(suite.TestCases), len(want))
+	}
+	for _, testCase := range suite.TestCases {
+		if testCase.ClassName != want[testCase.Name] {
+			t.Errorf("%s: classname %q, want %q", testCase.Name, testCase.ClassName, want[testCase.Name])
+		}
+	}
+}
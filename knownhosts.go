@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"server-manager/runner"
+)
+
+// updateKnownHosts scans the host keys of all targets and, after confirmation,
+// records new or changed keys in the known_hosts file.
+func updateKnownHosts(ctx context.Context, path string, targets []runner.Target, parallelism int, opts runner.Options) error {
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		// A missing file simply means every host is new
+		callback = func(string, net.Addr, ssh.PublicKey) error { return &knownhosts.KeyError{} }
+	}
+
+	// Scan concurrently, then prompt in host order
+	scanned, scanErrs := scanHostKeys(ctx, targets, parallelism, opts)
+
+	var accepted []*runner.ScannedKey
+	for i, target := range targets {
+		if scanErrs[i] != nil {
+			slog.Error("Failed to scan host key", "host", target.Name, "error", scanErrs[i])
+			continue
+		}
+
+		status, err := runner.CheckHostKey(callback, scanned[i])
+		if err != nil {
+			slog.Error("Failed to check host key", "host", target.Name, "error", err)
+			continue
+		}
+
+		var question string
+		switch status {
+		case runner.HostKeyKnown:
+			continue
+		case runner.HostKeyUnknown:
+			question = fmt.Sprintf("Host %s is not in %s (%s %s). Add it?", target.Name, path, scanned[i].Key.Type(), ssh.FingerprintSHA256(scanned[i].Key))
+		case runner.HostKeyChanged:
+			question = fmt.Sprintf("WARNING: host key of %s has changed (now %s %s). Replace the entry in %s?", target.Name, scanned[i].Key.Type(), ssh.FingerprintSHA256(scanned[i].Key), path)
+		}
+
+		ok, err := confirm(question)
+		if err != nil {
+			return err
+		}
+		if ok {
+			accepted = append(accepted, scanned[i])
+		}
+	}
+
+	if len(accepted) == 0 {
+		return nil
+	}
+
+	return runner.UpdateKnownHosts(path, accepted)
+}
+
+// checkKnownHostsStrict scans the host keys of all targets before anything
+// runs and fails listing every host whose key is missing from, or differs
+// from, the known_hosts file. Hosts that can't be scanned are left to fail
+// in the run itself.
+func checkKnownHostsStrict(ctx context.Context, path string, targets []runner.Target, parallelism int, opts runner.Options) error {
+	callback, err := knownhosts.New(path)
+	if err != nil {
+		return err
+	}
+
+	scanned, scanErrs := scanHostKeys(ctx, targets, parallelism, opts)
+	var unknown []string
+	for i, target := range targets {
+		if scanErrs[i] != nil {
+			slog.Warn("Failed to scan host key", "host", target.Name, "error", scanErrs[i])
+			continue
+		}
+
+		status, err := runner.CheckHostKey(callback, scanned[i])
+		if err != nil {
+			return fmt.Errorf("%s: %w", target.Name, err)
+		}
+		switch status {
+		case runner.HostKeyUnknown:
+			slog.Error("Host key not in known_hosts", "host", target.Name, "key", scanned[i].Key.Type()+" "+ssh.FingerprintSHA256(scanned[i].Key))
+			unknown = append(unknown, target.Name)
+		case runner.HostKeyChanged:
+			slog.Error("Host key differs from known_hosts", "host", target.Name, "key", scanned[i].Key.Type()+" "+ssh.FingerprintSHA256(scanned[i].Key))
+			unknown = append(unknown, target.Name)
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("%d hosts with unrecognized keys: %s (add them with --known-hosts-update)", len(unknown), strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
+
+// scanHostKeys scans the host keys of targets, parallelism at a time.
+func scanHostKeys(ctx context.Context, targets []runner.Target, parallelism int, opts runner.Options) ([]*runner.ScannedKey, []error) {
+	scanned := make([]*runner.ScannedKey, len(targets))
+	scanErrs := make([]error, len(targets))
+	semaphore := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target runner.Target) {
+			defer wg.Done()
+
+			semaphore <- struct{}{}
+			scanned[i], scanErrs[i] = runner.ScanHostKey(ctx, target, opts)
+			<-semaphore
+		}(i, target)
+	}
+	wg.Wait()
+
+	return scanned, scanErrs
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"server-manager/runner"
+)
+
+// Metric names and labels written by --metrics-textfile and pushed by
+// --metrics-pushgateway. They are part of the public interface: dashboards
+// and alerts depend on them, so do not rename them.
+//
+//	server_manager_hosts_total                 gauge  hosts the command ran on
+//	server_manager_hosts_failed                gauge  hosts where the command failed
+//	server_manager_run_duration_seconds        gauge  wall time of the whole run
+//	server_manager_last_run_timestamp_seconds  gauge  unix time the run finished
+//	server_manager_host_up{host}               gauge  1 if the command succeeded on host, else 0
+//	server_manager_host_exit_code{host}        gauge  exit code on host (-1 if it never ran)
+const (
+	metricHostsTotal       = "server_manager_hosts_total"
+	metricHostsFailed      = "server_manager_hosts_failed"
+	metricRunDuration      = "server_manager_run_duration_seconds"
+	metricLastRunTimestamp = "server_manager_last_run_timestamp_seconds"
+	metricHostUp           = "server_manager_host_up"
+	metricHostExitCode     = "server_manager_host_exit_code"
+)
+
+// formatMetrics renders the run in the Prometheus text exposition format,
+// which is also what the node_exporter textfile collector reads.
+func formatMetrics(summary Summary, results []CommandResult, finished time.Time) []byte {
+	var b bytes.Buffer
+
+	writeGauge(&b, metricHostsTotal, "Number of hosts the command ran on.")
+	fmt.Fprintf(&b, "%s %d\n", metricHostsTotal, summary.Total)
+	writeGauge(&b, metricHostsFailed, "Number of hosts where the command failed.")
+	fmt.Fprintf(&b, "%s %d\n", metricHostsFailed, summary.Failed)
+	writeGauge(&b, metricRunDuration, "Wall time of the run in seconds.")
+	fmt.Fprintf(&b, "%s %g\n", metricRunDuration, summary.Duration.Seconds())
+	writeGauge(&b, metricLastRunTimestamp, "Unix time the run finished.")
+	fmt.Fprintf(&b, "%s %d\n", metricLastRunTimestamp, finished.Unix())
+
+	sorted := append([]CommandResult(nil), results...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Host < sorted[j].Host })
+
+	writeGauge(&b, metricHostUp, "Whether the command succeeded on the host.")
+	for _, r := range sorted {
+		up := 1
+		if r.Error != nil {
+			up = 0
+		}
+		fmt.Fprintf(&b, "%s{host=\"%s\"} %d\n", metricHostUp, escapeLabelValue(r.Host), up)
+	}
+	writeGauge(&b, metricHostExitCode, "Exit code of the command on the host, -1 if it never ran.")
+	for _, r := range sorted {
+		fmt.Fprintf(&b, "%s{host=\"%s\"} %d\n", metricHostExitCode, escapeLabelValue(r.Host), r.ExitCode)
+	}
+
+	return b.Bytes()
+}
+
+func writeGauge(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+func escapeLabelValue(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+// writeMetricsTextfile writes the metrics atomically, so the textfile
+// collector never scrapes a partial file.
+func writeMetricsTextfile(path string, metrics []byte) error {
+	return runner.WriteFileAtomic(path, metrics, 0644)
+}
+
+// pushMetrics replaces the metrics of the job/instance group on a Pushgateway.
+func pushMetrics(client *http.Client, gateway, job, instance string, metrics []byte) error {
+	pushURL := strings.TrimSuffix(gateway, "/") + "/metrics/job/" + url.PathEscape(job)
+	if instance != "" {
+		pushURL += "/instance/" + url.PathEscape(instance)
+	}
+
+	req, err := http.NewRequest(http.MethodPut, pushURL, bytes.NewReader(metrics))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
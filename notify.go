@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	slackColorSuccess = "#2eb886"
+	slackColorFailure = "#e01e5a"
+)
+
+// SlackNotifier posts a run summary to a Slack incoming webhook. With
+// OnFailureOnly, nothing is posted for a run where every host succeeded.
+type SlackNotifier struct {
+	WebhookURL    string
+	OnFailureOnly bool
+	Client        *http.Client
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+type slackBlock struct {
+	Type   string      `json:"type"`
+	Text   *slackText  `json:"text,omitempty"`
+	Fields []slackText `json:"fields,omitempty"`
+}
+
+type slackAttachment struct {
+	Color  string       `json:"color"`
+	Blocks []slackBlock `json:"blocks"`
+}
+
+type slackMessage struct {
+	Text        string            `json:"text"`
+	Attachments []slackAttachment `json:"attachments"`
+}
+
+func (n *SlackNotifier) Notify(summary Summary) error {
+	if n.OnFailureOnly && summary.Failed == 0 {
+		return nil
+	}
+
+	status, color := "succeeded", slackColorSuccess
+	if summary.Failed > 0 {
+		status, color = "failed", slackColorFailure
+	}
+	title := fmt.Sprintf("server-manager run %s: %d of %d hosts failed", status, summary.Failed, summary.Total)
+
+	message := slackMessage{
+		Text: title,
+		Attachments: []slackAttachment{{
+			Color: color,
+			Blocks: []slackBlock{
+				{Type: "section", Text: &slackText{Type: "mrkdwn", Text: "*" + title + "*"}},
+				{Type: "section", Text: &slackText{Type: "mrkdwn", Text: fmt.Sprintf("*Command:*\n```%s```", summary.Command)}},
+				{Type: "section", Fields: []slackText{
+					{Type: "mrkdwn", Text: fmt.Sprintf("*Total hosts:*\n%d", summary.Total)},
+					{Type: "mrkdwn", Text: fmt.Sprintf("*Succeeded:*\n%d", summary.Succeeded)},
+					{Type: "mrkdwn", Text: fmt.Sprintf("*Failed:*\n%d", summary.Failed)},
+					{Type: "mrkdwn", Text: fmt.Sprintf("*Duration:*\n%s", summary.Duration.Round(time.Millisecond))},
+				}},
+			},
+		}},
+	}
+
+	return postJSON(n.Client, n.WebhookURL, message)
+}
+
+// postJSON posts v as JSON and treats any non-2xx response as an error.
+func postJSON(client *http.Client, url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return postBody(client, url, body)
+}
+
+// postBody posts body as JSON, with headers given as name, value pairs.
+func postBody(client *http.Client, url string, body []byte, headers ...string) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	return nil
+}
+
+// maxWebhookRedirects is how many redirects a webhook may answer with.
+const maxWebhookRedirects = 3
+
+// WebhookNotifier posts the run summary as JSON to an arbitrary URL. With a
+// Template, the payload is rendered through it instead, which allows shaping
+// it into e.g. a Slack or Mattermost message. With a Secret, the body is
+// signed in an X-Signature-256 header ("sha256=" and the hex HMAC-SHA256).
+type WebhookNotifier struct {
+	URL      string
+	Template *template.Template
+	Secret   string
+	Client   *http.Client
+}
+
+// newWebhookClient returns a client for WebhookNotifier that follows at most
+// maxWebhookRedirects redirects.
+func newWebhookClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxWebhookRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxWebhookRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+// WebhookPayload is the data posted by WebhookNotifier and the data the
+// notify template is executed with.
+type WebhookPayload struct {
+	Command         string   `json:"command"`
+	Total           int      `json:"total_hosts"`
+	Succeeded       int      `json:"succeeded"`
+	Failed          int      `json:"failed"`
+	Excluded        int      `json:"excluded"`
+	FailedHosts     []string `json:"failed_hosts"`
+	Duration        string   `json:"duration"`
+	DurationSeconds float64  `json:"duration_seconds"`
+	DurationMillis  int64    `json:"duration_ms"`
+	ExitStatus      int      `json:"exit_status"`
+}
+
+// ParseNotifyTemplate parses a notify template. The json function quotes a
+// value as JSON, e.g. {"text": {{json .Command}}}.
+func ParseNotifyTemplate(text string) (*template.Template, error) {
+	return template.New("notify").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(text)
+}
+
+func (n *WebhookNotifier) Notify(summary Summary, exitStatus int) error {
+	payload := WebhookPayload{
+		Command:         summary.Command,
+		Total:           summary.Total,
+		Succeeded:       summary.Succeeded,
+		Failed:          summary.Failed,
+		Excluded:        summary.Excluded,
+		FailedHosts:     summary.FailedHosts,
+		Duration:        summary.Duration.Round(time.Millisecond).String(),
+		DurationSeconds: summary.Duration.Seconds(),
+		DurationMillis:  summary.Duration.Milliseconds(),
+		ExitStatus:      exitStatus,
+	}
+	if payload.FailedHosts == nil {
+		payload.FailedHosts = []string{}
+	}
+
+	var body []byte
+	if n.Template == nil {
+		var err error
+		if body, err = json.Marshal(payload); err != nil {
+			return err
+		}
+	} else {
+		var buf bytes.Buffer
+		if err := n.Template.Execute(&buf, payload); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	if n.Secret == "" {
+		return postBody(n.Client, n.URL, body)
+	}
+
+	mac := hmac.New(sha256.New, []byte(n.Secret))
+	mac.Write(body)
+	return postBody(n.Client, n.URL, body, "X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+}
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDutyNotifier triggers a PagerDuty incident when the failure rate of a
+// run exceeds Threshold percent, and resolves it once the same command runs
+// cleanly on every host. The dedup key is derived from the command, so the
+// resolve matches the earlier trigger without keeping any state.
+type PagerDutyNotifier struct {
+	RoutingKey string
+	Threshold  float64
+	URL        string
+	Client     *http.Client
+}
+
+type pagerDutyPayload struct {
+	Summary       string                 `json:"summary"`
+	Source        string                 `json:"source"`
+	Severity      string                 `json:"severity"`
+	CustomDetails map[string]interface{} `json:"custom_details"`
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+func (n *PagerDutyNotifier) Notify(summary Summary) error {
+	event := pagerDutyEvent{
+		RoutingKey: n.RoutingKey,
+		DedupKey:   pagerDutyDedupKey(summary.Command),
+	}
+
+	switch {
+	case summary.Total > 0 && summary.Failed == 0:
+		event.EventAction = "resolve"
+	case summary.Total > 0 && float64(summary.Failed)*100/float64(summary.Total) > n.Threshold:
+		source, _ := os.Hostname()
+		event.EventAction = "trigger"
+		event.Payload = &pagerDutyPayload{
+			Summary:  fmt.Sprintf("server-manager: %d of %d hosts failed running %q", summary.Failed, summary.Total, summary.Command),
+			Source:   source,
+			Severity: "critical",
+			CustomDetails: map[string]interface{}{
+				"command":      summary.Command,
+				"total_hosts":  summary.Total,
+				"failed":       summary.Failed,
+				"failed_hosts": summary.FailedHosts,
+			},
+		}
+	default:
+		return nil
+	}
+
+	url := n.URL
+	if url == "" {
+		url = pagerDutyEventsURL
+	}
+
+	return postJSON(n.Client, url, event)
+}
+
+func pagerDutyDedupKey(command string) string {
+	sum := sha256.Sum256([]byte(command))
+	return "server-manager-" + hex.EncodeToString(sum[:8])
+}
+
+// parsePercent parses a threshold such as "50%" or "50".
+func parsePercent(s string) (float64, error) {
+	value, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(s), "%"), 64)
+	if err != nil || value < 0 || value > 100 {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// slackServer records the messages posted to it.
+func slackServer(t *testing.T) (*httptest.Server, *[]slackMessage) {
+	t.Helper()
+	var messages []slackMessage
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if got := r.Header.Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q", got)
+		}
+		var message slackMessage
+		if err := json.Unmarshal(body, &message); err != nil {
+			t.Errorf("invalid payload %s: %v", body, err)
+		}
+		messages = append(messages, message)
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv, &messages
+}
+
+func TestSlackNotifierPayload(t *testing.T) {
+	srv, messages := slackServer(t)
+	notifier := &SlackNotifier{WebhookURL: srv.URL}
+
+	failed := Summary{Command: "uptime", Total: 3, Succeeded: 2, Failed: 1, Duration: 1500 * time.Millisecond}
+	if err := notifier.Notify(failed); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifier.Notify(Summary{Command: "uptime", Total: 3, Succeeded: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*messages) != 2 {
+		t.Fatalf("got %d messages, want 2", len(*messages))
+	}
+
+	message := (*messages)[0]
+	if want := "server-manager run failed: 1 of 3 hosts failed"; message.Text != want {
+		t.Errorf("text = %q, want %q", message.Text, want)
+	}
+	if len(message.Attachments) != 1 {
+		t.Fatalf("got %d attachments, want 1", len(message.Attachments))
+	}
+	attachment := message.Attachments[0]
+	if attachment.Color != slackColorFailure {
+		t.Errorf("color = %s, want %s for a failed run", attachment.Color, slackColorFailure)
+	}
+	blocks := attachment.Blocks
+	if len(blocks) != 3 || blocks[0].Type != "section" || blocks[0].Text.Text != "*"+message.Text+"*" {
+		t.Fatalf("blocks = %+v", blocks)
+	}
+	if !strings.Contains(blocks[1].Text.Text, "```uptime```") {
+		t.Errorf("command block = %q", blocks[1].Text.Text)
+	}
+	var fields []string
+	for _, field := range blocks[2].Fields {
+		fields = append(fields, field.Text)
+	}
+	if got, want := strings.Join(fields, "|"), "*Total hosts:*\n3|*Succeeded:*\n2|*Failed:*\n1|*Duration:*\n1.5s"; got != want {
+		t.Errorf("fields = %q, want %q", got, want)
+	}
+
+	if got := (*messages)[1].Attachments[0].Color; got != slackColorSuccess {
+		t.Errorf("color = %s, want %s for a clean run", got, slackColorSuccess)
+	}
+}
+
+func TestSlackNotifierOnFailureOnly(t *testing.T) {
+	srv, messages := slackServer(t)
+	notifier := &SlackNotifier{WebhookURL: srv.URL, OnFailureOnly: true}
+
+	if err := notifier.Notify(Summary{Command: "uptime", Total: 2, Succeeded: 2}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*messages) != 0 {
+		t.Fatalf("posted %d messages for a clean run", len(*messages))
+	}
+	if err := notifier.Notify(Summary{Command: "uptime", Total: 2, Succeeded: 1, Failed: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if len(*messages) != 1 {
+		t.Errorf("posted %d messages for a failed run, want 1", len(*messages))
+	}
+}
+
+func TestSlackNotifierStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid_payload", http.StatusBadRequest)
+	}))
+	defer srv.Close()
+
+	err := (&SlackNotifier{WebhookURL: srv.URL}).Notify(Summary{Total: 1, Failed: 1})
+	if err == nil || !strings.Contains(err.Error(), "invalid_payload") {
+		t.Errorf("err = %v, want the response body", err)
+	}
+}
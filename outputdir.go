@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"server-manager/runner"
+)
+
+// defaultOutputDirName names --output-dir files after the host.
+const defaultOutputDirName = "{{.Host}}.log"
+
+// outputDirSink writes each host's output to a file under dir as it arrives,
+// replacing the file of an earlier run. The file name is the name template
+// rendered like the command, with the built-in and user variables; it may
+// place files in subdirectories of dir but not outside it.
+func outputDirSink(dir, name string, r *runner.Runner) func(runner.Target, int) (io.WriteCloser, error) {
+	return func(target runner.Target, i int) (io.WriteCloser, error) {
+		path, err := outputDirPath(dir, name, r, i)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return nil, err
+		}
+
+		return os.Create(path)
+	}
+}
+
+// outputDirPath renders the file name for the i-th target and joins it to
+// dir. The default name goes through hostFileName, so a host name can't
+// leave dir.
+func outputDirPath(dir, name string, r *runner.Runner, i int) (string, error) {
+	if name == defaultOutputDirName {
+		return filepath.Join(dir, hostFileName(r.Targets[i].Name)+".log"), nil
+	}
+
+	rendered, err := r.Render(i, name)
+	if err != nil {
+		return "", fmt.Errorf("failed to render output file name: %w", err)
+	}
+	rel := filepath.Clean(rendered)
+	if filepath.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("output file name %q is not inside the output directory", rendered)
+	}
+
+	return filepath.Join(dir, rel), nil
+}
+
+// hostFileName turns a host name into a file name, replacing the characters
+// that can't or shouldn't appear in one.
+func hostFileName(host string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', 0:
+			return '_'
+		}
+		return r
+	}, host)
+}
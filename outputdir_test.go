@@ -0,0 +1,46 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"server-manager/runner"
+)
+
+func TestOutputDirPath(t *testing.T) {
+	r := &runner.Runner{
+		Targets: []runner.Target{
+			{Name: "web1", Addr: "deploy@web1.example.com:2222", Groups: []string{"web", "prod"}},
+			{Name: "a/b", Addr: "root@10.0.0.2"},
+		},
+		Vars: map[string]string{"env": "prod"},
+	}
+	tests := []struct {
+		name string
+		i    int
+		want string
+	}{
+		{name: defaultOutputDirName, i: 0, want: "out/web1.log"},
+		{name: defaultOutputDirName, i: 1, want: "out/a_b.log"},
+		{name: "{{.Index}}-of-{{.Total}}-{{.User}}@{{.Address}}_{{.Port}}.out", i: 0, want: "out/1-of-2-deploy@web1.example.com_2222.out"},
+		{name: "{{index .Groups 0}}/{{.Host}}.log", i: 0, want: "out/web/web1.log"},
+		{name: "{{.env}}/{{.Index}}.log", i: 1, want: "out/prod/2.log"},
+		{name: "sub/../{{.Host}}.log", i: 0, want: "out/web1.log"},
+	}
+	for _, tt := range tests {
+		got, err := outputDirPath("out", tt.name, r, tt.i)
+		if err != nil {
+			t.Errorf("outputDirPath(%q, %d): %v", tt.name, tt.i, err)
+			continue
+		}
+		if got != filepath.FromSlash(tt.want) {
+			t.Errorf("outputDirPath(%q, %d) = %s, want %s", tt.name, tt.i, got, tt.want)
+		}
+	}
+
+	for _, name := range []string{"../{{.Host}}.log", "/tmp/{{.Host}}.log", "{{.Missing}}", "", "."} {
+		if got, err := outputDirPath("out", name, r, 0); err == nil {
+			t.Errorf("outputDirPath(%q) = %s, want an error", name, got)
+		}
+	}
+}
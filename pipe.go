@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+
+	"server-manager/runner"
+)
+
+// pipeExecutor passes each host's output through Command, a local shell
+// command started once per host, and returns what it prints instead. The
+// host's own outcome is kept; failures of the local command are logged
+// with the host's name.
+type pipeExecutor struct {
+	runner.Executor
+	Command string
+}
+
+// pipeWaitDelay is how long a cancelled pipe's output is waited for, as
+// children of the killed shell may keep it open.
+const pipeWaitDelay = time.Second
+
+func (e pipeExecutor) Execute(ctx context.Context, target runner.Target, command string) (string, error) {
+	output, err := e.Executor.Execute(ctx, target, command)
+
+	// Tied to the host's context, so a timeout or Ctrl+C stops a stuck pipe too
+	cmd := exec.CommandContext(ctx, "sh", "-c", e.Command)
+	cmd.WaitDelay = pipeWaitDelay
+	cmd.Stdin = strings.NewReader(output)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if pipeErr := cmd.Run(); pipeErr != nil {
+		slog.Error("Command pipe failed", "host", target.Name, "error", pipeErr, "stderr", strings.TrimSpace(stderr.String()))
+	}
+
+	return stdout.String(), err
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"server-manager/runner"
+)
+
+// fixedExecutor returns the same output and error for every host.
+type fixedExecutor struct {
+	output string
+	err    error
+}
+
+func (e fixedExecutor) Execute(ctx context.Context, target runner.Target, command string) (string, error) {
+	return e.output, e.err
+}
+
+func TestPipeExecutor(t *testing.T) {
+	failed := errors.New("Process exited with status 1")
+	e := pipeExecutor{Executor: fixedExecutor{output: "a\nERROR b\nERROR c\n", err: failed}, Command: "grep -c ERROR"}
+
+	output, err := e.Execute(context.Background(), runner.Target{Name: "web1"}, "cat log")
+	if output != "2\n" {
+		t.Errorf("output = %q, want the pipe's", output)
+	}
+	if err != failed {
+		t.Errorf("err = %v, want the host's own", err)
+	}
+}
+
+func TestPipeExecutorStopsWithContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	e := pipeExecutor{Executor: fixedExecutor{output: "x"}, Command: "sleep 10"}
+
+	start := time.Now()
+	e.Execute(ctx, runner.Target{Name: "web1"}, "true")
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("pipe ran for %s after its context ended", elapsed)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const progressBarWidth = 30
+
+// ProgressReporter keeps a single status line on the terminal, redrawn in
+// place with a carriage return as hosts start and finish: a bar, how many
+// hosts are done, running and failed, the elapsed time and an estimate of
+// the time left.
+type ProgressReporter struct {
+	mu          sync.Mutex
+	w           io.Writer
+	total       int
+	parallelism int
+	start       time.Time
+	running     int
+	done        int
+	failed      int
+	busy        time.Duration
+	drawn       bool
+	finished    bool
+	stop        chan struct{}
+}
+
+// NewProgressReporter draws on w for a run of total hosts, parallelism at a
+// time (used for the estimate).
+func NewProgressReporter(w io.Writer, total, parallelism int) *ProgressReporter {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	return &ProgressReporter{w: w, total: total, parallelism: parallelism}
+}
+
+// Start draws the initial, empty bar and starts the clock, which redraws
+// the line every second so the elapsed time keeps moving.
+func (p *ProgressReporter) Start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.start = time.Now()
+	p.stop = make(chan struct{})
+	p.redraw()
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mu.Lock()
+				p.redraw()
+				p.mu.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Started counts a host that began running.
+func (p *ProgressReporter) Started() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.running++
+	p.redraw()
+}
+
+// Update counts a finished host and redraws the bar.
+func (p *ProgressReporter) Update(r CommandResult) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.running > 0 {
+		p.running--
+	}
+	p.done++
+	p.busy += r.Duration
+	if r.Error != nil {
+		p.failed++
+	}
+	p.redraw()
+}
+
+// Finish draws the final state and leaves it on screen.
+func (p *ProgressReporter) Finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.finished {
+		return
+	}
+	if p.stop != nil {
+		close(p.stop)
+	}
+	p.redraw()
+	fmt.Fprintln(p.w)
+	p.drawn = false
+	p.finished = true
+}
+
+// Wrap returns a writer that moves the bar out of the way of anything written
+// through it, so regular output and the bar don't overwrite each other.
+func (p *ProgressReporter) Wrap(w io.Writer) io.Writer {
+	return progressWriter{p: p, w: w}
+}
+
+func (p *ProgressReporter) clear() {
+	if p.drawn {
+		// Return to the start of the line and erase it
+		fmt.Fprint(p.w, "\r\033[2K")
+		p.drawn = false
+	}
+}
+
+func (p *ProgressReporter) redraw() {
+	if p.finished {
+		return
+	}
+	p.clear()
+	elapsed := time.Since(p.start)
+	fmt.Fprintf(p.w, "%s %d/%d done, %d running, %d failed, %s elapsed%s",
+		p.bar(), p.done, p.total, p.running, p.failed, elapsed.Round(time.Second), p.eta())
+	p.drawn = true
+}
+
+// eta estimates the time left from the average time a host took, with the
+// remaining hosts running parallelism at a time.
+func (p *ProgressReporter) eta() string {
+	remaining := p.total - p.done
+	if p.done == 0 || remaining <= 0 {
+		return ""
+	}
+	slots := p.parallelism
+	if remaining < slots {
+		slots = remaining
+	}
+	average := p.busy / time.Duration(p.done)
+	batches := (remaining + slots - 1) / slots
+
+	return fmt.Sprintf(", ETA %s", (average * time.Duration(batches)).Round(time.Second))
+}
+
+func (p *ProgressReporter) bar() string {
+	filled := progressBarWidth
+	if p.total > 0 {
+		filled = p.done * progressBarWidth / p.total
+	}
+
+	switch {
+	case filled >= progressBarWidth:
+		return "[" + strings.Repeat("=", progressBarWidth) + "]"
+	case filled == 0:
+		return "[>" + strings.Repeat(" ", progressBarWidth-1) + "]"
+	default:
+		return "[" + strings.Repeat("=", filled-1) + ">" + strings.Repeat(" ", progressBarWidth-filled) + "]"
+	}
+}
+
+type progressWriter struct {
+	p *ProgressReporter
+	w io.Writer
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	pw.p.mu.Lock()
+	defer pw.p.mu.Unlock()
+
+	wasDrawn := pw.p.drawn
+	pw.p.clear()
+	n, err := pw.w.Write(b)
+	if wasDrawn {
+		pw.p.redraw()
+	}
+
+	return n, err
+}
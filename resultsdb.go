@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	// A pure Go SQLite, so the binary builds without cgo
+	_ "modernc.org/sqlite"
+)
+
+// resultsDBMigrations build the --results-db schema, one entry per version.
+// The database's user_version is how many of them have been applied, so new
+// versions are only ever appended.
+var resultsDBMigrations = []string{
+	// 1: runs and the results of their hosts
+	`CREATE TABLE runs (
+		id TEXT PRIMARY KEY,
+		started_at TEXT NOT NULL,
+		finished_at TEXT,
+		user TEXT NOT NULL,
+		command TEXT NOT NULL,
+		options TEXT NOT NULL,
+		total INTEGER,
+		succeeded INTEGER,
+		failed INTEGER,
+		exit_status INTEGER
+	);
+	CREATE TABLE results (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		run_id TEXT NOT NULL REFERENCES runs(id),
+		host TEXT NOT NULL,
+		status TEXT NOT NULL,
+		exit_code INTEGER NOT NULL,
+		error TEXT,
+		duration_ms INTEGER NOT NULL,
+		finished_at TEXT NOT NULL,
+		output TEXT NOT NULL,
+		output_bytes INTEGER NOT NULL,
+		output_truncated INTEGER NOT NULL
+	);
+	CREATE INDEX results_host ON results (host, finished_at);
+	CREATE INDEX results_run ON results (run_id);`,
+}
+
+// ResultsDB records runs and their results in a SQLite database. Each result
+// is written as it arrives, so an aborted run still leaves what it got; its
+// run then has no finished_at. Outputs longer than MaxOutput bytes (when
+// positive) are cut off and marked output_truncated.
+type ResultsDB struct {
+	RunID     string
+	MaxOutput int
+	db        *sql.DB
+}
+
+// OpenResultsDB opens the database at path, creating it and bringing its
+// schema up to date as needed.
+func OpenResultsDB(path string) (*ResultsDB, error) {
+	// Concurrent runs may share the database, wait for each other's writes
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if err := migrateResultsDB(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &ResultsDB{RunID: newRunID(), db: db}, nil
+}
+
+func migrateResultsDB(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	if version > len(resultsDBMigrations) {
+		return fmt.Errorf("schema version %d is newer than this version of server-manager supports (%d)", version, len(resultsDBMigrations))
+	}
+
+	for ; version < len(resultsDBMigrations); version++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(resultsDBMigrations[version]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating to schema version %d: %w", version+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", version+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Started records the run with the settings it runs with.
+func (d *ResultsDB) Started(command string, settings []setting) error {
+	options := make(map[string]string, len(settings))
+	for _, s := range settings {
+		options[s.Name] = s.Value
+	}
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+
+	_, err = d.db.Exec("INSERT INTO runs (id, started_at, user, command, options) VALUES (?, ?, ?, ?, ?)",
+		d.RunID, dbTime(time.Now()), currentUser(), command, string(encoded))
+	return err
+}
+
+// WriteResult records a host's result.
+func (d *ResultsDB) WriteResult(r CommandResult) error {
+	status, errText := "ok", sql.NullString{}
+	if r.Error != nil {
+		status, errText = "failed", sql.NullString{String: r.Error.Error(), Valid: true}
+	}
+	output, size, truncated := r.Output, int64(len(r.Output)), r.Truncated
+	if r.Truncated {
+		size = r.OutputBytes
+	}
+	if d.MaxOutput > 0 && len(output) > d.MaxOutput {
+		output, truncated = output[:d.MaxOutput], true
+	}
+
+	_, err := d.db.Exec(`INSERT INTO results (run_id, host, status, exit_code, error, duration_ms, finished_at, output, output_bytes, output_truncated)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.RunID, r.Host, status, r.ExitCode, errText, r.Duration.Milliseconds(), dbTime(time.Now()), output, size, truncated)
+	return err
+}
+
+// Finished records the run's totals and closes the database.
+func (d *ResultsDB) Finished(summary Summary, exitStatus int) error {
+	_, err := d.db.Exec("UPDATE runs SET finished_at = ?, total = ?, succeeded = ?, failed = ?, exit_status = ? WHERE id = ?",
+		dbTime(time.Now()), summary.Total, summary.Succeeded, summary.Failed, exitStatus, d.RunID)
+	if closeErr := d.db.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// OpenExistingResultsDB opens a database written by earlier runs, failing
+// rather than creating it when there is none.
+func OpenExistingResultsDB(path string) (*ResultsDB, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, fmt.Errorf("no results database at %s yet (runs are recorded with --results-db)", path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	return OpenResultsDB(path)
+}
+
+// Close closes the database.
+func (d *ResultsDB) Close() error {
+	return d.db.Close()
+}
+
+// HistoryRun is a recorded run as listed by --history. Finished is zero for
+// runs that never got to the end.
+type HistoryRun struct {
+	ID       string    `json:"id"`
+	Started  time.Time `json:"started_at"`
+	Finished time.Time `json:"finished_at"`
+	Command  string    `json:"command"`
+	Hosts    int       `json:"hosts"`
+	Failed   int       `json:"failed"`
+}
+
+// Runs returns the last n runs, most recent first. Host counts come from the
+// recorded results, so unfinished runs show what they got through.
+func (d *ResultsDB) Runs(n int) ([]HistoryRun, error) {
+	rows, err := d.db.Query(`SELECT runs.id, runs.started_at, COALESCE(runs.finished_at, ''), runs.command,
+			COUNT(results.id), COALESCE(SUM(results.status = 'failed'), 0)
+		FROM runs LEFT JOIN results ON results.run_id = runs.id
+		GROUP BY runs.id ORDER BY runs.started_at DESC LIMIT ?`, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var runs []HistoryRun
+	for rows.Next() {
+		var run HistoryRun
+		var started, finished string
+		if err := rows.Scan(&run.ID, &started, &finished, &run.Command, &run.Hosts, &run.Failed); err != nil {
+			return nil, err
+		}
+		run.Started, _ = time.Parse(time.RFC3339Nano, started)
+		if finished != "" {
+			run.Finished, _ = time.Parse(time.RFC3339Nano, finished)
+		}
+		runs = append(runs, run)
+	}
+
+	return runs, rows.Err()
+}
+
+// RunResults returns the recorded results of the run whose ID is, or starts
+// with, id, in the order they arrived.
+func (d *ResultsDB) RunResults(id string) (HistoryRun, []CommandResult, error) {
+	var matches []string
+	rows, err := d.db.Query("SELECT id FROM runs WHERE substr(id, 1, length(?)) = ?", id, id)
+	if err != nil {
+		return HistoryRun{}, nil, err
+	}
+	for rows.Next() {
+		var match string
+		if err := rows.Scan(&match); err != nil {
+			rows.Close()
+			return HistoryRun{}, nil, err
+		}
+		matches = append(matches, match)
+	}
+	rows.Close()
+	switch {
+	case len(matches) == 0:
+		return HistoryRun{}, nil, fmt.Errorf("no run %s in the results database", id)
+	case len(matches) > 1:
+		return HistoryRun{}, nil, fmt.Errorf("run ID %s is ambiguous (%s)", id, strings.Join(matches, ", "))
+	}
+
+	run := HistoryRun{ID: matches[0]}
+	var started, finished string
+	if err := d.db.QueryRow("SELECT started_at, COALESCE(finished_at, ''), command FROM runs WHERE id = ?", run.ID).Scan(&started, &finished, &run.Command); err != nil {
+		return HistoryRun{}, nil, err
+	}
+	run.Started, _ = time.Parse(time.RFC3339Nano, started)
+	if finished != "" {
+		run.Finished, _ = time.Parse(time.RFC3339Nano, finished)
+	}
+
+	rows, err = d.db.Query(`SELECT host, exit_code, error, duration_ms, output, output_bytes, output_truncated
+		FROM results WHERE run_id = ? ORDER BY id`, run.ID)
+	if err != nil {
+		return HistoryRun{}, nil, err
+	}
+	defer rows.Close()
+
+	var results []CommandResult
+	for rows.Next() {
+		var r CommandResult
+		var errText sql.NullString
+		var durationMillis int64
+		if err := rows.Scan(&r.Host, &r.ExitCode, &errText, &durationMillis, &r.Output, &r.OutputBytes, &r.Truncated); err != nil {
+			return HistoryRun{}, nil, err
+		}
+		if errText.Valid {
+			r.Error = errors.New(errText.String)
+			run.Failed++
+		}
+		if !r.Truncated {
+			r.OutputBytes = 0
+		}
+		r.Duration = time.Duration(durationMillis) * time.Millisecond
+		results = append(results, r)
+	}
+	run.Hosts = len(results)
+
+	return run, results, rows.Err()
+}
+
+// dbTime formats t with a fixed width, so times sort as text.
+func dbTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000Z")
+}
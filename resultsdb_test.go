@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResultsDBRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.db")
+	db, err := OpenResultsDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.MaxOutput = 4
+	if err := db.Started("uptime", []setting{{Name: "parallel-requests", Value: "5"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []CommandResult{
+		{Host: "web1", Output: "up", Duration: 1500 * time.Millisecond},
+		{Host: "web2", Output: "too long", Error: errors.New("Process exited with status 2"), ExitCode: 2},
+	} {
+		if err := db.WriteResult(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Finished(Summary{Total: 2, Succeeded: 1, Failed: 1}, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reopening runs the migrations again, which must leave the data alone
+	db, err = OpenExistingResultsDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	runs, err := db.Runs(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 1 || runs[0].Command != "uptime" || runs[0].Hosts != 2 || runs[0].Failed != 1 || runs[0].Finished.IsZero() {
+		t.Fatalf("runs = %+v", runs)
+	}
+
+	run, results, err := db.RunResults(runs[0].ID[:4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run.ID != runs[0].ID || len(results) != 2 {
+		t.Fatalf("run %+v with %d results", run, len(results))
+	}
+	if r := results[0]; r.Host != "web1" || r.Output != "up" || r.Error != nil || r.Duration != 1500*time.Millisecond || r.Truncated {
+		t.Errorf("web1 = %+v", r)
+	}
+	if r := results[1]; r.Host != "web2" || r.Output != "too " || !r.Truncated || r.OutputBytes != 8 || r.ExitCode != 2 || r.Error == nil {
+		t.Errorf("web2 = %+v", r)
+	}
+}
+
+func TestOpenExistingResultsDBMissing(t *testing.T) {
+	if _, err := OpenExistingResultsDB(filepath.Join(t.TempDir(), "none.db")); err == nil {
+		t.Error("opened a database that doesn't exist")
+	}
+}
@@ -0,0 +1,104 @@
+package runner
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Names of the algorithms golang.org/x/crypto/ssh implements on the client
+// side, including the legacy ones it only uses when asked to explicitly.
+var (
+	SupportedCiphers = []string{
+		"aes128-gcm@openssh.com", "aes256-gcm@openssh.com",
+		"chacha20-poly1305@openssh.com",
+		"aes128-ctr", "aes192-ctr", "aes256-ctr",
+		"aes128-cbc", "3des-cbc",
+		"arcfour256", "arcfour128", "arcfour",
+	}
+	SupportedKeyExchanges = []string{
+		"curve25519-sha256", "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256", "ecdh-sha2-nistp384", "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha256", "diffie-hellman-group14-sha1",
+		"diffie-hellman-group1-sha1",
+		"diffie-hellman-group-exchange-sha256", "diffie-hellman-group-exchange-sha1",
+	}
+	SupportedHostKeyAlgorithms = []string{
+		ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01,
+		ssh.CertAlgoDSAv01, ssh.CertAlgoECDSA256v01, ssh.CertAlgoECDSA384v01,
+		ssh.CertAlgoECDSA521v01, ssh.CertAlgoED25519v01,
+		ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA,
+		ssh.KeyAlgoDSA, ssh.KeyAlgoED25519,
+	}
+	SupportedMACs = []string{
+		"hmac-sha2-256-etm@openssh.com", "hmac-sha2-256",
+		"hmac-sha1", "hmac-sha1-96",
+	}
+)
+
+// Algorithms restricts what is negotiated during the handshake. Empty lists
+// keep the library defaults.
+type Algorithms struct {
+	Ciphers           []string `yaml:"ciphers"`
+	KeyExchanges      []string `yaml:"kex_algorithms"`
+	HostKeyAlgorithms []string `yaml:"host_key_algorithms"`
+	MACs              []string `yaml:"macs"`
+}
+
+// Validate reports algorithm names the library does not implement, so typos
+// fail locally instead of as a handshake error on every host.
+func (a Algorithms) Validate() error {
+	for _, check := range []struct {
+		kind      string
+		names     []string
+		supported []string
+	}{
+		{"cipher", a.Ciphers, SupportedCiphers},
+		{"key exchange", a.KeyExchanges, SupportedKeyExchanges},
+		{"host key algorithm", a.HostKeyAlgorithms, SupportedHostKeyAlgorithms},
+		{"MAC", a.MACs, SupportedMACs},
+	} {
+		for _, name := range check.names {
+			if !slices.Contains(check.supported, name) {
+				return fmt.Errorf("unsupported %s %q (supported: %s)", check.kind, name, strings.Join(check.supported, ", "))
+			}
+		}
+	}
+
+	return nil
+}
+
+// merge returns a with every non-empty list of override replacing its own.
+func (a Algorithms) merge(override Algorithms) Algorithms {
+	if len(override.Ciphers) > 0 {
+		a.Ciphers = override.Ciphers
+	}
+	if len(override.KeyExchanges) > 0 {
+		a.KeyExchanges = override.KeyExchanges
+	}
+	if len(override.HostKeyAlgorithms) > 0 {
+		a.HostKeyAlgorithms = override.HostKeyAlgorithms
+	}
+	if len(override.MACs) > 0 {
+		a.MACs = override.MACs
+	}
+
+	return a
+}
+
+// apply sets the lists on config; empty ones select the library defaults.
+func (a Algorithms) apply(config *ssh.ClientConfig) {
+	config.Ciphers = a.Ciphers
+	config.KeyExchanges = a.KeyExchanges
+	config.HostKeyAlgorithms = a.HostKeyAlgorithms
+	config.MACs = a.MACs
+}
+
+// String joins the lists, e.g. to tell connections with different
+// algorithms apart.
+func (a Algorithms) String() string {
+	return strings.Join(a.Ciphers, ",") + ";" + strings.Join(a.KeyExchanges, ",") + ";" + strings.Join(a.HostKeyAlgorithms, ",") + ";" + strings.Join(a.MACs, ",")
+}
@@ -0,0 +1,64 @@
+package runner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ExpandAliases resolves every alias in hosts to its underlying address,
+// following alias chains. Entries that aren't aliases are returned unchanged.
+func ExpandAliases(hosts []string, aliases map[string]string) ([]string, error) {
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addr, err := resolveAlias(host, aliases)
+		if err != nil {
+			return nil, err
+		}
+		addrs[i] = addr
+	}
+
+	return addrs, nil
+}
+
+// validateAliases rejects circular alias definitions, even unused ones.
+func validateAliases(aliases map[string]string) error {
+	names := make([]string, 0, len(aliases))
+	for name := range aliases {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := resolveAlias(name, aliases); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func resolveAlias(host string, aliases map[string]string) (string, error) {
+	// Keep a "user@" prefix and resolve only the host part
+	var user string
+	if i := strings.LastIndex(host, "@"); i >= 0 {
+		user, host = host[:i+1], host[i+1:]
+	}
+
+	chain := []string{host}
+	for {
+		target, ok := aliases[host]
+		if !ok {
+			return user + host, nil
+		}
+
+		for _, seen := range chain {
+			if seen == target {
+				return "", fmt.Errorf("circular alias reference: %s -> %s", strings.Join(chain, " -> "), target)
+			}
+		}
+
+		chain = append(chain, target)
+		host = target
+	}
+}
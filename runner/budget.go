@@ -0,0 +1,88 @@
+package runner
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// outputBudgetThreshold is the share of the budget after which no host
+// starts without asking.
+const outputBudgetThreshold = 0.9
+
+// ErrOutputBudget fails the hosts that were not started because the run's
+// output budget ran out.
+var ErrOutputBudget = errors.New("not started: output budget exhausted")
+
+// OutputBudget is a safeguard on the output received across all hosts of a
+// run, e.g. against an accidental cat of a huge file. Once Limit bytes are
+// nearly used up, new hosts wait while Continue decides whether another
+// Limit bytes may be received; with a nil Continue, or when it declines, no
+// more hosts start. A nil *OutputBudget has no limit.
+type OutputBudget struct {
+	Limit    int64
+	Continue func(used, limit int64) bool
+
+	used      atomic.Int64
+	mu        sync.Mutex
+	allowed   int64
+	exhausted bool
+}
+
+// NewOutputBudget allows limit bytes of output before asking cont.
+func NewOutputBudget(limit int64, cont func(used, limit int64) bool) *OutputBudget {
+	return &OutputBudget{Limit: limit, Continue: cont, allowed: limit}
+}
+
+// Add counts n bytes of output received.
+func (b *OutputBudget) Add(n int64) {
+	if b != nil {
+		b.used.Add(n)
+	}
+}
+
+// Used returns the output received so far.
+func (b *OutputBudget) Used() int64 {
+	if b == nil {
+		return 0
+	}
+
+	return b.used.Load()
+}
+
+// Allow reports whether another host may start.
+func (b *OutputBudget) Allow() bool {
+	if b == nil {
+		return true
+	}
+
+	// Hosts queue up here while Continue is asked, so only one question is
+	// ever open
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.exhausted {
+		return false
+	}
+	used := b.used.Load()
+	if float64(used) < float64(b.allowed)*outputBudgetThreshold {
+		return true
+	}
+	if b.Continue == nil || !b.Continue(used, b.allowed) {
+		b.exhausted = true
+		return false
+	}
+	b.allowed = used + b.Limit
+
+	return true
+}
+
+// Exhausted reports whether hosts were kept from starting.
+func (b *OutputBudget) Exhausted() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.exhausted
+}
@@ -0,0 +1,90 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// Connectivity check failure categories, in the order a connection gets
+// through them.
+const (
+	CheckProxy     = "proxy"
+	CheckDNS       = "dns"
+	CheckTCP       = "tcp"
+	CheckHandshake = "handshake"
+	CheckAuth      = "auth"
+	CheckSession   = "session"
+)
+
+// CheckError is a failed connectivity check and the stage it failed at.
+type CheckError struct {
+	Category string
+	Err      error
+}
+
+func (e *CheckError) Error() string {
+	return e.Category + ": " + e.Err.Error()
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// CheckExecutor checks that a host can be reached and logged into instead of
+// running the command: it dials, authenticates and opens a session exactly
+// like SSHExecutor, then closes it again. Failures are *CheckError.
+type CheckExecutor struct {
+	Options Options
+}
+
+func (e *CheckExecutor) Execute(ctx context.Context, target Target, command string) (string, error) {
+	opts := target.options(e.Options)
+	logger := opts.logger().With("host", target.Addr)
+
+	start := time.Now()
+	conn, ka, err := connect(ctx, target.Addr, opts, logger)
+	if err != nil {
+		return "", &CheckError{Category: checkCategory(err), Err: err}
+	}
+	defer conn.Close()
+	defer ka.Stop()
+	connected := time.Since(start)
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return "", &CheckError{Category: CheckSession, Err: err}
+	}
+	session.Close()
+
+	return fmt.Sprintf("OK (connect %s, session %s)\n", connected.Round(time.Millisecond), (time.Since(start) - connected).Round(time.Millisecond)), nil
+}
+
+// checkCategory tells at which stage connect failed.
+func checkCategory(err error) string {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, ErrProxyUnavailable), errors.Is(err, ErrProxyAuth):
+		return CheckProxy
+	case errors.Is(err, ErrProxyTarget):
+		return CheckTCP
+	case errors.As(err, &dnsErr):
+		return CheckDNS
+	case isAuthFailure(err),
+		strings.Contains(err.Error(), "keyboard-interactive"),
+		strings.Contains(err.Error(), "certificate"),
+		strings.Contains(err.Error(), "no private keys"):
+		return CheckAuth
+	case strings.Contains(err.Error(), "handshake failed"):
+		return CheckHandshake
+	case errors.As(err, &opErr) && opErr.Op == "dial",
+		errors.Is(err, context.DeadlineExceeded):
+		return CheckTCP
+	}
+
+	return CheckHandshake
+}
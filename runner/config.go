@@ -0,0 +1,212 @@
+package runner
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+type Config struct {
+	Hosts   []HostEntry       `yaml:"hosts"`
+	Aliases map[string]string `yaml:"aliases"`
+	// Defaults stand in for flags that aren't given.
+	Defaults Defaults `yaml:"defaults"`
+	// DefaultCommandTimeout applies to hosts without a command_timeout of
+	// their own.
+	DefaultCommandTimeout time.Duration `yaml:"default_command_timeout"`
+	// CanaryHost is the host --canary runs on first, instead of the first
+	// host.
+	CanaryHost string `yaml:"canary_host"`
+	// Commands are the presets --preset runs by name.
+	Commands map[string]Preset `yaml:"commands"`
+	// Facts replace or add to the probes gathered by --facts.
+	Facts []FactProbe `yaml:"facts"`
+	// Groups hold settings for the groups named in host entries.
+	Groups map[string]GroupSettings `yaml:"groups"`
+}
+
+// HostEntry is a single host from the config. In YAML it is either a plain
+// string or a mapping with the host, its template variables, the groups it
+// belongs to and the private key (and certificate) to use instead of the
+// global ones.
+type HostEntry struct {
+	Host string `yaml:"host"`
+	// Name, when set, is what the host is called in output, filters and
+	// --exclude, while Address and Port are what is dialed. ReadConfig
+	// moves the name into Host.
+	Name    string            `yaml:"name"`
+	Address string            `yaml:"address"`
+	Port    int               `yaml:"port"`
+	Vars    map[string]string `yaml:"vars"`
+	Groups  []string          `yaml:"groups"`
+	Key     string            `yaml:"key"`
+	Cert    string            `yaml:"cert"`
+	// Algorithms override the --ciphers, --kex-algorithms,
+	// --host-key-algorithms and --ssh-macs lists for this host.
+	Algorithms `yaml:",inline"`
+	// CommandTimeout, e.g. "90s", limits how long the command may run on
+	// this host.
+	CommandTimeout time.Duration `yaml:"command_timeout"`
+	// RemoteShell (sh, bash or none) overrides --remote-shell for hosts
+	// whose login shell doesn't take POSIX syntax.
+	RemoteShell string `yaml:"remote_shell"`
+	// Line is where the entry is in the config file or newline-separated
+	// host list, 0 for entries from anywhere else.
+	Line int `yaml:"-"`
+}
+
+func (h *HostEntry) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&h.Host); err == nil {
+		return nil
+	}
+
+	type plain HostEntry
+	return unmarshal((*plain)(h))
+}
+
+// ReadConfig loads a YAML config file.
+func ReadConfig(filename string) (*Config, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &Config{}
+	err = yaml.Unmarshal(data, config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateAliases(config.Aliases); err != nil {
+		return nil, err
+	}
+	if err := validateGroups(config.Groups); err != nil {
+		return nil, err
+	}
+	if err := nameHosts(config.Hosts); err != nil {
+		return nil, err
+	}
+	for i, line := range hostLines(data) {
+		if i < len(config.Hosts) {
+			config.Hosts[i].Line = line
+		}
+	}
+
+	// defaults.command_timeout is another spelling of default_command_timeout
+	if config.Defaults.CommandTimeout > 0 {
+		if config.DefaultCommandTimeout > 0 {
+			return nil, errors.New("set either default_command_timeout or defaults.command_timeout, not both")
+		}
+		config.DefaultCommandTimeout = config.Defaults.CommandTimeout
+	}
+
+	return config, nil
+}
+
+// hostLines returns the line of every entry of the hosts list in data, which
+// yaml.v2 doesn't keep track of. It is nil if the lines can't be told.
+func hostLines(data []byte) []int {
+	var doc struct {
+		Hosts []yamlv3.Node `yaml:"hosts"`
+	}
+	if err := yamlv3.Unmarshal(data, &doc); err != nil {
+		return nil
+	}
+
+	lines := make([]int, len(doc.Hosts))
+	for i, node := range doc.Hosts {
+		lines[i] = node.Line
+	}
+
+	return lines
+}
+
+// ParseHostList reads newline-separated hosts, ignoring blank lines and
+// # comments.
+func ParseHostList(r io.Reader) (*Config, error) {
+	config := &Config{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		config.Hosts = append(config.Hosts, HostEntry{Host: line, Line: n})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// nameHosts gives entries with a name: that name as their Host, keeping
+// what they dial in Address, and rejects a name: used by more than one
+// entry. Plainly repeated hosts are left to DedupeTargets.
+func nameHosts(entries []HostEntry) error {
+	seen := make(map[string]bool, len(entries))
+	for i := range entries {
+		entry := &entries[i]
+		if entry.Name != "" || entry.Address != "" {
+			if entry.Host != "" && entry.Address != "" {
+				return fmt.Errorf("host %s: set either host or address, not both", entry.Host)
+			}
+			if entry.Address == "" {
+				entry.Address = entry.Host
+			}
+			if entry.Address == "" {
+				return fmt.Errorf("host %s has no address", entry.Name)
+			}
+			entry.Host = entry.Name
+			if entry.Host == "" {
+				entry.Host = entry.Address
+			}
+		}
+		if !ValidRemoteShell(entry.RemoteShell) {
+			return fmt.Errorf("host %s: unknown remote_shell %q (expected sh, bash or none)", entry.Host, entry.RemoteShell)
+		}
+		if entry.Port < 0 || entry.Port > 65535 {
+			return fmt.Errorf("host %s: invalid port %d", entry.Host, entry.Port)
+		}
+		if entry.Name != "" {
+			if seen[entry.Name] {
+				return fmt.Errorf("duplicate host name %s", entry.Name)
+			}
+			seen[entry.Name] = true
+		}
+	}
+
+	return nil
+}
+
+// DialAddr returns what to connect to for the entry: its address, with its
+// port unless the address has one, or else the host itself.
+func (h HostEntry) DialAddr() string {
+	addr := h.Address
+	if addr == "" {
+		addr = h.Host
+	}
+
+	return ApplyAddrDefaults(addr, "", h.Port)
+}
+
+// HostNames returns the host of every entry, in order.
+func HostNames(entries []HostEntry) []string {
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Host
+	}
+
+	return names
+}
@@ -0,0 +1,34 @@
+package runner
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// writeConfig writes a config file for a test and returns its path.
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "hosts.yaml")
+	if err := ioutil.WriteFile(path, []byte(yaml), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReadConfigRepeatedHosts(t *testing.T) {
+	config, err := ReadConfig(writeConfig(t, "hosts:\n  - web1\n  - web2\n  - web1\n"))
+	if err != nil {
+		t.Fatalf("ReadConfig: %v", err)
+	}
+	if got := HostNames(config.Hosts); len(got) != 3 {
+		t.Errorf("hosts = %v, want the repeat kept for DedupeTargets", got)
+	}
+}
+
+func TestReadConfigDuplicateNames(t *testing.T) {
+	_, err := ReadConfig(writeConfig(t, "hosts:\n  - name: web\n    address: 10.0.0.1\n  - name: web\n    address: 10.0.0.2\n"))
+	if err == nil {
+		t.Error("ReadConfig accepted two hosts named web")
+	}
+}
@@ -0,0 +1,161 @@
+package runner
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultMaxSessions matches the MaxSessions default of OpenSSH's sshd.
+const DefaultMaxSessions = 10
+
+// ConnManager keeps one SSH connection per host and runs every command for
+// that host in its own session on it, instead of dialing per command. At
+// most MaxSessions commands run on a host at once; further ones wait, so the
+// server's MaxSessions limit is never hit.
+type ConnManager struct {
+	Options     Options
+	MaxSessions int
+
+	mu    sync.Mutex
+	conns map[string]*managedConn
+}
+
+type managedConn struct {
+	key      string
+	ready    chan struct{}
+	client   *ssh.Client
+	ka       *keepalive
+	err      error
+	sessions chan struct{}
+	dead     chan struct{}
+}
+
+func NewConnManager(opts Options, maxSessions int) *ConnManager {
+	if maxSessions < 1 {
+		maxSessions = DefaultMaxSessions
+	}
+
+	return &ConnManager{
+		Options:     opts,
+		MaxSessions: maxSessions,
+		conns:       make(map[string]*managedConn),
+	}
+}
+
+// Execute runs command on target over its shared connection, dialing it
+// first if needed (with the target's own keys, if it has any). A connection that broke is dropped, so the
+// next command for the host redials.
+func (m *ConnManager) Execute(ctx context.Context, target Target, command string) (string, error) {
+	addr := target.Addr
+	logger := m.Options.logger().With("host", addr)
+
+	opts := target.options(m.Options)
+	mc, err := m.get(ctx, connKey(addr, opts), addr, opts)
+	if err != nil {
+		return "", err
+	}
+
+	select {
+	case mc.sessions <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	output, err := runSession(ctx, mc.client, mc.ka, command, opts, logger)
+	<-mc.sessions
+
+	// The connection died under us: drop it so the next command redials
+	if err != nil && mc.closed() {
+		m.drop(mc)
+	}
+
+	return output, err
+}
+
+// Close closes all connections.
+func (m *ConnManager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, mc := range m.conns {
+		<-mc.ready
+		if mc.client != nil {
+			mc.ka.Stop()
+			mc.client.Close()
+		}
+		delete(m.conns, key)
+	}
+
+	return nil
+}
+
+func (m *ConnManager) get(ctx context.Context, key, addr string, opts Options) (*managedConn, error) {
+	m.mu.Lock()
+	mc, ok := m.conns[key]
+	if !ok {
+		mc = &managedConn{key: key, ready: make(chan struct{}), sessions: make(chan struct{}, m.MaxSessions)}
+		m.conns[key] = mc
+	}
+	m.mu.Unlock()
+
+	if !ok {
+		mc.client, mc.ka, mc.err = connect(ctx, addr, opts, opts.logger().With("host", addr))
+		if mc.err == nil {
+			mc.dead = make(chan struct{})
+			go func() {
+				mc.client.Wait()
+				close(mc.dead)
+			}()
+		}
+		close(mc.ready)
+		if mc.err != nil {
+			// Let the next command try again rather than caching the failure
+			m.drop(mc)
+		}
+		return mc, mc.err
+	}
+
+	select {
+	case <-mc.ready:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return mc, mc.err
+}
+
+func (m *ConnManager) drop(mc *managedConn) {
+	m.mu.Lock()
+	if m.conns[mc.key] == mc {
+		delete(m.conns, mc.key)
+	}
+	m.mu.Unlock()
+
+	if mc.client != nil {
+		mc.ka.Stop()
+		mc.client.Close()
+	}
+}
+
+// closed reports whether the connection has shut down.
+func (mc *managedConn) closed() bool {
+	select {
+	case <-mc.dead:
+		return true
+	default:
+		return false
+	}
+}
+
+// connKey identifies a connection by address, algorithms and the keys it
+// authenticates with, so hosts with their own keys never reuse another login.
+func connKey(addr string, opts Options) string {
+	parts := []string{addr, opts.Algorithms.String(), opts.KeyPath}
+	for _, key := range opts.Keys {
+		parts = append(parts, key.Path)
+	}
+
+	return strings.Join(parts, "\x00")
+}
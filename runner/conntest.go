@@ -0,0 +1,84 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Connect test failures, so a host that is down can be told apart from a
+// command that failed.
+var (
+	ErrConnectionRefused = errors.New("connection refused")
+	ErrHostUnreachable   = errors.New("host unreachable")
+)
+
+// connectTest opens and closes a bare TCP connection to addr within timeout,
+// before any SSH is attempted.
+func connectTest(ctx context.Context, addr string, timeout time.Duration, opts Options) error {
+	var conn net.Conn
+	var err error
+	if opts.Proxy != nil {
+		conn, err = dialProxy(ctx, opts.Proxy, addr, timeout)
+	} else {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		conn, err = dialTCP(ctx, addr, timeout, opts.PreferFamily)
+	}
+	if err != nil {
+		return connectTestError(err)
+	}
+
+	return conn.Close()
+}
+
+func connectTestError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, ErrProxyUnavailable), errors.Is(err, ErrProxyAuth):
+		return err
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return fmt.Errorf("%w: %w", ErrConnectionRefused, err)
+	}
+
+	return fmt.Errorf("%w: %w", ErrHostUnreachable, err)
+}
+
+// ErrTCPUnreachable marks targets that failed a Preflight probe.
+var ErrTCPUnreachable = errors.New("tcp unreachable")
+
+// Preflight probes every target's port with a bare TCP connect, parallel at
+// a time, each within timeout, and returns the errors of the targets that
+// didn't answer by index. Probes are cheap, so parallel can be far higher
+// than for SSH.
+func Preflight(ctx context.Context, targets []Target, parallel int, timeout time.Duration, opts Options) map[int]error {
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	var mu sync.Mutex
+	failed := make(map[int]error)
+	slots := make(chan struct{}, parallel)
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target Target) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			_, host := splitUserHost(target.Addr)
+			if err := connectTest(ctx, buildDialAddr(host, DefaultPort), timeout, target.options(opts)); err != nil {
+				mu.Lock()
+				failed[i] = fmt.Errorf("%w: %w", ErrTCPUnreachable, err)
+				mu.Unlock()
+			}
+		}(i, target)
+	}
+	wg.Wait()
+
+	return failed
+}
@@ -0,0 +1,186 @@
+package runner
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Copy outcomes reported in CopyReport.Status.
+const (
+	CopyUploaded     = "uploaded"
+	CopySkipped      = "skipped (identical)"
+	CopyVerifyFailed = "verify failed"
+)
+
+// ErrCopyVerifyFailed is returned when the uploaded file's checksum doesn't
+// match the local one.
+var ErrCopyVerifyFailed = errors.New("checksum of uploaded file doesn't match")
+
+// CopyReport is what CopyExecutor returns as a host's output, JSON encoded.
+type CopyReport struct {
+	Status string `json:"status"`
+	// Bytes is how much was sent, 0 when the upload was skipped.
+	Bytes           int64   `json:"bytes"`
+	TransferSeconds float64 `json:"transfer_seconds"`
+}
+
+// CopyExecutor uploads Source to Dest on every host, ignoring the command.
+// The file is written next to Dest and renamed into place. With Verify, the
+// upload is skipped where Dest already has SHA256 as its checksum, and the
+// checksum is checked again afterwards.
+type CopyExecutor struct {
+	Options Options
+	Source  string
+	Dest    string
+	// SHA256 is the hex checksum of Source, see FileSHA256.
+	SHA256 string
+	Verify bool
+}
+
+// FileSHA256 returns the hex SHA-256 checksum of the file at path.
+func FileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (e *CopyExecutor) Execute(ctx context.Context, target Target, command string) (string, error) {
+	opts := target.options(e.Options)
+	opts.Stdin, opts.Output, opts.PTY, opts.ExecMode = nil, nil, false, ExecShell
+	logger := opts.logger().With("host", target.Addr)
+
+	conn, ka, err := connect(ctx, target.Addr, opts, logger)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	defer ka.Stop()
+
+	report := CopyReport{Status: CopyUploaded}
+	if e.Verify {
+		sum, err := e.remoteSHA256(ctx, conn, ka, opts, logger)
+		if err != nil {
+			return "", err
+		}
+		if sum == e.SHA256 {
+			logger.Debug("Destination is identical, skipping upload", "dest", e.Dest)
+			report.Status = CopySkipped
+			return report.encode()
+		}
+	}
+
+	start := time.Now()
+	report.Bytes, err = e.upload(ctx, conn, opts)
+	report.TransferSeconds = time.Since(start).Seconds()
+	if err != nil {
+		return "", err
+	}
+	logger.Debug("Uploaded", "dest", e.Dest, "bytes", report.Bytes, "duration", time.Since(start))
+
+	if e.Verify {
+		sum, err := e.remoteSHA256(ctx, conn, ka, opts, logger)
+		if err != nil {
+			return "", err
+		}
+		if sum != e.SHA256 {
+			report.Status = CopyVerifyFailed
+			output, _ := report.encode()
+			return output, fmt.Errorf("%w (local %s, remote %s)", ErrCopyVerifyFailed, e.SHA256, sum)
+		}
+	}
+
+	return report.encode()
+}
+
+// remoteSHA256 returns the checksum of Dest on the host, or "" when there is
+// no such file.
+func (e *CopyExecutor) remoteSHA256(ctx context.Context, conn *ssh.Client, ka *keepalive, opts Options, logger *slog.Logger) (string, error) {
+	dest := ShellQuote(e.Dest)
+	command := fmt.Sprintf("if [ -f %s ]; then sha256sum -- %s 2>/dev/null || shasum -a 256 -- %s; fi", dest, dest, dest)
+	output, err := runSession(ctx, conn, ka, command, opts, logger)
+	if _, err = untruncated(err); err != nil {
+		return "", fmt.Errorf("failed to checksum %s: %w", e.Dest, err)
+	}
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	return strings.ToLower(fields[0]), nil
+}
+
+// upload streams Source into a temporary file next to Dest and renames it
+// into place, returning how many bytes were sent.
+func (e *CopyExecutor) upload(ctx context.Context, conn *ssh.Client, opts Options) (int64, error) {
+	f, err := os.Open(e.Source)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-done:
+		}
+	}()
+
+	counted := &countingReader{r: f}
+	session.Stdin = counted
+	stderr := &limitedBuffer{limit: 4 << 10}
+	session.Stderr = stderr
+	dest := ShellQuote(e.Dest)
+	command := fmt.Sprintf(`tmp=%s.tmp.$$; cat > "$tmp" && mv -f "$tmp" %s || { rm -f "$tmp"; exit 1; }`, dest, dest)
+	if err := session.Run(wrapCommand(command, opts.RemoteShell, false)); err != nil {
+		if msg := strings.TrimSpace(string(stderr.bytes())); msg != "" {
+			err = fmt.Errorf("%w: %s", err, msg)
+		}
+		return counted.n, fmt.Errorf("failed to upload to %s: %w", e.Dest, err)
+	}
+
+	return counted.n, nil
+}
+
+func (r CopyReport) encode() (string, error) {
+	data, err := json.Marshal(r)
+	return string(data), err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,87 @@
+package runner
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Defaults is the config file's defaults section: settings used when the
+// corresponding flag isn't given. Host entries still override User and
+// Port with their own user@ and :port.
+type Defaults struct {
+	User             string        `yaml:"user"`
+	Key              string        `yaml:"key"`
+	Port             int           `yaml:"port"`
+	ParallelRequests int           `yaml:"parallel_requests"`
+	SSHTimeout       time.Duration `yaml:"ssh_timeout"`
+	CommandTimeout   time.Duration `yaml:"command_timeout"`
+	Output           string        `yaml:"output"`
+	KnownHosts       string        `yaml:"known_hosts"`
+}
+
+// defaultsKeys are the keys the defaults section accepts.
+var defaultsKeys = []string{"user", "key", "port", "parallel_requests", "ssh_timeout", "command_timeout", "output", "known_hosts"}
+
+// UnmarshalYAML rejects unknown keys, so a typo doesn't silently leave a
+// setting at its built-in value.
+func (d *Defaults) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return fmt.Errorf("defaults must be a mapping: %w", err)
+	}
+	var unknown []string
+	for key := range raw {
+		if !slices.Contains(defaultsKeys, key) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown keys in defaults: %s (expected %s)", strings.Join(unknown, ", "), strings.Join(defaultsKeys, ", "))
+	}
+
+	type plain Defaults
+	if err := unmarshal((*plain)(d)); err != nil {
+		return fmt.Errorf("invalid defaults: %w", err)
+	}
+
+	return d.validate()
+}
+
+func (d *Defaults) validate() error {
+	switch {
+	case d.Port < 0 || d.Port > 65535:
+		return fmt.Errorf("defaults: port %d out of range", d.Port)
+	case d.ParallelRequests < 0:
+		return fmt.Errorf("defaults: parallel_requests must not be negative")
+	case d.SSHTimeout < 0 || d.CommandTimeout < 0:
+		return fmt.Errorf("defaults: timeouts must not be negative")
+	case strings.Contains(d.User, "@"):
+		return fmt.Errorf("defaults: invalid user %q", d.User)
+	}
+
+	return nil
+}
+
+// ApplyAddrDefaults adds user and port to a [user@]host[:port] entry that
+// doesn't have its own. An empty user or a zero port leaves that part alone.
+func ApplyAddrDefaults(addr, user string, port int) string {
+	prefix := ""
+	host := addr
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		prefix, host = addr[:i+1], addr[i+1:]
+	} else if user != "" {
+		prefix = user + "@"
+	}
+	if port > 0 {
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			host = buildDialAddr(host, port)
+		}
+	}
+
+	return prefix + host
+}
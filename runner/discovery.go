@@ -0,0 +1,137 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// HostDiscovery builds the host list from an inventory service instead of
+// a hosts file.
+type HostDiscovery interface {
+	Discover(ctx context.Context) ([]HostEntry, error)
+}
+
+// DefaultConsulAddr is queried when neither --consul-addr nor
+// $CONSUL_HTTP_ADDR is set.
+const DefaultConsulAddr = "http://127.0.0.1:8500"
+
+// ConsulDiscovery lists the healthy instances of a service from the Consul
+// catalog (/v1/health/service/<name>?passing). Each instance contributes
+// its service address, or its node's address if the service has none. The
+// node, service ID, datacenter and service port are available to the
+// command template as {{.consul_node}}, {{.consul_service_id}},
+// {{.consul_datacenter}} and {{.consul_service_port}}.
+type ConsulDiscovery struct {
+	Addr    string
+	Token   string
+	Service string
+	// Tag, when set, only keeps instances with this tag.
+	Tag string
+	// UseServicePort dials the service's registered port instead of the
+	// SSH default, for services that are sshd themselves.
+	UseServicePort bool
+	Client         *http.Client
+}
+
+type consulServiceEntry struct {
+	Node struct {
+		Node       string `json:"Node"`
+		Address    string `json:"Address"`
+		Datacenter string `json:"Datacenter"`
+	} `json:"Node"`
+	Service struct {
+		ID      string `json:"ID"`
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+func (d *ConsulDiscovery) Discover(ctx context.Context) ([]HostEntry, error) {
+	addr := d.Addr
+	if addr == "" {
+		addr = DefaultConsulAddr
+	}
+	// CONSUL_HTTP_ADDR is often given without a scheme
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Consul address: %w", err)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/v1/health/service/" + url.PathEscape(d.Service)
+	u.RawQuery = "passing"
+	if d.Tag != "" {
+		u.RawQuery += "&tag=" + url.QueryEscape(d.Tag)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if d.Token != "" {
+		req.Header.Set("X-Consul-Token", d.Token)
+	}
+
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Consul returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var entries []consulServiceEntry
+	if err := json.Unmarshal(body, &entries); err != nil {
+		return nil, fmt.Errorf("invalid Consul response: %w", err)
+	}
+
+	var hosts []HostEntry
+	for _, entry := range entries {
+		address := entry.Service.Address
+		if address == "" {
+			address = entry.Node.Address
+		}
+		if address == "" {
+			return nil, fmt.Errorf("instance %s on node %s has no address", entry.Service.ID, entry.Node.Node)
+		}
+
+		host := address
+		if d.UseServicePort && entry.Service.Port > 0 {
+			host = net.JoinHostPort(strings.Trim(address, "[]"), strconv.Itoa(entry.Service.Port))
+		}
+		hosts = append(hosts, HostEntry{
+			Host: host,
+			Vars: map[string]string{
+				"consul_node":         entry.Node.Node,
+				"consul_service_id":   entry.Service.ID,
+				"consul_datacenter":   entry.Node.Datacenter,
+				"consul_service_port": strconv.Itoa(entry.Service.Port),
+			},
+		})
+	}
+	if len(hosts) == 0 {
+		if d.Tag != "" {
+			return nil, fmt.Errorf("no healthy instances of service %q with tag %q", d.Service, d.Tag)
+		}
+		return nil, fmt.Errorf("no healthy instances of service %q", d.Service)
+	}
+
+	return hosts, nil
+}
@@ -0,0 +1,37 @@
+package runner
+
+import "strings"
+
+// Endpoint returns the account a target connects to as user@host:port, with
+// the default user and port filled in, so targets reaching the same account
+// on the same host compare equal.
+func (t Target) Endpoint() string {
+	user, host := splitUserHost(t.Addr)
+	return user + "@" + strings.ToLower(buildDialAddr(host, DefaultPort))
+}
+
+// Duplicate is a target DedupeTargets dropped because an earlier one, at
+// Of, has the same Endpoint. Both are positions in the targets given.
+type Duplicate struct {
+	Index int
+	Of    int
+}
+
+// DedupeTargets returns the targets whose Endpoint no earlier target has, in
+// order, along with the dropped ones.
+func DedupeTargets(targets []Target) ([]Target, []Duplicate) {
+	first := make(map[string]int, len(targets))
+	kept := make([]Target, 0, len(targets))
+	var dropped []Duplicate
+	for i, target := range targets {
+		endpoint := target.Endpoint()
+		if j, ok := first[endpoint]; ok {
+			dropped = append(dropped, Duplicate{Index: i, Of: j})
+			continue
+		}
+		first[endpoint] = i
+		kept = append(kept, target)
+	}
+
+	return kept, dropped
+}
@@ -0,0 +1,40 @@
+package runner
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var envNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// EnvVar is an environment variable passed to the remote session.
+type EnvVar struct {
+	Name  string
+	Value string
+}
+
+// ValidateEnvName rejects names a shell can't export, which would otherwise
+// be pasted unquoted into the exports of EnvExportFallback.
+func ValidateEnvName(name string) error {
+	if !envNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid environment variable name %q (letters, digits and _ only, not starting with a digit)", name)
+	}
+
+	return nil
+}
+
+// exportPrefix builds shell export statements for variables sshd refused to set.
+func exportPrefix(vars []EnvVar) string {
+	var b strings.Builder
+	for _, v := range vars {
+		fmt.Fprintf(&b, "export %s=%s; ", v.Name, ShellQuote(v.Value))
+	}
+
+	return b.String()
+}
+
+// ShellQuote wraps s in single quotes so a POSIX shell passes it through literally.
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
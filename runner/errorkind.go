@@ -0,0 +1,77 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrorKind says at a glance why a host failed. The values are stable, as
+// they appear in JSON output.
+type ErrorKind string
+
+const (
+	ErrorKindDNS               ErrorKind = "dns"
+	ErrorKindConnectionRefused ErrorKind = "connection_refused"
+	ErrorKindUnreachable       ErrorKind = "unreachable"
+	ErrorKindTimeout           ErrorKind = "timeout"
+	ErrorKindHostKeyMismatch   ErrorKind = "host_key_mismatch"
+	ErrorKindAuthFailed        ErrorKind = "auth_failed"
+	ErrorKindSessionFailed     ErrorKind = "session_failed"
+	ErrorKindCommandFailed     ErrorKind = "command_failed"
+	ErrorKindCanceled          ErrorKind = "canceled"
+	ErrorKindOther             ErrorKind = "other"
+)
+
+// ClassifyError returns the kind of a host's error, or "" for nil. The SSH
+// handshake only passes its errors on as text, so those are told apart by
+// their messages.
+func ClassifyError(err error) ErrorKind {
+	if err == nil {
+		return ""
+	}
+
+	var exitErr *ssh.ExitError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var allKeys *AuthFailedAllKeys
+	var certErr *CertValidityError
+	msg := err.Error()
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrorKindCanceled
+	case errors.As(err, &exitErr), errors.Is(err, ErrOutputTruncated):
+		return ErrorKindCommandFailed
+	case errors.As(err, &allKeys), errors.As(err, &certErr):
+		return ErrorKindAuthFailed
+	case errors.As(err, &dnsErr):
+		return ErrorKindDNS
+	case errors.Is(err, ErrConnectionRefused), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ECONNRESET),
+		strings.Contains(msg, "connection reset by peer"):
+		return ErrorKindConnectionRefused
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, ErrConnectionLost),
+		errors.As(err, &netErr) && netErr.Timeout(), strings.Contains(msg, "i/o timeout"):
+		return ErrorKindTimeout
+	case errors.Is(err, ErrHostUnreachable), errors.Is(err, ErrProxyTarget), errors.Is(err, ErrProxyUnavailable),
+		errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return ErrorKindUnreachable
+	case strings.Contains(msg, "no common algorithm"):
+		return ErrorKindOther
+	// Host certificate failures come from ssh.CertChecker, as "ssh: cert..."
+	case strings.Contains(msg, "knownhosts: "), strings.Contains(msg, "host key"),
+		strings.Contains(msg, "ssh: cert"), strings.Contains(msg, "ssh: principal"), strings.Contains(msg, "no authorities for hostname"):
+		return ErrorKindHostKeyMismatch
+	case isAuthFailure(err), strings.Contains(msg, "no SSH keys or other authentication"),
+		errors.Is(err, ErrProxyAuth):
+		return ErrorKindAuthFailed
+	case errors.Is(err, ErrPTYDenied), strings.Contains(msg, "environment variable"),
+		strings.Contains(msg, "ssh: rejected"), strings.Contains(msg, "without exit status"):
+		return ErrorKindSessionFailed
+	}
+
+	return ErrorKindOther
+}
@@ -0,0 +1,59 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestClassifyError(t *testing.T) {
+	expired := &CertValidityError{Path: "/home/me/.ssh/id_ed25519-cert.pub", State: "expired", ValidBefore: 1}
+	tests := []struct {
+		name string
+		err  error
+		want ErrorKind
+	}{
+		{name: "nil", err: nil, want: ""},
+		{name: "canceled", err: fmt.Errorf("run: %w", context.Canceled), want: ErrorKindCanceled},
+		{name: "deadline", err: context.DeadlineExceeded, want: ErrorKindTimeout},
+		{name: "exit status", err: &ssh.ExitError{}, want: ErrorKindCommandFailed},
+		{name: "expired client certificate", err: expired, want: ErrorKindAuthFailed},
+		{name: "wrapped client certificate", err: fmt.Errorf("failed to connect: %w", expired), want: ErrorKindAuthFailed},
+		{name: "not yet valid client certificate", err: &CertValidityError{Path: "c.pub", State: "not yet valid"}, want: ErrorKindAuthFailed},
+		{name: "host certificate expired", err: errors.New("ssh: handshake failed: ssh: cert has expired"), want: ErrorKindHostKeyMismatch},
+		{name: "host certificate from unknown CA", err: errors.New("ssh: handshake failed: ssh: no authorities for hostname: web1:22"), want: ErrorKindHostKeyMismatch},
+		{name: "host certificate principal", err: errors.New(`ssh: handshake failed: ssh: principal "web1" not in the set of valid principals for given certificate: ["web2"]`), want: ErrorKindHostKeyMismatch},
+		{name: "host certificate revoked", err: errors.New("ssh: handshake failed: ssh: certificate serial 7 revoked"), want: ErrorKindHostKeyMismatch},
+		{name: "plain host key", err: errors.New("ssh: handshake failed: ssh: non-certificate host key"), want: ErrorKindHostKeyMismatch},
+		{name: "known_hosts mismatch", err: errors.New("ssh: handshake failed: knownhosts: key mismatch"), want: ErrorKindHostKeyMismatch},
+		{name: "unable to authenticate", err: errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey], no supported methods remain"), want: ErrorKindAuthFailed},
+		{name: "bad certificate file", err: errors.New("failed to parse certificate id-cert.pub: ssh: short read"), want: ErrorKindOther},
+		{name: "no common algorithm", err: errors.New("ssh: handshake failed: ssh: no common algorithm for host key"), want: ErrorKindOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyError(tt.err); got != tt.want {
+				t.Errorf("ClassifyError(%v) = %q, want %q", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidKeysExpiredCertificate(t *testing.T) {
+	now := time.Now()
+	cert := &ssh.Certificate{ValidAfter: uint64(now.Add(-2 * time.Hour).Unix()), ValidBefore: uint64(now.Add(-time.Hour).Unix())}
+	_, err := validKeys([]Key{{Path: "id", CertPath: "id-cert.pub", Cert: cert}}, now)
+
+	var certErr *CertValidityError
+	if !errors.As(err, &certErr) || certErr.State != "expired" {
+		t.Fatalf("err = %v, want an expired *CertValidityError", err)
+	}
+	if kind := ClassifyError(err); kind != ErrorKindAuthFailed {
+		t.Errorf("kind = %s, want %s", kind, ErrorKindAuthFailed)
+	}
+}
@@ -0,0 +1,150 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Exec modes for Options.ExecMode.
+const (
+	// ExecShell hands the command to the remote shell as is, so pipes,
+	// globs and $VARS work.
+	ExecShell = "shell"
+	// ExecExec runs the command's words as a plain argument list. sshd
+	// always starts commands through the user's shell, so every word is
+	// quoted to reach the program literally, without expansion.
+	ExecExec = "exec"
+)
+
+// Remote shells for Options.RemoteShell.
+const (
+	// RemoteShellNone leaves the command to the login shell, as sent.
+	RemoteShellNone = "none"
+	RemoteShellSh   = "sh"
+	RemoteShellBash = "bash"
+)
+
+// ValidRemoteShell reports whether shell is a remote shell setting; empty
+// means RemoteShellNone.
+func ValidRemoteShell(shell string) bool {
+	switch shell {
+	case "", RemoteShellNone, RemoteShellSh, RemoteShellBash:
+		return true
+	}
+
+	return false
+}
+
+// wrapCommand makes command run in shell rather than whatever the login
+// shell is (fish and csh don't take POSIX syntax), and as root with sudo:
+// sudo outside, the shell inside. sudo needs a shell to run a command line,
+// so it brings sh when no shell is chosen.
+func wrapCommand(command, shell string, sudo bool) string {
+	if shell == RemoteShellNone {
+		shell = ""
+	}
+	switch {
+	case sudo && shell == "":
+		return "sudo -n sh -c " + ShellQuote(command)
+	case sudo:
+		return "sudo -n " + shell + " -c " + ShellQuote(command)
+	case shell != "":
+		return "exec " + shell + " -c " + ShellQuote(command)
+	}
+
+	return command
+}
+
+// execCommand prepares command for the exec mode.
+func execCommand(command, mode string) (string, error) {
+	switch mode {
+	case "", ExecShell:
+		return command, nil
+	case ExecExec:
+	default:
+		return "", fmt.Errorf("unknown exec mode %q (expected %s or %s)", mode, ExecShell, ExecExec)
+	}
+
+	args, err := splitArgs(command)
+	if err != nil {
+		return "", err
+	}
+	if len(args) == 0 {
+		return "", errors.New("empty command")
+	}
+
+	return QuoteArgs(args), nil
+}
+
+// QuoteArgs joins args into a command line that any POSIX shell splits back
+// into exactly args, with nothing expanded.
+func QuoteArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = ShellQuote(arg)
+	}
+
+	return strings.Join(quoted, " ")
+}
+
+// splitArgs splits cmd into words the way a POSIX shell would without
+// expanding anything: whitespace separates words, single quotes keep
+// everything literal, double quotes keep everything but \" \\ \$ and \`,
+// and a backslash outside quotes escapes the next character.
+func splitArgs(cmd string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+
+	runes := []rune(cmd)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch {
+			case r == '"':
+				quote = 0
+			case r == '\\' && i+1 < len(runes) && strings.ContainsRune("\"\\$`", runes[i+1]):
+				i++
+				word.WriteRune(runes[i])
+			default:
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inWord = true
+		case r == '\\':
+			if i+1 == len(runes) {
+				return nil, errors.New("command ends with a backslash")
+			}
+			i++
+			word.WriteRune(runes[i])
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote in command", quote)
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+
+	return args, nil
+}
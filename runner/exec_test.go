@@ -0,0 +1,124 @@
+package runner
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// quotingCases are argument lists that must reach the remote program exactly.
+var quotingCases = [][]string{
+	{"echo", "hello"},
+	{"echo", "two words", "  leading and trailing  "},
+	{"echo", "it's", "'", "''", "a'b'c"},
+	{"echo", `say "hi"`, `"`, `\"`},
+	{"echo", "$(rm -rf /)", "`id`", "$HOME", "${PATH}", "$((1+1))"},
+	{"echo", "line one\nline two", "\n", "tab\there"},
+	{"echo", "a;b", "a&&b", "a|b", "a>b", "<a", "*", "?", "[a]", "~", "#comment", "!"},
+	{"echo", `back\slash`, `\`, `\\`, `\n`},
+	{"echo", "", "empty above"},
+	{"echo", "ünïcødé", "日本語"},
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"", "''"},
+		{"plain", "'plain'"},
+		{"two words", "'two words'"},
+		{"it's", `'it'\''s'`},
+		{"$(id)", "'$(id)'"},
+		{"a\nb", "'a\nb'"},
+	}
+	for _, tt := range tests {
+		if got := ShellQuote(tt.in); got != tt.want {
+			t.Errorf("ShellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteArgsRoundTrip(t *testing.T) {
+	for _, args := range quotingCases {
+		got, err := splitArgs(QuoteArgs(args))
+		if err != nil {
+			t.Errorf("splitArgs(QuoteArgs(%q)): %v", args, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, args) {
+			t.Errorf("splitArgs(QuoteArgs(%q)) = %q", args, got)
+		}
+	}
+}
+
+// TestQuoteArgsShell checks the quoting against a real POSIX shell: each
+// argument must come back byte for byte, with nothing expanded or run.
+func TestQuoteArgsShell(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh to check the quoting with")
+	}
+
+	for _, args := range quotingCases {
+		line := "printf '%s\\0' " + QuoteArgs(args[1:])
+		for _, shell := range []string{RemoteShellNone, RemoteShellSh} {
+			out, err := exec.Command(sh, "-c", wrapCommand(line, shell, false)).Output()
+			if err != nil {
+				t.Errorf("%s (shell %s): %v", line, shell, err)
+				continue
+			}
+			got := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+			if len(args) == 1 {
+				got = nil
+			}
+			if !reflect.DeepEqual(got, args[1:]) {
+				t.Errorf("shell %s got %q, want %q", shell, got, args[1:])
+			}
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+	}{
+		{"ls -la /tmp", []string{"ls", "-la", "/tmp"}},
+		{"  spaced\t out\n", []string{"spaced", "out"}},
+		{`echo 'single quoted $HOME'`, []string{"echo", "single quoted $HOME"}},
+		{`echo "double \"quoted\" \$HOME"`, []string{"echo", `double "quoted" $HOME`}},
+		{`echo "keeps \n as is"`, []string{"echo", `keeps \n as is`}},
+		{`echo escaped\ space`, []string{"echo", "escaped space"}},
+		{`echo '' ""`, []string{"echo", "", ""}},
+		{`echo a'b'"c"`, []string{"echo", "abc"}},
+		{"echo $(id)", []string{"echo", "$(id)"}},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.in)
+		if err != nil {
+			t.Errorf("splitArgs(%q): %v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+
+	for _, in := range []string{`echo 'open`, `echo "open`, `echo trailing\`} {
+		if _, err := splitArgs(in); err == nil {
+			t.Errorf("splitArgs(%q) succeeded, want an error", in)
+		}
+	}
+}
+
+func TestExecCommandExecMode(t *testing.T) {
+	got, err := execCommand(`grep -r "two words" '$(id)'`, ExecExec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `'grep' '-r' 'two words' '$(id)'`; got != want {
+		t.Errorf("execCommand() = %s, want %s", got, want)
+	}
+	if _, err := execCommand("   ", ExecExec); err == nil {
+		t.Error("empty command accepted")
+	}
+}
@@ -0,0 +1,214 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FactProbe is a command run to gather one fact, and how its output is
+// turned into a value.
+type FactProbe struct {
+	Name    string `yaml:"name"`
+	Command string `yaml:"command"`
+	// Parse is one of the FactParsers; empty means "text".
+	Parse string `yaml:"parse"`
+}
+
+// FactParsers turn probe output into a fact value:
+//
+//	text        the trimmed output
+//	int         the output as an integer
+//	uptime      seconds since boot, from the first field of /proc/uptime
+//	df          use% per mount point, from df -P output
+//	os-release  PRETTY_NAME (or NAME VERSION) from /etc/os-release
+var FactParsers = map[string]func(output string) (interface{}, error){
+	"text":       parseTextFact,
+	"int":        parseIntFact,
+	"uptime":     parseUptimeFact,
+	"df":         parseDFFact,
+	"os-release": parseOSReleaseFact,
+}
+
+// DefaultFactProbes are gathered by --facts unless the config file
+// overrides them.
+var DefaultFactProbes = []FactProbe{
+	{Name: "hostname", Command: "hostname -f"},
+	{Name: "kernel", Command: "uname -r"},
+	{Name: "os", Command: "cat /etc/os-release", Parse: "os-release"},
+	{Name: "uptime_seconds", Command: "cat /proc/uptime", Parse: "uptime"},
+	{Name: "disk_usage_percent", Command: "df -P /", Parse: "df"},
+}
+
+// MergeFactProbes applies the probes from a config file to base: a probe
+// with a known name replaces it (or removes it if its command is empty),
+// other probes are added at the end.
+func MergeFactProbes(base, overrides []FactProbe) ([]FactProbe, error) {
+	probes := append([]FactProbe{}, base...)
+	for _, override := range overrides {
+		if override.Name == "" {
+			return nil, errors.New("fact probe without a name")
+		}
+		if _, ok := FactParsers[override.parser()]; !ok {
+			return nil, fmt.Errorf("fact %s: unknown parser %q", override.Name, override.Parse)
+		}
+
+		replaced := false
+		for i, probe := range probes {
+			if probe.Name == override.Name {
+				probes[i] = override
+				replaced = true
+				break
+			}
+		}
+		if !replaced {
+			probes = append(probes, override)
+		}
+	}
+
+	// Drop the probes that were disabled with an empty command
+	kept := probes[:0]
+	for _, probe := range probes {
+		if probe.Command != "" {
+			kept = append(kept, probe)
+		}
+	}
+
+	return kept, nil
+}
+
+func (p FactProbe) parser() string {
+	if p.Parse == "" {
+		return "text"
+	}
+
+	return p.Parse
+}
+
+// HostFacts are the facts gathered from one host. A probe that failed has
+// an entry in Errors instead of Facts.
+type HostFacts struct {
+	Facts  map[string]interface{} `json:"facts"`
+	Errors map[string]string      `json:"errors,omitempty"`
+}
+
+// FactsExecutor gathers facts instead of running the command: it runs each
+// probe in its own session over one connection per host and returns the
+// HostFacts as JSON. It only fails if it can't connect or every probe fails.
+type FactsExecutor struct {
+	Options Options
+	Probes  []FactProbe
+}
+
+func (e *FactsExecutor) Execute(ctx context.Context, target Target, command string) (string, error) {
+	opts := target.options(e.Options)
+	opts.Stdin, opts.Output = nil, nil
+	logger := opts.logger().With("host", target.Addr)
+
+	conn, ka, err := connect(ctx, target.Addr, opts, logger)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	defer ka.Stop()
+
+	facts := HostFacts{Facts: make(map[string]interface{}), Errors: make(map[string]string)}
+	for _, probe := range e.Probes {
+		output, err := runSession(ctx, conn, ka, probe.Command, opts, logger)
+		_, err = untruncated(err)
+		if err == nil {
+			var value interface{}
+			value, err = FactParsers[probe.parser()](output)
+			if err == nil {
+				facts.Facts[probe.Name] = value
+				continue
+			}
+		}
+		logger.Debug("Fact probe failed", "fact", probe.Name, "error", err)
+		facts.Errors[probe.Name] = err.Error()
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	data, err := json.Marshal(facts)
+	if err != nil {
+		return "", err
+	}
+	if len(facts.Facts) == 0 && len(e.Probes) > 0 {
+		return string(data), errors.New("all fact probes failed")
+	}
+
+	return string(data), nil
+}
+
+func parseTextFact(output string) (interface{}, error) {
+	return strings.TrimSpace(output), nil
+}
+
+func parseIntFact(output string) (interface{}, error) {
+	return strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+}
+
+func parseUptimeFact(output string) (interface{}, error) {
+	fields := strings.Fields(output)
+	if len(fields) == 0 {
+		return nil, errors.New("empty uptime")
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid uptime %q", fields[0])
+	}
+
+	return int64(seconds), nil
+}
+
+func parseDFFact(output string) (interface{}, error) {
+	usage := make(map[string]int)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	for _, line := range lines[1:] {
+		// Filesystem, blocks, used, available, capacity, mount point
+		fields := strings.Fields(line)
+		if len(fields) < 6 {
+			continue
+		}
+		percent, err := strconv.Atoi(strings.TrimSuffix(fields[4], "%"))
+		if err != nil {
+			continue
+		}
+		usage[strings.Join(fields[5:], " ")] = percent
+	}
+	if len(usage) == 0 {
+		return nil, errors.New("no mount points in df output")
+	}
+
+	return usage, nil
+}
+
+func parseOSReleaseFact(output string) (interface{}, error) {
+	fields := make(map[string]string)
+	for _, line := range strings.Split(output, "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.HasPrefix(name, "#") {
+			continue
+		}
+		if unquoted, err := strconv.Unquote(value); err == nil {
+			value = unquoted
+		} else {
+			value = strings.Trim(value, `'"`)
+		}
+		fields[name] = value
+	}
+
+	switch {
+	case fields["PRETTY_NAME"] != "":
+		return fields["PRETTY_NAME"], nil
+	case fields["NAME"] != "":
+		return strings.TrimSpace(fields["NAME"] + " " + fields["VERSION"]), nil
+	}
+
+	return nil, errors.New("no NAME in os-release")
+}
@@ -0,0 +1,92 @@
+package runner
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// groupRetryInterval is how often targets waiting on a full group are
+// retried when no slot was released in between.
+const groupRetryInterval = 100 * time.Millisecond
+
+// GroupSettings is an entry of the config file's groups section.
+type GroupSettings struct {
+	// MaxParallel, when positive, caps how many of the group's hosts run
+	// at once, on top of --parallel-requests.
+	MaxParallel int `yaml:"max_parallel"`
+}
+
+// GroupLimits returns the max_parallel of every group that sets one.
+func (c *Config) GroupLimits() map[string]int {
+	limits := make(map[string]int)
+	for name, group := range c.Groups {
+		if group.MaxParallel > 0 {
+			limits[name] = group.MaxParallel
+		}
+	}
+
+	return limits
+}
+
+func validateGroups(groups map[string]GroupSettings) error {
+	for name, group := range groups {
+		if group.MaxParallel < 0 {
+			return fmt.Errorf("group %s: max_parallel must not be negative", name)
+		}
+	}
+
+	return nil
+}
+
+// NewGroupSlots makes a semaphore for every group with a positive limit.
+func NewGroupSlots(limits map[string]int) map[string]chan struct{} {
+	slots := make(map[string]chan struct{})
+	for name, limit := range limits {
+		if limit > 0 {
+			slots[name] = make(chan struct{}, limit)
+		}
+	}
+
+	return slots
+}
+
+// tryAcquireGroups takes a slot in each of the target's limited groups
+// without waiting and returns the function releasing them, which also
+// signals freed. Slots are taken in group name order. It returns false, with
+// nothing held, if any of the groups is full.
+func (r *Runner) tryAcquireGroups(target Target, freed chan<- struct{}) (func(), bool) {
+	var names []string
+	for _, name := range target.Groups {
+		if _, ok := r.GroupSlots[name]; ok && !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var held []chan struct{}
+	release := func() {
+		for _, slots := range held {
+			<-slots
+		}
+		if len(held) > 0 {
+			select {
+			case freed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	for _, name := range names {
+		slots := r.GroupSlots[name]
+		select {
+		case slots <- struct{}{}:
+			held = append(held, slots)
+		default:
+			release()
+			return nil, false
+		}
+	}
+
+	return release, true
+}
@@ -0,0 +1,62 @@
+package runner
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ReadPublicKeys reads the public keys in the given files, one per line in
+// authorized_keys format (as in a ca.pub), skipping blank lines and # comments.
+func ReadPublicKeys(paths []string) ([]ssh.PublicKey, error) {
+	var keys []ssh.PublicKey
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		for len(bytes.TrimSpace(data)) > 0 {
+			var key ssh.PublicKey
+			key, _, _, data, err = ssh.ParseAuthorizedKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// CertHostKeyCallback accepts host certificates signed by one of cas that are
+// valid now and name the host among their principals. Certificates whose key
+// or signing CA is in revoked are rejected. Hosts presenting a plain key are
+// checked by fallback, or rejected when it is nil.
+func CertHostKeyCallback(cas, revoked []ssh.PublicKey, fallback ssh.HostKeyCallback) ssh.HostKeyCallback {
+	checker := &ssh.CertChecker{
+		IsHostAuthority: func(auth ssh.PublicKey, address string) bool {
+			return containsKey(cas, auth)
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return containsKey(revoked, cert.Key) || containsKey(revoked, cert.SignatureKey)
+		},
+		Clock:           time.Now,
+		HostKeyFallback: fallback,
+	}
+
+	return checker.CheckHostKey
+}
+
+func containsKey(keys []ssh.PublicKey, key ssh.PublicKey) bool {
+	marshaled := key.Marshal()
+	for _, k := range keys {
+		if bytes.Equal(k.Marshal(), marshaled) {
+			return true
+		}
+	}
+
+	return false
+}
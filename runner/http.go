@@ -0,0 +1,97 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultHTTPMaxBody is how much of a response HTTPExecutor reads when its
+// MaxBodyBytes isn't set.
+const DefaultHTTPMaxBody = 1 << 20
+
+// HTTPExecutor checks a health endpoint on each target instead of running a
+// command. The target's SSH user and port are ignored.
+type HTTPExecutor struct {
+	Scheme string
+	Port   int
+	Path   string
+	// Expect, when set, must appear in the response body.
+	Expect string
+	// MaxBodyBytes caps how much of the body is read, and so searched for
+	// Expect; DefaultHTTPMaxBody when not positive.
+	MaxBodyBytes int64
+	Client       *http.Client
+	// Logger receives per-host request events at debug level; nil uses
+	// slog.Default().
+	Logger *slog.Logger
+}
+
+func (e *HTTPExecutor) Execute(ctx context.Context, target Target, command string) (string, error) {
+	_, host := splitUserHost(target.Addr)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.Trim(host, "[]")
+
+	u := url.URL{
+		Scheme: e.Scheme,
+		Host:   net.JoinHostPort(host, strconv.Itoa(e.Port)),
+		Path:   e.Path,
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	client := e.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	logger := e.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+	logger = logger.With("host", target.Addr)
+
+	logger.Debug("Sending request", "url", u.String())
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Debug("Request failed", "duration", time.Since(start), "error", err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	// Only read as much as Expect is checked against, whatever the endpoint sends
+	limit := e.MaxBodyBytes
+	if limit <= 0 {
+		limit = DefaultHTTPMaxBody
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit))
+	elapsed := time.Since(start).Round(time.Millisecond)
+	logger.Debug("Response received", "status", resp.StatusCode, "bytes", len(body), "duration", elapsed)
+	if err != nil {
+		return "", fmt.Errorf("failed to read response from %s: %w", u.String(), err)
+	}
+
+	output := fmt.Sprintf("%s %s in %s\n", resp.Proto, resp.Status, elapsed)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return output, fmt.Errorf("unexpected status %s from %s", resp.Status, u.String())
+	}
+	if e.Expect != "" && !strings.Contains(string(body), e.Expect) {
+		return output, fmt.Errorf("response body from %s does not contain %q", u.String(), e.Expect)
+	}
+
+	return output, nil
+}
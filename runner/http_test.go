@@ -0,0 +1,78 @@
+package runner
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// startHTTP serves handler and returns an executor and target pointing at it.
+func startHTTP(t *testing.T, handler http.HandlerFunc) (*HTTPExecutor, Target) {
+	t.Helper()
+	s := httptest.NewServer(handler)
+	t.Cleanup(s.Close)
+
+	host, port, err := net.SplitHostPort(strings.TrimPrefix(s.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	portNum, _ := strconv.Atoi(port)
+
+	return &HTTPExecutor{Scheme: "http", Port: portNum, Path: "/health"}, Target{Name: "web1", Addr: "root@" + host}
+}
+
+func TestHTTPExecutorExpect(t *testing.T) {
+	e, target := startHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("status: OK\n"))
+	})
+
+	e.Expect = "OK"
+	output, err := e.Execute(context.Background(), target, "")
+	if err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	if !strings.Contains(output, "200 OK") {
+		t.Errorf("output = %q, want the status", output)
+	}
+
+	e.Expect = "READY"
+	if _, err := e.Execute(context.Background(), target, ""); err == nil {
+		t.Error("Execute succeeded without the expected text")
+	}
+}
+
+func TestHTTPExecutorBodyLimit(t *testing.T) {
+	const size = 64 << 20
+	sent := make(chan int64, 1)
+	e, target := startHTTP(t, func(w http.ResponseWriter, r *http.Request) {
+		chunk := []byte(strings.Repeat("x", 32<<10))
+		var n int64
+		for n < size {
+			if _, err := w.Write(chunk); err != nil {
+				break
+			}
+			n += int64(len(chunk))
+		}
+		if n >= size {
+			w.Write([]byte("OK"))
+		}
+		sent <- n
+	})
+	e.MaxBodyBytes = 1 << 20
+	e.Expect = "OK"
+
+	if _, err := e.Execute(context.Background(), target, ""); err == nil {
+		t.Error("Expect matched past MaxBodyBytes")
+	}
+	if n := <-sent; n >= size {
+		t.Errorf("the whole %d MB body was read", n>>20)
+	}
+}
@@ -0,0 +1,65 @@
+package runner
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// KeyboardInteractive answers the prompts of keyboard-interactive
+// authentication, for devices that offer nothing else.
+type KeyboardInteractive struct {
+	// Password answers prompts that ask for a password.
+	Password string
+	// Answers answer the other prompts, in the order they are asked.
+	Answers []string
+}
+
+// challenge returns the callback for one connection. A prompt that can't be
+// answered fails the login with the (sanitized) prompt text.
+func (k *KeyboardInteractive) challenge(logger *slog.Logger) ssh.KeyboardInteractiveChallenge {
+	next := 0
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, question := range questions {
+			// Only the prompt is logged, never the answer
+			logger.Debug("Keyboard-interactive prompt", "prompt", sanitizePrompt(question))
+			switch {
+			case k.Password != "" && strings.Contains(strings.ToLower(question), "password"):
+				answers[i] = k.Password
+			case next < len(k.Answers):
+				answers[i] = k.Answers[next]
+				next++
+			default:
+				return nil, fmt.Errorf("no answer for keyboard-interactive prompt %q (use --password or --ki-answers)", sanitizePrompt(question))
+			}
+		}
+
+		return answers, nil
+	}
+}
+
+// sanitizePrompt drops control characters from a server-provided prompt and
+// caps its length, so it is safe to put into logs and terminals.
+func sanitizePrompt(prompt string) string {
+	const maxLen = 100
+
+	var b strings.Builder
+	n := 0
+	for _, r := range strings.TrimSpace(prompt) {
+		if !unicode.IsPrint(r) {
+			continue
+		}
+		if n == maxLen {
+			b.WriteString("...")
+			break
+		}
+		b.WriteRune(r)
+		n++
+	}
+
+	return b.String()
+}
@@ -0,0 +1,85 @@
+package runner
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ErrConnectionLost is returned when a connection stops answering keepalives.
+var ErrConnectionLost = errors.New("connection lost: keepalives unanswered")
+
+// keepalive sends keepalive@openssh.com requests on a connection and closes it
+// once too many of them go unanswered, so a dead link fails instead of hanging.
+type keepalive struct {
+	done     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
+	lost     atomic.Bool
+}
+
+func startKeepalive(conn ssh.Conn, interval time.Duration, maxMissed int) *keepalive {
+	k := &keepalive{done: make(chan struct{})}
+	if interval <= 0 {
+		return k
+	}
+
+	k.wg.Add(1)
+	go func() {
+		defer k.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		missed := 0
+		for {
+			select {
+			case <-k.done:
+				return
+			case <-ticker.C:
+			}
+
+			// SendRequest returns once the connection is closed, so this can't leak
+			reply := make(chan error, 1)
+			go func() {
+				_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+				reply <- err
+			}()
+
+			select {
+			case <-k.done:
+				return
+			case err := <-reply:
+				if err != nil {
+					missed++
+				} else {
+					missed = 0
+				}
+			case <-time.After(interval):
+				missed++
+			}
+
+			if missed >= maxMissed {
+				k.lost.Store(true)
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	return k
+}
+
+// Stop ends the keepalive loop and waits for it to exit.
+func (k *keepalive) Stop() {
+	k.stopOnce.Do(func() { close(k.done) })
+	k.wg.Wait()
+}
+
+// Lost reports whether the connection was closed for missing keepalives.
+func (k *keepalive) Lost() bool {
+	return k.lost.Load()
+}
@@ -0,0 +1,207 @@
+package runner
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Key is a parsed private key and where it came from: a file, or a source
+// such as "env:DEPLOY_KEY". With Cert set, the Signer presents the
+// certificate instead of the bare public key.
+type Key struct {
+	Path     string
+	CertPath string
+	Cert     *ssh.Certificate
+	Signer   ssh.Signer
+}
+
+// LoadKeys reads and parses the private keys at paths, each with its
+// <key>-cert.pub certificate if there is one. The result can be shared by
+// all hosts of a run.
+func LoadKeys(paths []string) ([]Key, error) {
+	keys := make([]Key, 0, len(paths))
+	for _, path := range paths {
+		key, err := LoadKey(path, "")
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// LoadKey reads the private key at path and, if certPath is set or
+// <path>-cert.pub exists, the certificate to authenticate with. A
+// certificate outside its validity window is an error.
+func LoadKey(path, certPath string) (Key, error) {
+	keyBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Key{}, err
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to parse private key %s: %w", path, err)
+	}
+	key := Key{Path: path, Signer: signer}
+
+	if certPath == "" {
+		if _, err := os.Stat(path + "-cert.pub"); err != nil {
+			return key, nil
+		}
+		certPath = path + "-cert.pub"
+	}
+
+	return withCert(key, certPath)
+}
+
+// ParseKey parses key material that was not read from a file, e.g. from an
+// environment variable. source names it in errors, which never include the
+// key material itself. The certificate at certPath is used if set.
+func ParseKey(source string, pemBytes []byte, certPath string) (Key, error) {
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if err != nil {
+		return Key{}, fmt.Errorf("key from %s is not a valid private key", source)
+	}
+	key := Key{Path: source, Signer: signer}
+
+	if certPath == "" {
+		return key, nil
+	}
+
+	return withCert(key, certPath)
+}
+
+// withCert loads the certificate at certPath for key.
+func withCert(key Key, certPath string) (Key, error) {
+	certBytes, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return Key{}, err
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to parse certificate %s: %w", certPath, err)
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return Key{}, fmt.Errorf("%s is not an SSH certificate", certPath)
+	}
+	certSigner, err := ssh.NewCertSigner(cert, key.Signer)
+	if err != nil {
+		return Key{}, fmt.Errorf("certificate %s does not match key %s: %w", certPath, key.Path, err)
+	}
+
+	key.CertPath = certPath
+	key.Cert = cert
+	key.Signer = certSigner
+	if err := key.checkValidity(time.Now()); err != nil {
+		return Key{}, err
+	}
+
+	return key, nil
+}
+
+// CertValidityError reports a client certificate that is expired or not yet
+// valid. ClassifyError counts it as an authentication failure.
+type CertValidityError struct {
+	Path        string
+	State       string
+	ValidAfter  uint64
+	ValidBefore uint64
+}
+
+func (e *CertValidityError) Error() string {
+	return fmt.Sprintf("certificate %s is %s (valid from %s until %s)", e.Path, e.State, certTime(e.ValidAfter), certTime(e.ValidBefore))
+}
+
+// checkValidity reports an error if the key's certificate is not valid at
+// now, so an expired certificate is named instead of surfacing as a generic
+// authentication failure.
+func (k Key) checkValidity(now time.Time) error {
+	if k.Cert == nil {
+		return nil
+	}
+
+	unix := uint64(now.Unix())
+	if unix >= k.Cert.ValidAfter && unix < k.Cert.ValidBefore {
+		return nil
+	}
+
+	state := "expired"
+	if unix < k.Cert.ValidAfter {
+		state = "not yet valid"
+	}
+	return &CertValidityError{Path: k.CertPath, State: state, ValidAfter: k.Cert.ValidAfter, ValidBefore: k.Cert.ValidBefore}
+}
+
+func certTime(t uint64) string {
+	if t == ssh.CertTimeInfinity {
+		return "forever"
+	}
+
+	return time.Unix(int64(t), 0).UTC().Format(time.RFC3339)
+}
+
+// validKeys drops keys whose certificate is not valid at now. If that leaves
+// nothing, the first validity error is returned.
+func validKeys(keys []Key, now time.Time) ([]Key, error) {
+	var valid []Key
+	var firstErr error
+	for _, key := range keys {
+		if err := key.checkValidity(now); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		valid = append(valid, key)
+	}
+	if len(valid) == 0 {
+		if firstErr == nil {
+			firstErr = errors.New("no private keys to authenticate with")
+		}
+		return nil, firstErr
+	}
+
+	return valid, nil
+}
+
+// recordingSigner notes which key the server accepted: the client only signs
+// with a key after the server agreed to it.
+type recordingSigner struct {
+	ssh.Signer
+	path string
+	used *string
+}
+
+func (s *recordingSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	*s.used = s.path
+	return s.Signer.Sign(rand, data)
+}
+
+// recordingAlgorithmSigner keeps the AlgorithmSigner interface visible, so
+// RSA keys can still sign with rsa-sha2-256/512.
+type recordingAlgorithmSigner struct {
+	*recordingSigner
+	algorithmSigner ssh.AlgorithmSigner
+}
+
+func (s *recordingAlgorithmSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	*s.used = s.path
+	return s.algorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+}
+
+func recordSigner(signer ssh.Signer, path string, used *string) ssh.Signer {
+	recording := &recordingSigner{Signer: signer, path: path, used: used}
+	if as, ok := signer.(ssh.AlgorithmSigner); ok {
+		return &recordingAlgorithmSigner{recordingSigner: recording, algorithmSigner: as}
+	}
+
+	return recording
+}
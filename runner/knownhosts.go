@@ -0,0 +1,171 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyStatus describes how a scanned host key relates to known_hosts.
+type HostKeyStatus int
+
+const (
+	HostKeyKnown HostKeyStatus = iota
+	HostKeyUnknown
+	HostKeyChanged
+)
+
+var errKeyScanned = errors.New("host key scanned")
+
+// ScannedKey is a host key presented by a server during the handshake.
+type ScannedKey struct {
+	Addr   string
+	Remote net.Addr
+	Key    ssh.PublicKey
+}
+
+// KnownHostsLine formats the key the same way ssh-keyscan does.
+func (s *ScannedKey) KnownHostsLine() string {
+	return knownhosts.Line([]string{knownhosts.Normalize(s.Addr)}, s.Key)
+}
+
+// ScanHostKey connects to target just far enough to capture its host key,
+// without authenticating. The handshake is made like a real connection's:
+// opts with the target's algorithms applied, so HostKeyAlgorithms picks the
+// key that is scanned, and dialed with PreferFamily through Proxy. Of the
+// rest of opts, only Timeout and ConnectLimiter are used.
+func ScanHostKey(ctx context.Context, target Target, opts Options) (*ScannedKey, error) {
+	opts = target.options(opts)
+	_, host := splitUserHost(target.Addr)
+	dialAddr := buildDialAddr(host, DefaultPort)
+
+	var scanned *ScannedKey
+	config := &ssh.ClientConfig{
+		User: "root",
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			scanned = &ScannedKey{Addr: dialAddr, Remote: remote, Key: key}
+			return errKeyScanned
+		},
+		Timeout: opts.Timeout,
+	}
+	opts.Algorithms.apply(config)
+
+	if _, err := opts.ConnectLimiter.Wait(ctx); err != nil {
+		return nil, err
+	}
+	conn, err := dial(ctx, dialAddr, config, opts.PreferFamily, opts.Proxy)
+	if conn != nil {
+		conn.Close()
+	}
+	if scanned != nil {
+		return scanned, nil
+	}
+
+	return nil, err
+}
+
+// CheckHostKey verifies a scanned key against a known_hosts callback.
+func CheckHostKey(callback ssh.HostKeyCallback, scanned *ScannedKey) (HostKeyStatus, error) {
+	err := callback(scanned.Addr, scanned.Remote, scanned.Key)
+	if err == nil {
+		return HostKeyKnown, nil
+	}
+
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		if len(keyErr.Want) == 0 {
+			return HostKeyUnknown, nil
+		}
+		return HostKeyChanged, nil
+	}
+
+	return HostKeyKnown, err
+}
+
+// UpdateKnownHosts writes the scanned keys to a known_hosts file, replacing
+// any existing entries for the same hosts. The file is replaced atomically.
+func UpdateKnownHosts(path string, keys []*ScannedKey) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	replaced := make(map[string]bool)
+	for _, key := range keys {
+		replaced[knownhosts.Normalize(key.Addr)] = true
+	}
+
+	var out bytes.Buffer
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" || knownHostsLineMatches(line, replaced) {
+			continue
+		}
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteString("\n")
+		}
+	}
+	for _, key := range keys {
+		out.WriteString(key.KnownHostsLine() + "\n")
+	}
+
+	return WriteFileAtomic(path, out.Bytes(), 0600)
+}
+
+// knownHostsLineMatches reports whether a known_hosts line lists one of the
+// given hosts, either in plain text or hashed.
+func knownHostsLineMatches(line string, hosts map[string]bool) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return false
+	}
+	if strings.HasPrefix(fields[0], "@") {
+		// Leave @cert-authority and @revoked lines alone
+		return false
+	}
+
+	for _, pattern := range strings.Split(fields[0], ",") {
+		if hosts[pattern] {
+			return true
+		}
+		if strings.HasPrefix(pattern, "|1|") {
+			for host := range hosts {
+				if hashedHostMatches(pattern, host) {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func hashedHostMatches(pattern, host string) bool {
+	parts := strings.Split(pattern, "|")
+	if len(parts) != 4 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	want, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+	return hmac.Equal(mac.Sum(nil), want)
+}
@@ -0,0 +1,48 @@
+package runner
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"server-manager/runner/sshtest"
+)
+
+func TestScanHostKeyAlgorithms(t *testing.T) {
+	s := &sshtest.Server{}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	opts := Options{Timeout: 5 * time.Second}
+
+	scanned, err := ScanHostKey(context.Background(), Target{Addr: "root@" + s.Addr()}, opts)
+	if err != nil {
+		t.Fatalf("ScanHostKey: %v", err)
+	}
+	if got, want := ssh.FingerprintSHA256(scanned.Key), ssh.FingerprintSHA256(s.HostKey.PublicKey()); got != want {
+		t.Errorf("scanned key %s, want %s", got, want)
+	}
+
+	// The server only has an ed25519 key, so asking for RSA must fail the
+	// handshake rather than scan anyway
+	rsaOnly := Algorithms{HostKeyAlgorithms: []string{ssh.KeyAlgoRSASHA256}}
+	opts.Algorithms = rsaOnly
+	if _, err := ScanHostKey(context.Background(), Target{Addr: "root@" + s.Addr()}, opts); err == nil {
+		t.Error("scan succeeded with --host-key-algorithms excluding the host's key")
+	}
+
+	// The target's own algorithms override the global ones
+	target := Target{Addr: "root@" + s.Addr(), Algorithms: Algorithms{HostKeyAlgorithms: []string{ssh.KeyAlgoED25519}}}
+	if _, err := ScanHostKey(context.Background(), target, opts); err != nil {
+		t.Errorf("scan with the target's host key algorithms: %v", err)
+	}
+
+	opts.Algorithms = Algorithms{}
+	target = Target{Addr: "root@" + s.Addr(), Algorithms: rsaOnly}
+	if _, err := ScanHostKey(context.Background(), target, opts); err == nil {
+		t.Error("scan ignored the target's host key algorithms")
+	}
+}
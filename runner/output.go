@@ -0,0 +1,162 @@
+package runner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"unicode/utf8"
+)
+
+// ErrOutputTruncated is returned, with Options.MaxOutputError, for commands
+// whose output went past Options.MaxOutputBytes.
+var ErrOutputTruncated = errors.New("output exceeded the limit")
+
+// TruncatedError reports that a command produced Total bytes of output and
+// only the last Limit were kept. Err is the command's own outcome, nil when
+// it succeeded. Runner turns it into Result.Truncated and Result.OutputBytes,
+// so only callers of an Executor see it.
+type TruncatedError struct {
+	Limit int64
+	Total int64
+	Err   error
+}
+
+func (e *TruncatedError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+
+	return fmt.Sprintf("output truncated at %d of %d bytes", e.Limit, e.Total)
+}
+
+func (e *TruncatedError) Unwrap() error {
+	return e.Err
+}
+
+// untruncated strips a TruncatedError from err, returning it separately.
+func untruncated(err error) (*TruncatedError, error) {
+	var truncated *TruncatedError
+	if errors.As(err, &truncated) {
+		return truncated, truncated.Err
+	}
+
+	return nil, err
+}
+
+// limitedBuffer collects a command's stdout and stderr as they are written,
+// keeping the last limit bytes (all of them when limit isn't positive) and
+// counting the rest, so memory stays bounded however much is produced while
+// the end of the output, where errors and summaries usually are, survives.
+type limitedBuffer struct {
+	mu    sync.Mutex
+	buf   []byte
+	limit int64
+	total int64
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.total += int64(len(p))
+	if b.limit > 0 && int64(len(p)) >= b.limit {
+		b.buf = append(b.buf[:0], p[int64(len(p))-b.limit:]...)
+		return len(p), nil
+	}
+	// Let the buffer grow to twice the limit before dropping the oldest
+	// bytes, so each write doesn't move the whole tail
+	if b.limit > 0 && int64(len(b.buf)+len(p)) > 2*b.limit {
+		keep := b.limit - int64(len(p))
+		b.buf = b.buf[:copy(b.buf, b.buf[int64(len(b.buf))-keep:])]
+	}
+	b.buf = append(b.buf, p...)
+
+	// Claim the whole write so the session keeps draining the channel
+	return len(p), nil
+}
+
+// bytes returns the kept output. When the start was dropped, it begins at
+// the first whole character.
+func (b *limitedBuffer) bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	out := b.buf
+	if b.limit > 0 && int64(len(out)) > b.limit {
+		out = out[int64(len(out))-b.limit:]
+	}
+	if b.limit > 0 && b.total > b.limit {
+		for i := 0; i < utf8.UTFMax-1 && len(out) > 0 && !utf8.RuneStart(out[0]); i++ {
+			out = out[1:]
+		}
+	}
+
+	return out
+}
+
+func (b *limitedBuffer) truncated() bool {
+	return b.limit > 0 && b.total > b.limit
+}
+
+// sinkWriter passes writes on to w until one fails, then keeps the error
+// and drops the rest, so a failing sink doesn't stall the session.
+type sinkWriter struct {
+	mu  sync.Mutex
+	w   io.Writer
+	err error
+}
+
+func (s *sinkWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err == nil {
+		_, s.err = s.w.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// crlfWriter turns the CRLF line endings a terminal writes into LF on the way
+// to w. A CR ending one write is held back until the next shows whether it
+// starts a CRLF; Flush passes on a CR still held at the end.
+type crlfWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+	cr bool
+}
+
+func (c *crlfWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data := p
+	if c.cr {
+		data = append([]byte{'\r'}, p...)
+		c.cr = false
+	}
+	if len(data) > 0 && data[len(data)-1] == '\r' {
+		data = data[:len(data)-1]
+		c.cr = true
+	}
+	if _, err := c.w.Write(bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *crlfWriter) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.cr {
+		return nil
+	}
+	c.cr = false
+	_, err := c.w.Write([]byte{'\r'})
+
+	return err
+}
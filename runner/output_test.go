@@ -0,0 +1,94 @@
+package runner
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLimitedBufferKeepsTail(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int64
+		writes []string
+		want   string
+	}{
+		{name: "no limit", writes: []string{"abc", "def"}, want: "abcdef"},
+		{name: "under the limit", limit: 10, writes: []string{"abc", "def"}, want: "abcdef"},
+		{name: "exactly the limit", limit: 6, writes: []string{"abc", "def"}, want: "abcdef"},
+		{name: "small writes past the limit", limit: 4, writes: []string{"ab", "cd", "ef", "gh", "ij"}, want: "ghij"},
+		{name: "one write past the limit", limit: 4, writes: []string{"abcdefgh"}, want: "efgh"},
+		{name: "big write after small ones", limit: 4, writes: []string{"ab", "cdefghij", "k"}, want: "hijk"},
+		{name: "starts at a whole character", limit: 5, writes: []string{"ab✓✓"}, want: "✓"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := &limitedBuffer{limit: tt.limit}
+			total := 0
+			for _, w := range tt.writes {
+				if n, err := b.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+				total += len(w)
+			}
+			if got := string(b.bytes()); got != tt.want {
+				t.Errorf("bytes() = %q, want %q", got, tt.want)
+			}
+			if b.total != int64(total) {
+				t.Errorf("total = %d, want %d", b.total, total)
+			}
+			if want := tt.limit > 0 && int64(total) > tt.limit; b.truncated() != want {
+				t.Errorf("truncated() = %v, want %v", b.truncated(), want)
+			}
+		})
+	}
+}
+
+func TestLimitedBufferStaysBounded(t *testing.T) {
+	const limit = 1 << 10
+	b := &limitedBuffer{limit: limit}
+	line := strings.Repeat("x", 99) + "\n"
+	for i := 0; i < 10000; i++ {
+		b.Write([]byte(line))
+		if int64(cap(b.buf)) > 4*limit {
+			t.Fatalf("buffer grew to %d bytes with a %d byte limit", cap(b.buf), limit)
+		}
+	}
+	b.Write([]byte("last line\n"))
+	if got := string(b.bytes()); len(got) != limit || !strings.HasSuffix(got, "x\nlast line\n") {
+		t.Errorf("kept %d bytes ending %q", len(got), got[len(got)-20:])
+	}
+}
+
+func TestCRLFWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+		want   string
+	}{
+		{name: "whole lines", writes: []string{"a\r\nb\r\n"}, want: "a\nb\n"},
+		{name: "CRLF split across writes", writes: []string{"a\r", "\nb\r", "\n"}, want: "a\nb\n"},
+		{name: "bare CR kept", writes: []string{"50%\r100%\r\n"}, want: "50%\r100%\n"},
+		{name: "CR followed by text in the next write", writes: []string{"50%\r", "100%\n"}, want: "50%\r100%\n"},
+		{name: "trailing CR flushed", writes: []string{"a\r\nb\r"}, want: "a\nb\r"},
+		{name: "empty writes", writes: []string{"a\r", "", "\n"}, want: "a\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out strings.Builder
+			c := &crlfWriter{w: &out}
+			for _, w := range tt.writes {
+				if n, err := c.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+			}
+			if err := c.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != tt.want {
+				t.Errorf("wrote %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
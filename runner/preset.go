@@ -0,0 +1,48 @@
+package runner
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Preset is a named command from the config file's commands map.
+type Preset struct {
+	Command     string `yaml:"command"`
+	Description string `yaml:"description"`
+	// Sudo runs the command as root through sudo -n (see Options.Sudo).
+	Sudo bool `yaml:"sudo"`
+	// Timeout applies like --command-timeout when that flag isn't given.
+	Timeout time.Duration `yaml:"timeout"`
+	// Confirm asks before the preset is run.
+	Confirm bool `yaml:"confirm"`
+}
+
+// PresetNames returns the names of the config's presets, sorted.
+func (c *Config) PresetNames() []string {
+	names := make([]string, 0, len(c.Commands))
+	for name := range c.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Preset looks up a preset by name. The error for an unknown name lists the
+// valid ones.
+func (c *Config) Preset(name string) (Preset, error) {
+	preset, ok := c.Commands[name]
+	if !ok {
+		if len(c.Commands) == 0 {
+			return Preset{}, fmt.Errorf("unknown preset %q (the config file has no commands)", name)
+		}
+		return Preset{}, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(c.PresetNames(), ", "))
+	}
+	if preset.Command == "" {
+		return Preset{}, fmt.Errorf("preset %q has no command", name)
+	}
+
+	return preset, nil
+}
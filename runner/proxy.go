@@ -0,0 +1,82 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// Proxy failures, told apart so a dead proxy isn't mistaken for dead hosts.
+var (
+	ErrProxyUnavailable = errors.New("proxy unavailable")
+	ErrProxyAuth        = errors.New("proxy rejected credentials")
+	ErrProxyTarget      = errors.New("target host unreachable via proxy")
+)
+
+// ParseProxyURL parses a socks5://[user:pass@]host[:port] proxy address
+// (port 1080 by default). socks5h is accepted as well; host names are
+// resolved by the proxy either way.
+func ParseProxyURL(value string) (*url.URL, error) {
+	u, err := url.Parse(value)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return nil, fmt.Errorf("unsupported proxy %q (expected socks5://[user:pass@]host:port)", value)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("proxy %q has no host", value)
+	}
+
+	return u, nil
+}
+
+// dialProxy connects to addr through the SOCKS5 proxy at proxyURL.
+func dialProxy(ctx context.Context, proxyURL *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	d, err := proxy.FromURL(proxyURL, &net.Dialer{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	conn, err := d.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, proxyError(proxyURL, err)
+	}
+
+	return conn, nil
+}
+
+// proxyError tells whether the proxy itself or the host behind it failed.
+func proxyError(proxyURL *url.URL, err error) error {
+	if errors.Is(err, context.Canceled) {
+		return err
+	}
+
+	// The socks package wraps everything in a "socks connect" OpError whose
+	// inner error is a "dial" OpError when the proxy couldn't be reached
+	inner := err
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "socks connect" {
+		inner = opErr.Err
+	}
+	var dialErr *net.OpError
+	switch {
+	case errors.As(inner, &dialErr) && dialErr.Op == "dial":
+		return fmt.Errorf("%w %s: %v", ErrProxyUnavailable, proxyURL.Host, dialErr.Err)
+	case strings.Contains(inner.Error(), "authentication"):
+		return fmt.Errorf("%w (%s): %v", ErrProxyAuth, proxyURL.Host, inner)
+	}
+
+	return fmt.Errorf("%w: %v", ErrProxyTarget, inner)
+}
@@ -0,0 +1,398 @@
+// Package runner executes a command on many hosts over SSH with bounded
+// concurrency. It is the engine behind the server-manager CLI.
+package runner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Result is the outcome of running the command on a single host.
+type Result struct {
+	Host     string
+	Output   string
+	Error    error
+	Duration time.Duration
+	ExitCode int
+	// Truncated is set when the output went past Options.MaxOutputBytes
+	// and its start was cut off; OutputBytes is then how much was produced.
+	Truncated   bool
+	OutputBytes int64
+	// ErrorKind classifies Error, see ClassifyError.
+	ErrorKind ErrorKind
+}
+
+// receivedBytes is how much output the command produced, including what a
+// truncated result dropped.
+func (r Result) receivedBytes() int64 {
+	if r.Truncated {
+		return r.OutputBytes
+	}
+
+	return int64(len(r.Output))
+}
+
+// Target is a host to run on. Name is what results are reported under, Addr
+// is the [user@]host[:port] that is dialed and Vars feed the command template.
+// Keys and Algorithms, when set, replace those of Options for this host, and
+// a non-zero Timeout bounds the whole execution on it.
+type Target struct {
+	Name       string
+	Addr       string
+	Vars       map[string]string
+	Groups     []string
+	Keys       []Key
+	Algorithms Algorithms
+	Timeout    time.Duration
+	// RemoteShell, when set, replaces Options.RemoteShell for this host.
+	RemoteShell string
+	// Unreachable, when set (e.g. by Preflight), fails the target with
+	// this error without running anything.
+	Unreachable error
+	// Output, when set, receives the target's whole output as it arrives.
+	// Runner sets it from OutputSink.
+	Output io.Writer
+}
+
+// options returns opts with the target's own keys and algorithms applied.
+func (t Target) options(opts Options) Options {
+	if len(t.Keys) > 0 {
+		opts.Keys = t.Keys
+	}
+	opts.Algorithms = opts.Algorithms.merge(t.Algorithms)
+	if t.RemoteShell != "" {
+		opts.RemoteShell = t.RemoteShell
+	}
+	if t.Output != nil {
+		opts.Output = t.Output
+	}
+
+	return opts
+}
+
+// Executor runs a rendered command against a single target.
+type Executor interface {
+	Execute(ctx context.Context, target Target, command string) (string, error)
+}
+
+// SSHExecutor runs commands over SSH. With Conns set, commands share one
+// connection per host and Options is taken from the ConnManager.
+type SSHExecutor struct {
+	Options Options
+	Conns   *ConnManager
+}
+
+func (e *SSHExecutor) Execute(ctx context.Context, target Target, command string) (string, error) {
+	if e.Conns != nil {
+		return e.Conns.Execute(ctx, target, command)
+	}
+
+	return ExecuteCommand(ctx, target.Addr, command, target.options(e.Options))
+}
+
+// Runner runs a command on its targets, at most Parallelism at a time.
+// Vars are global template variables and take precedence over target vars,
+// which in turn take precedence over DefaultVars.
+// Executor defaults to an SSHExecutor using Options.
+type Runner struct {
+	Targets     []Target
+	Parallelism int
+	Vars        map[string]string
+	DefaultVars map[string]string
+	Options     Options
+	Executor    Executor
+	// Slots, when set, replaces Parallelism: a host runs while it holds a
+	// slot, so runners sharing Slots are limited together.
+	Slots chan struct{}
+	// Graceful makes cancelling the run only skip hosts that haven't
+	// started; commands already running finish or hit their Timeout.
+	Graceful bool
+	// GroupSlots, from NewGroupSlots, caps how many targets of each named
+	// group run at once. A target in several limited groups honors all of
+	// them, and only takes a Parallelism (or Slots) slot once its groups
+	// let it run. Runners sharing GroupSlots are limited together.
+	GroupSlots map[string]chan struct{}
+	// OnStart, when set, is called (possibly concurrently) as each target
+	// gets its slot and starts running.
+	OnStart func(target Target)
+	// Budget, when set, is charged with every target's output and keeps
+	// targets from starting once it runs out.
+	Budget *OutputBudget
+	// OutputSink, when set, opens where a target's whole output is copied
+	// as it arrives, ahead of Options.MaxOutputBytes, so outputs of any size
+	// reach it without being held in memory. It is closed when the target
+	// is done. i is the target's index in Targets, e.g. for Render.
+	OutputSink func(target Target, i int) (io.WriteCloser, error)
+}
+
+// Run executes command on every target and returns the results in the order
+// they completed. If ctx is cancelled, targets that hadn't started yet are
+// left out and ctx.Err() is returned along with the results collected so far.
+func (r *Runner) Run(ctx context.Context, command string) ([]Result, error) {
+	results, err := r.Stream(ctx, command)
+	if err != nil {
+		return nil, err
+	}
+
+	var collected []Result
+	for result := range results {
+		collected = append(collected, result)
+	}
+
+	return collected, ctx.Err()
+}
+
+// Stream is like Run but delivers results on a channel as hosts complete.
+// The channel is closed once every target is done; callers must drain it.
+func (r *Runner) Stream(ctx context.Context, command string) (<-chan Result, error) {
+	indices := make([]int, len(r.Targets))
+	for i := range indices {
+		indices[i] = i
+	}
+
+	return r.StreamTargets(ctx, command, indices)
+}
+
+// StreamTargets is like Stream but only runs the targets at the given
+// indices, e.g. a canary host first and the rest later. Built-in variables
+// such as Index and Total still refer to all targets.
+func (r *Runner) StreamTargets(ctx context.Context, command string, indices []int) (<-chan Result, error) {
+	if _, err := ParseCommandTemplate(command); err != nil {
+		return nil, fmt.Errorf("failed to parse command template: %w", err)
+	}
+
+	parallelism := r.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	// Create a limited concurrency parallelism pattern
+	// using the specified number of parallel requests
+	semaphore := r.Slots
+	if semaphore == nil {
+		semaphore = make(chan struct{}, parallelism)
+	}
+
+	// Run the targets on a fixed pool of workers, so a huge host list doesn't
+	// start a goroutine per host up front
+	workers := parallelism
+	if workers > len(indices) {
+		workers = len(indices)
+	}
+	jobs := make(chan targetJob)
+	results := make(chan Result)
+	var wg sync.WaitGroup
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for job := range jobs {
+				if result, ok := r.runTarget(ctx, semaphore, job.index, command, job.releaseGroups); ok {
+					results <- result
+				}
+			}
+		}()
+	}
+
+	go func() {
+		r.dispatch(ctx, indices, jobs)
+		close(jobs)
+	}()
+
+	// Wait for all workers to finish and close the results channel
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results, nil
+}
+
+// targetJob is a target handed to a worker, holding its group slots.
+type targetJob struct {
+	index         int
+	releaseGroups func()
+}
+
+// dispatch hands the targets at indices to the workers in order, once they
+// have a slot in each of their limited groups. Targets whose groups are full
+// are passed over and retried when slots free up, so hosts held back by a
+// small group limit neither keep others from running nor take a worker
+// while waiting. It stops when ctx is cancelled.
+func (r *Runner) dispatch(ctx context.Context, indices []int, jobs chan<- targetJob) {
+	freed := make(chan struct{}, 1)
+	pending := indices
+	for len(pending) > 0 {
+		var waiting []int
+		for _, i := range pending {
+			if ctx.Err() != nil {
+				return
+			}
+			releaseGroups, ok := func() {}, true
+			if r.Targets[i].Unreachable == nil {
+				releaseGroups, ok = r.tryAcquireGroups(r.Targets[i], freed)
+			}
+			if !ok {
+				waiting = append(waiting, i)
+				continue
+			}
+			select {
+			case jobs <- targetJob{index: i, releaseGroups: releaseGroups}:
+			case <-ctx.Done():
+				releaseGroups()
+				return
+			}
+		}
+		if len(waiting) == 0 {
+			return
+		}
+		pending = waiting
+
+		// Runners sharing GroupSlots don't signal freed, so check again
+		// every so often too
+		select {
+		case <-freed:
+		case <-time.After(groupRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Render expands command for the i-th target. The template sees the
+// built-in variables (see TargetBuiltins) plus DefaultVars, overridden by the
+// target's vars and those by Vars.
+func (r *Runner) Render(i int, command string) (string, error) {
+	target := r.Targets[i]
+	vars := mergeVars(r.DefaultVars, target.Vars, r.Vars)
+
+	return renderTemplate(command, TargetBuiltins(target, i, len(r.Targets)), vars)
+}
+
+// CommandLine returns the command line sent to the i-th target: command
+// rendered, prepared for the exec mode and wrapped for the remote shell and
+// sudo.
+func (r *Runner) CommandLine(i int, command string) (string, error) {
+	rendered, err := r.Render(i, command)
+	if err != nil {
+		return "", err
+	}
+	opts := r.Targets[i].options(r.Options)
+	line, err := execCommand(rendered, opts.ExecMode)
+	if err != nil {
+		return "", err
+	}
+
+	return wrapCommand(line, opts.RemoteShell, opts.Sudo), nil
+}
+
+func (r *Runner) runTarget(ctx context.Context, semaphore chan struct{}, i int, command string, releaseGroups func()) (Result, bool) {
+	target := r.Targets[i]
+	defer releaseGroups()
+
+	// Render the command once, before connecting, so a bad template fails
+	// the host without touching it
+	hostCommand, err := r.Render(i, command)
+	if err != nil {
+		return Result{
+			Host:      target.Name,
+			Error:     fmt.Errorf("failed to render command: %w", err),
+			ExitCode:  -1,
+			ErrorKind: ErrorKindOther,
+		}, true
+	}
+
+	if target.Unreachable != nil {
+		return Result{
+			Host:      target.Name,
+			Error:     target.Unreachable,
+			ExitCode:  -1,
+			ErrorKind: ClassifyError(target.Unreachable),
+		}, true
+	}
+
+	// Acquire a semaphore slot, unless the run is cancelled first
+	select {
+	case semaphore <- struct{}{}:
+	case <-ctx.Done():
+		return Result{}, false
+	}
+	defer func() { <-semaphore }() // Release the semaphore slot
+	if ctx.Err() != nil {
+		return Result{}, false
+	}
+	if !r.Budget.Allow() {
+		return Result{
+			Host:      target.Name,
+			Error:     ErrOutputBudget,
+			ExitCode:  -1,
+			ErrorKind: ErrorKindOther,
+		}, true
+	}
+	if r.OnStart != nil {
+		r.OnStart(target)
+	}
+	var sink io.WriteCloser
+	if r.OutputSink != nil {
+		if sink, err = r.OutputSink(target, i); err != nil {
+			return Result{
+				Host:      target.Name,
+				Error:     fmt.Errorf("failed to open output sink: %w", err),
+				ExitCode:  -1,
+				ErrorKind: ErrorKindOther,
+			}, true
+		}
+		target.Output = sink
+	}
+
+	executor := r.Executor
+	if executor == nil {
+		executor = &SSHExecutor{Options: r.Options}
+	}
+
+	// With Graceful, cancellation only keeps hosts from starting
+	runCtx := ctx
+	if r.Graceful {
+		runCtx = context.WithoutCancel(ctx)
+	}
+	hostCtx := runCtx
+	if target.Timeout > 0 {
+		var cancel context.CancelFunc
+		hostCtx, cancel = context.WithTimeout(runCtx, target.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	output, err := executor.Execute(hostCtx, target, hostCommand)
+	if sink != nil {
+		if closeErr := sink.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to write output: %w", closeErr)
+		}
+	}
+	truncated, err := untruncated(err)
+	if err != nil && runCtx.Err() == nil && errors.Is(hostCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("command timed out after %s: %w", target.Timeout, context.DeadlineExceeded)
+	}
+
+	result := Result{
+		Host:      target.Name,
+		Output:    output,
+		Error:     err,
+		Duration:  time.Since(start),
+		ExitCode:  exitCode(err),
+		ErrorKind: ClassifyError(err),
+	}
+	if truncated != nil {
+		result.Truncated = true
+		result.OutputBytes = truncated.Total
+	}
+	r.Budget.Add(result.receivedBytes())
+
+	return result, true
+}
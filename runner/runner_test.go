@@ -0,0 +1,396 @@
+package runner
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"server-manager/runner/sshtest"
+)
+
+// startServer starts s and returns options authenticating with its client
+// key. The server is closed when the test ends.
+func startServer(t *testing.T, s *sshtest.Server) Options {
+	t.Helper()
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	keyPath, err := s.WriteClientKey(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return Options{KeyPath: keyPath, Timeout: 5 * time.Second}
+}
+
+func TestExecuteCommandSuccess(t *testing.T) {
+	var got *sshtest.Request
+	s := &sshtest.Server{Handler: func(req *sshtest.Request) sshtest.Response {
+		got = req
+		return sshtest.Response{Stdout: "hello\n", Stderr: "warning\n"}
+	}}
+	opts := startServer(t, s)
+
+	output, err := ExecuteCommand(context.Background(), "deploy@"+s.Addr(), "echo hello", opts)
+	if err != nil {
+		t.Fatalf("ExecuteCommand: %v", err)
+	}
+	if !strings.Contains(output, "hello\n") || !strings.Contains(output, "warning\n") {
+		t.Errorf("output = %q, want stdout and stderr", output)
+	}
+	if got.User != "deploy" || got.Command != "echo hello" {
+		t.Errorf("server got user %q command %q", got.User, got.Command)
+	}
+}
+
+func TestExecuteCommandNonZeroExit(t *testing.T) {
+	s := &sshtest.Server{Handler: func(*sshtest.Request) sshtest.Response {
+		return sshtest.Response{Stdout: "partial\n", ExitCode: 3}
+	}}
+	opts := startServer(t, s)
+
+	output, err := ExecuteCommand(context.Background(), "root@"+s.Addr(), "false", opts)
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Fatalf("err = %v, want an *ssh.ExitError", err)
+	}
+	if code := exitCode(err); code != 3 {
+		t.Errorf("exit code = %d, want 3", code)
+	}
+	if kind := ClassifyError(err); kind != ErrorKindCommandFailed {
+		t.Errorf("kind = %s, want %s", kind, ErrorKindCommandFailed)
+	}
+	if output != "partial\n" {
+		t.Errorf("output = %q, want the output before the failure", output)
+	}
+}
+
+func TestExecuteCommandAuthFailure(t *testing.T) {
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, err := ssh.NewPublicKey(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &sshtest.Server{AuthorizedKeys: []ssh.PublicKey{authorized}}
+	opts := startServer(t, s)
+
+	_, err = ExecuteCommand(context.Background(), "root@"+s.Addr(), "true", opts)
+	if err == nil {
+		t.Fatal("ExecuteCommand succeeded with an unauthorized key")
+	}
+	if kind := ClassifyError(err); kind != ErrorKindAuthFailed {
+		t.Errorf("kind = %s, want %s (err %v)", kind, ErrorKindAuthFailed, err)
+	}
+	if s.Sessions() != 0 {
+		t.Errorf("server ran %d commands", s.Sessions())
+	}
+}
+
+func TestExecuteCommandConnectTimeout(t *testing.T) {
+	s := &sshtest.Server{HandshakeDelay: time.Second}
+	opts := startServer(t, s)
+	opts.Timeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := ExecuteCommand(context.Background(), "root@"+s.Addr(), "true", opts)
+	if err == nil {
+		t.Fatal("ExecuteCommand succeeded against a stalled handshake")
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("took %s, want about the 100ms timeout", elapsed)
+	}
+	if kind := ClassifyError(err); kind != ErrorKindTimeout {
+		t.Errorf("kind = %s, want %s (err %v)", kind, ErrorKindTimeout, err)
+	}
+}
+
+func TestRunParallelismLimit(t *testing.T) {
+	s := &sshtest.Server{Handler: func(*sshtest.Request) sshtest.Response {
+		return sshtest.Response{Stdout: "ok", Delay: 50 * time.Millisecond}
+	}}
+	opts := startServer(t, s)
+
+	const hosts, parallelism = 12, 3
+	targets := make([]Target, hosts)
+	for i := range targets {
+		targets[i] = Target{Name: "host" + string(rune('a'+i)), Addr: "root@" + s.Addr()}
+	}
+	r := &Runner{Targets: targets, Parallelism: parallelism, Options: opts}
+
+	results, err := r.Run(context.Background(), "uptime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != hosts {
+		t.Fatalf("got %d results, want %d", len(results), hosts)
+	}
+	for _, result := range results {
+		if result.Error != nil {
+			t.Errorf("%s: %v", result.Host, result.Error)
+		}
+	}
+	if max := s.MaxConcurrentSessions(); max > parallelism {
+		t.Errorf("%d sessions ran at once, want at most %d", max, parallelism)
+	}
+	if s.Sessions() != hosts {
+		t.Errorf("server ran %d commands, want %d", s.Sessions(), hosts)
+	}
+}
+
+// blockingExecutor records the goroutine count while parallelism commands
+// are running, then lets them all finish.
+type blockingExecutor struct {
+	mu         sync.Mutex
+	running    int
+	parallel   int
+	goroutines int
+	release    chan struct{}
+}
+
+func (e *blockingExecutor) Execute(ctx context.Context, target Target, command string) (string, error) {
+	e.mu.Lock()
+	e.running++
+	if e.running == e.parallel {
+		if n := runtime.NumGoroutine(); n > e.goroutines {
+			e.goroutines = n
+		}
+		close(e.release)
+		e.release = make(chan struct{})
+	}
+	release := e.release
+	e.mu.Unlock()
+
+	select {
+	case <-release:
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	e.mu.Lock()
+	e.running--
+	e.mu.Unlock()
+	return "ok", nil
+}
+
+func manyTargets(n int) []Target {
+	targets := make([]Target, n)
+	for i := range targets {
+		targets[i] = Target{Name: fmt.Sprintf("host%d", i), Addr: fmt.Sprintf("10.0.%d.%d", i/256%256, i%256)}
+	}
+	return targets
+}
+
+func TestRunBoundedGoroutines(t *testing.T) {
+	const hosts, parallelism = 20000, 16
+	before := runtime.NumGoroutine()
+	executor := &blockingExecutor{parallel: parallelism, release: make(chan struct{})}
+	r := &Runner{Targets: manyTargets(hosts), Parallelism: parallelism, Executor: executor}
+
+	results, err := r.Run(context.Background(), "uptime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != hosts {
+		t.Fatalf("got %d results, want %d", len(results), hosts)
+	}
+	if executor.goroutines == 0 {
+		t.Fatal("parallelism was never reached")
+	}
+	// The workers, the dispatcher and the closer, plus a little slack for the
+	// runtime; nowhere near one per host.
+	if limit := before + parallelism + 8; executor.goroutines > limit {
+		t.Errorf("%d goroutines while running %d hosts, want at most %d", executor.goroutines, hosts, limit)
+	}
+}
+
+func BenchmarkRunManyTargets(b *testing.B) {
+	const hosts, parallelism = 10000, 32
+	targets := manyTargets(hosts)
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		executor := &blockingExecutor{parallel: parallelism, release: make(chan struct{})}
+		r := &Runner{Targets: targets, Parallelism: parallelism, Executor: executor}
+		if _, err := r.Run(context.Background(), "uptime"); err != nil {
+			b.Fatal(err)
+		}
+		b.ReportMetric(float64(executor.goroutines), "goroutines")
+	}
+}
+
+// lineReader produces n bytes of numbered-looking lines without holding them.
+type lineReader struct{ n int64 }
+
+func (r *lineReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = 'a' + byte(i%26)
+		if i%64 == 63 {
+			p[i] = '\n'
+		}
+	}
+	r.n -= int64(len(p))
+	return len(p), nil
+}
+
+// countingSink counts what a target's OutputSink receives.
+type countingSink struct{ n *int64 }
+
+func (s countingSink) Write(p []byte) (int, error) {
+	atomic.AddInt64(s.n, int64(len(p)))
+	return len(p), nil
+}
+
+func (s countingSink) Close() error { return nil }
+
+func TestRunLargeOutputsFlatMemory(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams several hundred MB")
+	}
+
+	const hosts, size, limit = 4, 100 << 20, 1 << 20
+	s := &sshtest.Server{Handler: func(*sshtest.Request) sshtest.Response {
+		return sshtest.Response{StdoutReader: &lineReader{n: size}}
+	}}
+	opts := startServer(t, s)
+	opts.MaxOutputBytes = limit
+
+	targets := make([]Target, hosts)
+	received := make([]int64, hosts)
+	for i := range targets {
+		targets[i] = Target{Name: fmt.Sprintf("host%d", i), Addr: "root@" + s.Addr()}
+	}
+	r := &Runner{
+		Targets:     targets,
+		Parallelism: hosts,
+		Options:     opts,
+		OutputSink: func(target Target, i int) (io.WriteCloser, error) {
+			return countingSink{n: &received[i]}, nil
+		},
+	}
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	baseline := stats.HeapInuse
+
+	var peak uint64
+	done := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				if stats.HeapInuse > peak {
+					peak = stats.HeapInuse
+				}
+			}
+		}
+	}()
+
+	results, err := r.Run(context.Background(), "cat big.log")
+	close(done)
+	<-sampled
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, result := range results {
+		if result.Error != nil {
+			t.Fatalf("%s: %v", result.Host, result.Error)
+		}
+		if !result.Truncated || result.OutputBytes != size || len(result.Output) != limit {
+			t.Errorf("%s: truncated %v, %d of %d bytes kept", result.Host, result.Truncated, len(result.Output), result.OutputBytes)
+		}
+		if received[i] != size {
+			t.Errorf("%s: sink got %d bytes, want %d", result.Host, received[i], size)
+		}
+	}
+	// Each host may hold a couple of output limits plus SSH window buffers;
+	// holding the output would need the full hosts*size.
+	if grown := int64(peak) - int64(baseline); grown > 64<<20 {
+		t.Errorf("heap grew by %d MB streaming %d MB", grown>>20, hosts*size>>20)
+	}
+}
+
+func TestExecuteCommandRejectsBadEnvName(t *testing.T) {
+	s := &sshtest.Server{}
+	opts := startServer(t, s)
+	opts.Env = []EnvVar{{Name: "A;touch /tmp/pwned;B", Value: "x"}}
+	opts.EnvExportFallback = true
+
+	if _, err := ExecuteCommand(context.Background(), "root@"+s.Addr(), "true", opts); err == nil {
+		t.Fatal("ExecuteCommand accepted an invalid env var name")
+	}
+	if s.Sessions() != 0 {
+		t.Errorf("server ran %d commands", s.Sessions())
+	}
+}
+
+// bufferSink collects a target's OutputSink.
+type bufferSink struct{ *strings.Builder }
+
+func (bufferSink) Close() error { return nil }
+
+func TestRunPTYOutputSinkLineEndings(t *testing.T) {
+	s := &sshtest.Server{Handler: func(req *sshtest.Request) sshtest.Response {
+		if !req.PTY {
+			return sshtest.Response{Stderr: "no pty", ExitCode: 1}
+		}
+		return sshtest.Response{Stdout: "one\r\ntwo\r\nprogress 50%\rprogress 100%\r\n"}
+	}}
+	opts := startServer(t, s)
+	opts.PTY = true
+
+	var sink strings.Builder
+	r := &Runner{
+		Targets: []Target{{Name: "web1", Addr: "root@" + s.Addr()}},
+		Options: opts,
+		OutputSink: func(target Target, i int) (io.WriteCloser, error) {
+			return bufferSink{&sink}, nil
+		},
+	}
+	results, err := r.Run(context.Background(), "deploy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Error != nil {
+		t.Fatal(results[0].Error)
+	}
+
+	want := "one\ntwo\nprogress 50%\rprogress 100%\n"
+	if results[0].Output != want {
+		t.Errorf("output = %q, want %q", results[0].Output, want)
+	}
+	if sink.String() != want {
+		t.Errorf("sink got %q, want %q", sink.String(), want)
+	}
+}
@@ -0,0 +1,531 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// DefaultPort is dialed for hosts that don't specify a port.
+const DefaultPort = 22
+
+// ErrPTYDenied is returned when the server refuses to allocate a terminal.
+var ErrPTYDenied = errors.New("server denied PTY request")
+
+// Options holds the settings shared by every host in a run. Keys are offered
+// to the server in order; when empty, the key at KeyPath is loaded instead.
+type Options struct {
+	Keys              []Key
+	KeyPath           string
+	Timeout           time.Duration
+	Env               []EnvVar
+	EnvExportFallback bool
+	// Stdin, when non-nil, is fed to the command's stdin on every host.
+	Stdin []byte
+	// Output, when set, is also written everything the command prints, as
+	// it arrives and before MaxOutputBytes applies.
+	Output            io.Writer
+	PTY               bool
+	PTYRows           int
+	PTYCols           int
+	KeepaliveInterval time.Duration
+	KeepaliveMissed   int
+	// KeyboardInteractive, when set, is tried after the keys.
+	KeyboardInteractive *KeyboardInteractive
+	// TryAllKeys offers each key on a connection of its own, reconnecting
+	// with the next key when one is rejected, for servers whose MaxAuthTries
+	// would give up before the right key comes up. When every key is
+	// rejected the error is an *AuthFailedAllKeys.
+	TryAllKeys bool
+	// ConnectTest, when positive, is how long a bare TCP connect to the host
+	// may take before SSH is tried. Failing it gives ErrConnectionRefused or
+	// ErrHostUnreachable.
+	ConnectTest time.Duration
+	// ConnectLimiter, when set, paces every dial, including reconnects, so
+	// it must be shared by all hosts of a run.
+	ConnectLimiter *RateLimiter
+	// ExecMode is ExecShell (the default when empty) or ExecExec.
+	ExecMode string
+	// RemoteShell, when sh or bash, runs commands in that shell instead of
+	// the login shell. Sudo runs them as root via sudo -n, around the shell.
+	RemoteShell string
+	Sudo        bool
+	// MaxOutputBytes, when positive, caps the output kept per command to
+	// its last MaxOutputBytes; the rest is counted but discarded. With MaxOutputError, such a command
+	// fails with ErrOutputTruncated.
+	MaxOutputBytes int64
+	MaxOutputError bool
+	// Algorithms restricts the handshake to the given algorithms.
+	Algorithms Algorithms
+	// PreferFamily (4 or 6) picks which addresses of a dual-stack host
+	// name are dialed first; 0 leaves it to the resolver.
+	PreferFamily int
+	// Proxy, when set, is the SOCKS5 proxy every connection goes through.
+	// Host names are then resolved by the proxy and PreferFamily is unused.
+	Proxy *url.URL
+	// ForwardAgent, when set, is made available to the command as its
+	// SSH agent. Only set it for hosts trusted with your credentials.
+	ForwardAgent agent.Agent
+	// HostKeyCallback verifies host keys; nil accepts any key.
+	HostKeyCallback ssh.HostKeyCallback
+	// Logger receives per-host lifecycle events at debug level; nil uses
+	// slog.Default().
+	Logger *slog.Logger
+}
+
+func (o Options) logger() *slog.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+
+	return slog.Default()
+}
+
+// ExecuteCommand runs command on the host at addr ([user@]host[:port]) and
+// returns its combined output. Output produced before a failure is kept.
+// Cancelling ctx tears down the connection.
+func ExecuteCommand(ctx context.Context, addr, command string, opts Options) (string, error) {
+	logger := opts.logger().With("host", addr)
+	start := time.Now()
+
+	conn, ka, err := connect(ctx, addr, opts, logger)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	defer ka.Stop()
+
+	output, err := runSession(ctx, conn, ka, command, opts, logger)
+	logger.Debug("Host finished", "duration", time.Since(start))
+
+	return output, err
+}
+
+// connect dials addr and authenticates, and starts keepalives on the
+// connection. The caller stops the keepalives and closes the client.
+func connect(ctx context.Context, addr string, opts Options, logger *slog.Logger) (*ssh.Client, *keepalive, error) {
+	// Load the private key unless the caller already parsed its keys
+	keys := opts.Keys
+	if len(keys) == 0 && opts.KeyPath != "" {
+		loaded, err := LoadKeys([]string{opts.KeyPath})
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = loaded
+	}
+
+	// Certificates may have expired since they were loaded
+	if len(keys) > 0 {
+		valid, err := validKeys(keys, time.Now())
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = valid
+	}
+	var authenticated string
+	signers := make([]ssh.Signer, len(keys))
+	keyPaths := make([]string, len(keys))
+	for i, key := range keys {
+		signers[i] = recordSigner(key.Signer, key.Path, &authenticated)
+		keyPaths[i] = key.Path
+		logger.Debug("Offering private key", "path", key.Path, "cert", key.CertPath, "type", key.Signer.PublicKey().Type(), "fingerprint", ssh.FingerprintSHA256(key.Signer.PublicKey()))
+	}
+
+	// Only offer the methods that were configured
+	var auth []ssh.AuthMethod
+	var methods []string
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+		methods = append(methods, "publickey")
+	}
+	if opts.KeyboardInteractive != nil {
+		auth = append(auth, ssh.KeyboardInteractive(opts.KeyboardInteractive.challenge(logger)))
+		methods = append(methods, "keyboard-interactive")
+	}
+	if len(auth) == 0 {
+		return nil, nil, errors.New("no SSH keys or other authentication configured")
+	}
+
+	// SSH configuration
+	hostKeyCallback := opts.HostKeyCallback
+	if hostKeyCallback == nil {
+		hostKeyCallback = ssh.InsecureIgnoreHostKey()
+	}
+	user, host := splitUserHost(addr)
+	config := &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         opts.Timeout,
+	}
+	opts.Algorithms.apply(config)
+
+	// SSH connection, once the connect rate allows another one
+	dialAddr := buildDialAddr(host, DefaultPort)
+	if waited, err := opts.ConnectLimiter.Wait(ctx); err != nil {
+		return nil, nil, err
+	} else if waited > 0 {
+		logger.Debug("Waited for --connect-rate", "duration", waited)
+	}
+	dialStart := time.Now()
+	if opts.ConnectTest > 0 {
+		if err := connectTest(ctx, dialAddr, opts.ConnectTest, opts); err != nil {
+			logger.Debug("Connect test failed", "addr", dialAddr, "duration", time.Since(dialStart), "error", err)
+			return nil, nil, err
+		}
+		logger.Debug("Connect test passed", "addr", dialAddr, "duration", time.Since(dialStart))
+	}
+	logger.Debug("Dialing", "addr", dialAddr, "user", user, "auth", strings.Join(methods, ","))
+	dialStart = time.Now()
+	var conn *ssh.Client
+	var err error
+	if opts.TryAllKeys && len(signers) > 1 {
+		conn, err = dialEachKey(ctx, dialAddr, config, signers, keyPaths, auth[1:], opts, logger)
+	} else {
+		conn, err = dial(ctx, dialAddr, config, opts.PreferFamily, opts.Proxy)
+	}
+	if err != nil {
+		logger.Debug("Dial failed", "addr", dialAddr, "duration", time.Since(dialStart), "error", err)
+		var allKeys *AuthFailedAllKeys
+		switch {
+		case errors.As(err, &allKeys):
+		case isAuthFailure(err):
+			err = fmt.Errorf("%w (tried keys: %s)", err, strings.Join(keyPaths, ", "))
+		case strings.Contains(err.Error(), "no common algorithm"):
+			err = fmt.Errorf("%w (adjust --ciphers, --kex-algorithms or --host-key-algorithms)", err)
+		}
+		return nil, nil, err
+	}
+	if authenticated != "" {
+		logger.Debug("Authenticated", "key", authenticated)
+	} else {
+		logger.Debug("Authenticated", "method", "keyboard-interactive")
+	}
+	logger.Debug("Connected", "remote", conn.RemoteAddr().String(), "server_version", string(conn.ServerVersion()), "duration", time.Since(dialStart))
+
+	if opts.ForwardAgent != nil {
+		if err := agent.ForwardToAgent(conn, opts.ForwardAgent); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+
+	// Keep the connection alive through idle firewalls
+	return conn, startKeepalive(conn, opts.KeepaliveInterval, opts.KeepaliveMissed), nil
+}
+
+// AuthFailedAllKeys is returned with Options.TryAllKeys when the server
+// rejected every key, each on a connection of its own.
+type AuthFailedAllKeys struct {
+	Paths []string
+	// Err is the error of the last attempt.
+	Err error
+}
+
+func (e *AuthFailedAllKeys) Error() string {
+	return fmt.Sprintf("authentication failed with every key (tried keys: %s): %v", strings.Join(e.Paths, ", "), e.Err)
+}
+
+func (e *AuthFailedAllKeys) Unwrap() error {
+	return e.Err
+}
+
+// dialEachKey dials addr once per key until one authenticates. Only
+// authentication failures move on to the next key, and the other methods
+// in auth are only offered with the last one. Every dial after the first
+// waits for the connect rate again.
+func dialEachKey(ctx context.Context, addr string, config *ssh.ClientConfig, signers []ssh.Signer, paths []string, auth []ssh.AuthMethod, opts Options, logger *slog.Logger) (*ssh.Client, error) {
+	var err error
+	for i, signer := range signers {
+		if i > 0 {
+			if _, err := opts.ConnectLimiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		attempt := *config
+		attempt.Auth = []ssh.AuthMethod{ssh.PublicKeys(signer)}
+		if i == len(signers)-1 {
+			attempt.Auth = append(attempt.Auth, auth...)
+		}
+
+		var conn *ssh.Client
+		conn, err = dial(ctx, addr, &attempt, opts.PreferFamily, opts.Proxy)
+		if err == nil {
+			return conn, nil
+		}
+		if !isAuthFailure(err) {
+			return nil, err
+		}
+		logger.Debug("Key rejected, reconnecting with the next one", "path", paths[i], "error", err)
+	}
+
+	return nil, &AuthFailedAllKeys{Paths: paths, Err: err}
+}
+
+// isAuthFailure reports whether a handshake error means the server rejected
+// the credentials, including servers hanging up after MaxAuthTries.
+func isAuthFailure(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "unable to authenticate") || strings.Contains(msg, "too many authentication failures")
+}
+
+// runSession runs command in a new session on conn. Cancelling ctx closes
+// the session but leaves the connection open for other sessions.
+func runSession(ctx context.Context, conn *ssh.Client, ka *keepalive, command string, opts Options, logger *slog.Logger) (string, error) {
+	command, err := execCommand(command, opts.ExecMode)
+	if err != nil {
+		return "", err
+	}
+	command = wrapCommand(command, opts.RemoteShell, opts.Sudo)
+
+	session, err := conn.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	logger.Debug("Session opened")
+
+	// Tear the session down if the run is cancelled mid-command
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			session.Close()
+		case <-done:
+		}
+	}()
+
+	// Pass environment variables, falling back to exports if sshd refuses them
+	requested := command
+	var rejected []EnvVar
+	for _, v := range opts.Env {
+		if err := ValidateEnvName(v.Name); err != nil {
+			return "", err
+		}
+		// Only the name is logged, values may hold secrets
+		logger.Debug("Setting environment variable", "name", v.Name)
+		if err := session.Setenv(v.Name, v.Value); err != nil {
+			if !opts.EnvExportFallback {
+				return "", fmt.Errorf("server rejected environment variable %s (check AcceptEnv in sshd_config): %w", v.Name, err)
+			}
+			rejected = append(rejected, v)
+		}
+	}
+	if len(rejected) > 0 {
+		command = exportPrefix(rejected) + command
+	}
+
+	// Allocate a terminal for commands that refuse to run without one
+	if opts.PTY {
+		modes := ssh.TerminalModes{
+			ssh.ECHO:          0,
+			ssh.TTY_OP_ISPEED: 14400,
+			ssh.TTY_OP_OSPEED: 14400,
+		}
+		if err := session.RequestPty("xterm-256color", opts.PTYRows, opts.PTYCols, modes); err != nil {
+			return "", fmt.Errorf("%w: %v", ErrPTYDenied, err)
+		}
+	}
+
+	// A refused agent forward is only a warning, the command may not need it
+	if opts.ForwardAgent != nil {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			logger.Warn("Server refused agent forwarding", "error", err)
+		}
+	}
+
+	// Each session writes its own copy. A command that exits without reading
+	// all of it isn't an error, and only holds up its own host
+	var stdinSent chan int64
+	if opts.Stdin != nil {
+		pipe, err := session.StdinPipe()
+		if err != nil {
+			return "", err
+		}
+		stdinSent = make(chan int64, 1)
+		go func() {
+			n, _ := io.Copy(pipe, bytes.NewReader(opts.Stdin))
+			pipe.Close()
+			stdinSent <- n
+		}()
+	}
+
+	// Execute the command, keeping any output produced before a failure
+	// Log the command without the export prefix, which carries env values
+	logger.Debug("Sending command", "command", requested, "exported_env", len(rejected), "pty", opts.PTY)
+	commandStart := time.Now()
+	// Capture through a limited buffer rather than CombinedOutput, so a huge
+	// output is dropped as it arrives instead of being held in memory
+	captured := &limitedBuffer{limit: opts.MaxOutputBytes}
+	var w io.Writer = captured
+	var sink *sinkWriter
+	if opts.Output != nil {
+		sink = &sinkWriter{w: opts.Output}
+		w = io.MultiWriter(captured, sink)
+	}
+	// The terminal translates newlines to CRLF; undo that for the captured
+	// output and the sink alike
+	var crlf *crlfWriter
+	if opts.PTY {
+		crlf = &crlfWriter{w: w}
+		w = crlf
+	}
+	session.Stdout = w
+	session.Stderr = w
+	err = session.Run(command)
+	if crlf != nil {
+		crlf.Flush()
+	}
+	if sink != nil && sink.err != nil && err == nil {
+		err = fmt.Errorf("failed to write output: %w", sink.err)
+	}
+	output := captured.bytes()
+	logger.Debug("Command finished", "bytes", captured.total, "truncated", captured.truncated(), "exit_code", exitCode(err), "duration", time.Since(commandStart))
+	if stdinSent != nil {
+		logger.Debug("Stdin sent", "bytes", <-stdinSent, "of", len(opts.Stdin))
+	}
+	if err != nil {
+		switch {
+		case ctx.Err() != nil:
+			err = ctx.Err()
+		case ka.Lost():
+			err = ErrConnectionLost
+		}
+	}
+	if captured.truncated() {
+		if err == nil && opts.MaxOutputError {
+			err = fmt.Errorf("%w of %d bytes (%d produced)", ErrOutputTruncated, opts.MaxOutputBytes, captured.total)
+		}
+		err = &TruncatedError{Limit: opts.MaxOutputBytes, Total: captured.total, Err: err}
+	}
+
+	return string(output), err
+}
+
+// dial opens an SSH client connection. Both the TCP connect and the SSH
+// handshake are bounded by the connect timeout and by cancellation of ctx.
+func dial(ctx context.Context, addr string, config *ssh.ClientConfig, family int, proxyURL *url.URL) (*ssh.Client, error) {
+	var netConn net.Conn
+	var err error
+	if proxyURL != nil {
+		netConn, err = dialProxy(ctx, proxyURL, addr, config.Timeout)
+	} else {
+		netConn, err = dialTCP(ctx, addr, config.Timeout, family)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Timeout > 0 {
+		netConn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	handshakeDone := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			netConn.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	c, chans, reqs, err := ssh.NewClientConn(netConn, addr, config)
+	close(handshakeDone)
+	if err != nil {
+		netConn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	netConn.SetDeadline(time.Time{})
+
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// lookupIPAddr resolves host names for dialTCP; tests swap in a stub.
+var lookupIPAddr = net.DefaultResolver.LookupIPAddr
+
+// dialTCP connects to addr. With family 4 or 6, a host name's addresses of
+// that family are tried first, falling back to the other family if it has
+// none (so AAAA-only hosts still work with 4 and vice versa).
+func dialTCP(ctx context.Context, addr string, timeout time.Duration, family int) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || family == 0 || net.ParseIP(strings.SplitN(host, "%", 2)[0]) != nil {
+		return dialer.DialContext(ctx, "tcp", addr)
+	}
+
+	ips, err := lookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var preferred, others []net.IPAddr
+	for _, ip := range ips {
+		if (ip.IP.To4() != nil) == (family == 4) {
+			preferred = append(preferred, ip)
+		} else {
+			others = append(others, ip)
+		}
+	}
+
+	var lastErr error
+	for _, ip := range append(preferred, others...) {
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses found for %s", host)
+	}
+
+	return nil, lastErr
+}
+
+// splitUserHost splits an optional "user@" prefix off a host entry.
+func splitUserHost(entry string) (string, string) {
+	if i := strings.LastIndex(entry, "@"); i >= 0 {
+		return entry[:i], entry[i+1:]
+	}
+
+	return "root", entry
+}
+
+// buildDialAddr joins host and port, keeping a port already present in the
+// entry and bracketing IPv6 literals (including zoned link-local ones).
+func buildDialAddr(host string, port int) string {
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		return net.JoinHostPort(h, p)
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+}
+
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitStatus()
+	}
+
+	return -1
+}
@@ -0,0 +1,112 @@
+package runner
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildDialAddr(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{"192.168.1.1", "192.168.1.1:22"},
+		{"192.168.1.1:2222", "192.168.1.1:2222"},
+		{"web1", "web1:22"},
+		{"web1.example.com", "web1.example.com:22"},
+		{"web1.example.com:2222", "web1.example.com:2222"},
+		{"::1", "[::1]:22"},
+		{"2001:db8::10", "[2001:db8::10]:22"},
+		{"fe80::1%eth0", "[fe80::1%eth0]:22"},
+		{"[::1]", "[::1]:22"},
+		{"[::1]:2222", "[::1]:2222"},
+		{"[fe80::1%eth0]:2222", "[fe80::1%eth0]:2222"},
+	}
+	for _, tt := range tests {
+		if got := buildDialAddr(tt.host, 22); got != tt.want {
+			t.Errorf("buildDialAddr(%q, 22) = %s, want %s", tt.host, got, tt.want)
+		}
+	}
+}
+
+// stubResolver makes dialTCP resolve every host name to ips, failing the test
+// if a lookup happens with ips nil.
+func stubResolver(t *testing.T, ips ...string) {
+	t.Helper()
+	orig := lookupIPAddr
+	t.Cleanup(func() { lookupIPAddr = orig })
+	lookupIPAddr = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		if ips == nil {
+			t.Errorf("%s looked up, want it dialed as is", host)
+		}
+		var addrs []net.IPAddr
+		for _, ip := range ips {
+			addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		return addrs, nil
+	}
+}
+
+// listenBoth listens on the same port on 127.0.0.1 and ::1, skipping the test
+// where the sandbox has no IPv6 loopback.
+func listenBoth(t *testing.T) string {
+	t.Helper()
+	v4, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { v4.Close() })
+	_, port, _ := net.SplitHostPort(v4.Addr().String())
+	v6, err := net.Listen("tcp", net.JoinHostPort("::1", port))
+	if err != nil {
+		t.Skipf("no IPv6 loopback on port %s: %v", port, err)
+	}
+	t.Cleanup(func() { v6.Close() })
+
+	return port
+}
+
+func TestDialTCPPreferFamily(t *testing.T) {
+	port := listenBoth(t)
+	portNum, _ := strconv.Atoi(port)
+	tests := []struct {
+		name   string
+		addr   string
+		family int
+		ips    []string
+		want   string
+	}{
+		{name: "dual stack, prefer 4", addr: "dual.example.com", family: 4, ips: []string{"::1", "127.0.0.1"}, want: "127.0.0.1"},
+		{name: "dual stack, prefer 6", addr: "dual.example.com", family: 6, ips: []string{"127.0.0.1", "::1"}, want: "::1"},
+		{name: "AAAA only, prefer 4", addr: "v6only.example.com", family: 4, ips: []string{"::1"}, want: "::1"},
+		{name: "A only, prefer 6", addr: "v4only.example.com", family: 6, ips: []string{"127.0.0.1"}, want: "127.0.0.1"},
+		{name: "bare IPv6 literal", addr: "::1", family: 4, want: "::1"},
+		{name: "bracketed IPv6 literal with port", addr: "[::1]:" + port, family: 4, want: "::1"},
+		{name: "IPv4 literal", addr: "127.0.0.1", family: 6, want: "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubResolver(t, tt.ips...)
+			addr := buildDialAddr(tt.addr, portNum)
+			conn, err := dialTCP(context.Background(), addr, time.Second, tt.family)
+			if err != nil {
+				t.Fatalf("dialTCP(%s, %d): %v", addr, tt.family, err)
+			}
+			defer conn.Close()
+			if got, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); got != tt.want {
+				t.Errorf("dialTCP(%s, %d) connected to %s, want %s", addr, tt.family, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialTCPNoAddresses(t *testing.T) {
+	stubResolver(t, []string{}...)
+	if _, err := dialTCP(context.Background(), "empty.example.com:22", time.Second, 6); err == nil || !strings.Contains(err.Error(), "no addresses") {
+		t.Errorf("err = %v, want no addresses found", err)
+	}
+}
@@ -0,0 +1,304 @@
+// Package sshtest provides an in-process SSH server for exercising the runner
+// without real hosts. Commands are answered by a scriptable Handler.
+package sshtest
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Request describes a command received by the server.
+type Request struct {
+	User    string
+	Command string
+	Env     map[string]string
+	PTY     bool
+	Stdin   io.Reader
+}
+
+// Response is what the server sends back for a command. Delay is slept
+// before anything is written, to simulate slow hosts. StdoutReader, when set,
+// is copied to stdout after Stdout, for outputs too big to hold in memory.
+type Response struct {
+	Stdout       string
+	StdoutReader io.Reader
+	Stderr       string
+	ExitCode     int
+	Delay        time.Duration
+}
+
+// Handler answers a single command.
+type Handler func(req *Request) Response
+
+// Server is an SSH server listening on a random loopback port. Zero values
+// are filled in by Start: a fresh host key, and a client key that is the only
+// one accepted.
+type Server struct {
+	Handler        Handler
+	HostKey        ssh.Signer
+	ClientKey      ssh.Signer
+	AuthorizedKeys []ssh.PublicKey
+	// KeyboardInteractive, when set, also allows keyboard-interactive auth,
+	// e.g. for devices without public key support.
+	KeyboardInteractive func(user string, client ssh.KeyboardInteractiveChallenge) error
+	// HandshakeDelay stalls new connections before the SSH handshake, to
+	// simulate hosts that accept TCP but never answer.
+	HandshakeDelay time.Duration
+
+	listener  net.Listener
+	clientPEM []byte
+	wg        sync.WaitGroup
+
+	mu        sync.Mutex
+	sessions  int
+	active    int
+	maxActive int
+}
+
+// Start generates any missing keys and starts accepting connections.
+func (s *Server) Start() error {
+	if s.Handler == nil {
+		s.Handler = func(*Request) Response { return Response{} }
+	}
+
+	if s.HostKey == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		if s.HostKey, err = ssh.NewSignerFromKey(key); err != nil {
+			return err
+		}
+	}
+
+	if s.ClientKey == nil {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return err
+		}
+		if s.ClientKey, err = ssh.NewSignerFromKey(key); err != nil {
+			return err
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return err
+		}
+		s.clientPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	}
+	if s.AuthorizedKeys == nil {
+		s.AuthorizedKeys = []ssh.PublicKey{s.ClientKey.PublicKey()}
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	s.wg.Add(1)
+	go s.serve()
+
+	return nil
+}
+
+// Addr is the host:port the server listens on.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// WriteClientKey writes the generated client private key into dir and
+// returns its path, for use as the runner's KeyPath.
+func (s *Server) WriteClientKey(dir string) (string, error) {
+	if s.clientPEM == nil {
+		return "", errors.New("sshtest: client key was not generated by the server")
+	}
+
+	path := filepath.Join(dir, "id_sshtest")
+	return path, ioutil.WriteFile(path, s.clientPEM, 0600)
+}
+
+// Sessions returns the number of commands executed so far.
+func (s *Server) Sessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.sessions
+}
+
+// MaxConcurrentSessions returns the highest number of commands that were
+// running at the same time.
+func (s *Server) MaxConcurrentSessions() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.maxActive
+}
+
+// Close stops the server and waits for its goroutines to exit.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			for _, authorized := range s.AuthorizedKeys {
+				if string(authorized.Marshal()) == string(key.Marshal()) {
+					return nil, nil
+				}
+			}
+			return nil, fmt.Errorf("sshtest: unknown public key for %s", meta.User())
+		},
+	}
+	if s.KeyboardInteractive != nil {
+		config.KeyboardInteractiveCallback = func(meta ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			return nil, s.KeyboardInteractive(meta.User(), client)
+		}
+	}
+	config.AddHostKey(s.HostKey)
+
+	var conns sync.WaitGroup
+	defer conns.Wait()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		conns.Add(1)
+		go func() {
+			defer conns.Done()
+			s.handleConn(conn, config)
+		}()
+	}
+}
+
+func (s *Server) handleConn(conn net.Conn, config *ssh.ServerConfig) {
+	defer conn.Close()
+
+	if s.HandshakeDelay > 0 {
+		time.Sleep(s.HandshakeDelay)
+	}
+
+	serverConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer serverConn.Close()
+
+	// Answer global requests such as keepalives
+	go func() {
+		for req := range reqs {
+			if req.WantReply {
+				req.Reply(req.Type == "keepalive@openssh.com", nil)
+			}
+		}
+	}()
+
+	var sessions sync.WaitGroup
+	defer sessions.Wait()
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only session channels are supported")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		sessions.Add(1)
+		go func() {
+			defer sessions.Done()
+			s.handleSession(serverConn.User(), channel, requests)
+		}()
+	}
+}
+
+func (s *Server) handleSession(user string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	req := &Request{User: user, Env: make(map[string]string), Stdin: channel}
+	for r := range requests {
+		switch r.Type {
+		case "env":
+			var payload struct{ Name, Value string }
+			if err := ssh.Unmarshal(r.Payload, &payload); err != nil {
+				r.Reply(false, nil)
+				continue
+			}
+			req.Env[payload.Name] = payload.Value
+			r.Reply(true, nil)
+		case "pty-req":
+			req.PTY = true
+			r.Reply(true, nil)
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(r.Payload, &payload); err != nil {
+				r.Reply(false, nil)
+				return
+			}
+			r.Reply(true, nil)
+
+			req.Command = payload.Command
+			s.exec(channel, req)
+			return
+		default:
+			if r.WantReply {
+				r.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func (s *Server) exec(channel ssh.Channel, req *Request) {
+	s.mu.Lock()
+	s.sessions++
+	s.active++
+	if s.active > s.maxActive {
+		s.maxActive = s.active
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+
+	resp := s.Handler(req)
+	if resp.Delay > 0 {
+		time.Sleep(resp.Delay)
+	}
+
+	io.WriteString(channel, resp.Stdout)
+	if resp.StdoutReader != nil {
+		io.Copy(channel, resp.StdoutReader)
+	}
+	io.WriteString(channel.Stderr(), resp.Stderr)
+
+	status := make([]byte, 4)
+	binary.BigEndian.PutUint32(status, uint32(resp.ExitCode))
+	channel.SendRequest("exit-status", false, status)
+}
@@ -0,0 +1,141 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ParseCommandTemplate parses a command template without rendering it, which
+// is enough to catch syntax errors before any host is contacted.
+func ParseCommandTemplate(tmpl string) (*template.Template, error) {
+	return template.New("command").Option("missingkey=error").Parse(tmpl)
+}
+
+// RenderCommand expands the command template with the given variables,
+// available both as {{.name}} and as {{.Vars.name}}. Referencing an
+// undefined variable is an error.
+func RenderCommand(tmpl string, vars map[string]string) (string, error) {
+	return renderTemplate(tmpl, nil, vars)
+}
+
+// TargetBuiltins returns the built-in template variables for target, the
+// index-th (0-based) of total targets:
+//
+//	Host     the host entry as configured
+//	Address  the resolved host name or IP that is dialed
+//	Port     the port that is dialed
+//	User     the SSH user
+//	Index    the 1-based position of the host in the run
+//	Total    the number of hosts in the run
+//	Groups   the groups the host belongs to
+func TargetBuiltins(target Target, index, total int) map[string]interface{} {
+	user, host := splitUserHost(target.Addr)
+	address, port := host, DefaultPort
+	if h, p, err := net.SplitHostPort(buildDialAddr(host, DefaultPort)); err == nil {
+		address = h
+		port, _ = strconv.Atoi(p)
+	}
+	groups := target.Groups
+	if groups == nil {
+		groups = []string{}
+	}
+
+	return map[string]interface{}{
+		"Host":    target.Name,
+		"Address": address,
+		"Port":    port,
+		"User":    user,
+		"Index":   index + 1,
+		"Total":   total,
+		"Groups":  groups,
+	}
+}
+
+// renderTemplate executes tmpl with the built-ins and vars at the top level,
+// user vars shadowing built-ins of the same name, and vars also under .Vars.
+func renderTemplate(tmpl string, builtins map[string]interface{}, vars map[string]string) (string, error) {
+	t, err := ParseCommandTemplate(tmpl)
+	if err != nil {
+		return "", err
+	}
+
+	data := make(map[string]interface{}, len(builtins)+len(vars)+1)
+	for name, value := range builtins {
+		data[name] = value
+	}
+	for name, value := range vars {
+		data[name] = value
+	}
+	if _, ok := data["Vars"]; !ok {
+		data["Vars"] = vars
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// ReadVarsFile reads template variables from a JSON or YAML file, picked by
+// the file extension. Top-level keys are variable names; scalar values are
+// converted to strings.
+func ReadVarsFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		// Keep numbers as written instead of going through float64
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		err = decoder.Decode(&raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return nil, fmt.Errorf("unsupported vars file extension %q (expected .json, .yaml or .yml)", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	vars := make(map[string]string, len(raw))
+	for name, value := range raw {
+		switch value.(type) {
+		case map[interface{}]interface{}, map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("variable %q must be a scalar", name)
+		case nil:
+			vars[name] = ""
+		default:
+			vars[name] = fmt.Sprint(value)
+		}
+	}
+
+	return vars, nil
+}
+
+// mergeVars combines template variables from all levels. Host vars override
+// file vars, and flag vars override both.
+func mergeVars(fileVars, hostVars, flagVars map[string]string) map[string]string {
+	vars := make(map[string]string, len(fileVars)+len(hostVars)+len(flagVars))
+	for _, level := range []map[string]string{fileVars, hostVars, flagVars} {
+		for name, value := range level {
+			vars[name] = value
+		}
+	}
+
+	return vars
+}
@@ -0,0 +1,66 @@
+package runner
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeVars(t *testing.T) {
+	tests := []struct {
+		name                         string
+		fileVars, hostVars, flagVars map[string]string
+		want                         map[string]string
+	}{
+		{
+			name: "all empty",
+			want: map[string]string{},
+		},
+		{
+			name:     "file only",
+			fileVars: map[string]string{"env": "prod", "region": "eu"},
+			want:     map[string]string{"env": "prod", "region": "eu"},
+		},
+		{
+			name:     "host overrides file",
+			fileVars: map[string]string{"env": "prod", "region": "eu"},
+			hostVars: map[string]string{"region": "us"},
+			want:     map[string]string{"env": "prod", "region": "us"},
+		},
+		{
+			name:     "flag overrides file",
+			fileVars: map[string]string{"env": "prod"},
+			flagVars: map[string]string{"env": "stage"},
+			want:     map[string]string{"env": "stage"},
+		},
+		{
+			name:     "flag overrides host and file",
+			fileVars: map[string]string{"env": "prod", "region": "eu", "tier": "web"},
+			hostVars: map[string]string{"region": "us", "tier": "db"},
+			flagVars: map[string]string{"tier": "cache"},
+			want:     map[string]string{"env": "prod", "region": "us", "tier": "cache"},
+		},
+		{
+			name:     "empty value still overrides",
+			hostVars: map[string]string{"env": "prod"},
+			flagVars: map[string]string{"env": ""},
+			want:     map[string]string{"env": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mergeVars(tt.fileVars, tt.hostVars, tt.flagVars)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeVars() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeVarsLeavesInputsAlone(t *testing.T) {
+	fileVars := map[string]string{"env": "prod"}
+	mergeVars(fileVars, map[string]string{"env": "stage"}, nil)
+	if fileVars["env"] != "prod" {
+		t.Errorf("file vars changed to %v", fileVars)
+	}
+}
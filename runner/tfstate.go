@@ -0,0 +1,147 @@
+package runner
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+// DefaultTerraformResourceTypes are the compute resources hosts are taken
+// from when TerraformStateParser.ResourceTypes is empty.
+var DefaultTerraformResourceTypes = []string{
+	"aws_instance",
+	"google_compute_instance",
+	"azurerm_linux_virtual_machine",
+}
+
+// TerraformStateParser builds a host list from a Terraform state file
+// (format version 4). Each instance contributes its public IP, or its private
+// IP when it has no public one; instances with neither, e.g. still being
+// created, are skipped with a warning. The resource address is available to
+// the command template as {{.tf_address}}.
+type TerraformStateParser struct {
+	ResourceTypes []string
+	// Logger receives the skipped instances; nil uses slog.Default().
+	Logger *slog.Logger
+}
+
+type tfState struct {
+	Version   int          `json:"version"`
+	Resources []tfResource `json:"resources"`
+}
+
+type tfResource struct {
+	Module    string       `json:"module"`
+	Mode      string       `json:"mode"`
+	Type      string       `json:"type"`
+	Name      string       `json:"name"`
+	Instances []tfInstance `json:"instances"`
+}
+
+type tfInstance struct {
+	IndexKey   interface{}            `json:"index_key"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+func (p *TerraformStateParser) Parse(data []byte) ([]HostEntry, error) {
+	state := tfState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.Version != 4 {
+		return nil, fmt.Errorf("unsupported Terraform state version %d (expected 4)", state.Version)
+	}
+
+	types := p.ResourceTypes
+	if len(types) == 0 {
+		types = DefaultTerraformResourceTypes
+	}
+	wanted := make(map[string]bool)
+	for _, t := range types {
+		wanted[t] = true
+	}
+
+	logger := p.Logger
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	var hosts []HostEntry
+	for _, resource := range state.Resources {
+		if resource.Mode != "managed" || !wanted[resource.Type] {
+			continue
+		}
+		for _, instance := range resource.Instances {
+			address := resource.address(instance.IndexKey)
+			ip := instanceIP(resource.Type, instance.Attributes)
+			if ip == "" {
+				logger.Warn("Skipping Terraform resource without a public or private IP", "resource", address)
+				continue
+			}
+			hosts = append(hosts, HostEntry{
+				Host: ip,
+				Vars: map[string]string{"tf_address": address},
+			})
+		}
+	}
+	if len(hosts) == 0 {
+		return nil, errors.New("no matching resources in Terraform state")
+	}
+
+	return hosts, nil
+}
+
+// address renders the resource address as Terraform prints it, e.g.
+// module.web.aws_instance.app[0].
+func (r tfResource) address(indexKey interface{}) string {
+	address := r.Type + "." + r.Name
+	if r.Module != "" {
+		address = r.Module + "." + address
+	}
+	switch key := indexKey.(type) {
+	case float64:
+		address += fmt.Sprintf("[%d]", int(key))
+	case string:
+		address += fmt.Sprintf("[%q]", key)
+	}
+
+	return address
+}
+
+func instanceIP(resourceType string, attrs map[string]interface{}) string {
+	switch resourceType {
+	case "google_compute_instance":
+		// network_interface[0].access_config[0].nat_ip, else .network_ip
+		iface := firstObject(attrs["network_interface"])
+		if ip := stringAttr(firstObject(iface["access_config"]), "nat_ip"); ip != "" {
+			return ip
+		}
+		return stringAttr(iface, "network_ip")
+	case "azurerm_linux_virtual_machine":
+		if ip := stringAttr(attrs, "public_ip_address"); ip != "" {
+			return ip
+		}
+		return stringAttr(attrs, "private_ip_address")
+	default:
+		if ip := stringAttr(attrs, "public_ip"); ip != "" {
+			return ip
+		}
+		return stringAttr(attrs, "private_ip")
+	}
+}
+
+func firstObject(v interface{}) map[string]interface{} {
+	list, _ := v.([]interface{})
+	if len(list) == 0 {
+		return nil
+	}
+	obj, _ := list[0].(map[string]interface{})
+
+	return obj
+}
+
+func stringAttr(attrs map[string]interface{}, name string) string {
+	s, _ := attrs[name].(string)
+	return s
+}
@@ -0,0 +1,58 @@
+package runner
+
+import (
+	"bytes"
+	"log/slog"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTFState = `{
+  "version": 4,
+  "resources": [
+    {"mode": "managed", "type": "aws_instance", "name": "web", "instances": [
+      {"index_key": 0, "attributes": {"public_ip": "203.0.113.10", "private_ip": "10.0.0.10"}},
+      {"index_key": 1, "attributes": {"public_ip": "", "private_ip": "10.0.0.11"}},
+      {"index_key": 2, "attributes": {"public_ip": "", "private_ip": ""}}
+    ]},
+    {"module": "module.db", "mode": "managed", "type": "google_compute_instance", "name": "db", "instances": [
+      {"index_key": "primary", "attributes": {"network_interface": [{"network_ip": "10.1.0.5", "access_config": []}]}}
+    ]},
+    {"mode": "data", "type": "aws_instance", "name": "lookup", "instances": [
+      {"attributes": {"public_ip": "198.51.100.1"}}
+    ]}
+  ]
+}`
+
+func TestTerraformStateParser(t *testing.T) {
+	var logs bytes.Buffer
+	p := &TerraformStateParser{Logger: slog.New(slog.NewTextHandler(&logs, nil))}
+
+	hosts, err := p.Parse([]byte(testTFState))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []HostEntry{
+		{Host: "203.0.113.10", Vars: map[string]string{"tf_address": "aws_instance.web[0]"}},
+		{Host: "10.0.0.11", Vars: map[string]string{"tf_address": "aws_instance.web[1]"}},
+		{Host: "10.1.0.5", Vars: map[string]string{"tf_address": `module.db.google_compute_instance.db["primary"]`}},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("Parse() = %+v, want %+v", hosts, want)
+	}
+	if !strings.Contains(logs.String(), "aws_instance.web[2]") {
+		t.Errorf("no warning for the instance without an IP, logged %q", logs.String())
+	}
+}
+
+func TestTerraformStateParserNothingUsable(t *testing.T) {
+	p := &TerraformStateParser{Logger: slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil))}
+	state := `{"version": 4, "resources": [{"mode": "managed", "type": "aws_instance", "name": "web", "instances": [{"attributes": {}}]}]}`
+	if _, err := p.Parse([]byte(state)); err == nil {
+		t.Error("Parse() succeeded without any usable instance")
+	}
+	if _, err := p.Parse([]byte(`{"version": 3}`)); err == nil {
+		t.Error("Parse() accepted state version 3")
+	}
+}
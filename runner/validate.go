@@ -0,0 +1,190 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// validateLookups is how many host names ValidateConfig resolves at once.
+const validateLookups = 16
+
+// ValidationError is a problem found in a config before anything runs. Host
+// is empty for problems not tied to one host.
+type ValidationError struct {
+	Host string
+	Err  error
+}
+
+func (e ValidationError) Error() string {
+	if e.Host == "" {
+		return e.Err.Error()
+	}
+
+	return e.Host + ": " + e.Err.Error()
+}
+
+func (e ValidationError) Unwrap() error {
+	return e.Err
+}
+
+// LookupFunc resolves a host name, like net.Resolver.LookupHost.
+type LookupFunc func(ctx context.Context, host string) ([]string, error)
+
+// ValidateConfig checks cfg without connecting to any host: every address
+// must be a valid IP or host name, with a valid port and user, host names
+// must resolve with lookup (unless opts.Proxy resolves them, or lookup is
+// nil), and the key files of opts and of the hosts must be readable. It
+// returns every problem found, in host order.
+func ValidateConfig(cfg *Config, opts Options, lookup LookupFunc) []ValidationError {
+	var problems []ValidationError
+	if opts.KeyPath != "" && len(opts.Keys) == 0 {
+		if err := checkReadable(opts.KeyPath); err != nil {
+			problems = append(problems, ValidationError{Err: fmt.Errorf("key: %w", err)})
+		}
+	}
+
+	dialAddrs := make([]string, len(cfg.Hosts))
+	for i, entry := range cfg.Hosts {
+		dialAddrs[i] = entry.DialAddr()
+	}
+	addrs, err := ExpandAliases(dialAddrs, cfg.Aliases)
+	if err != nil {
+		return append(problems, ValidationError{Err: err})
+	}
+
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	hostProblems := make([][]error, len(cfg.Hosts))
+	slots := make(chan struct{}, validateLookups)
+	var wg sync.WaitGroup
+	for i, entry := range cfg.Hosts {
+		for _, path := range []string{entry.Key, entry.Cert} {
+			if path == "" || path == "-" || strings.HasPrefix(path, "env:") {
+				continue
+			}
+			if err := checkReadable(path); err != nil {
+				hostProblems[i] = append(hostProblems[i], err)
+			}
+		}
+
+		host, err := checkAddr(ApplyAddrDefaults(addrs[i], cfg.Defaults.User, cfg.Defaults.Port))
+		if err != nil {
+			hostProblems[i] = append(hostProblems[i], err)
+			continue
+		}
+		if net.ParseIP(host) != nil || opts.Proxy != nil || lookup == nil {
+			continue
+		}
+
+		// Resolve names concurrently, a slow resolver would otherwise add up
+		wg.Add(1)
+		go func(i int, host string) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			if _, err := lookup(ctx, host); err != nil {
+				hostProblems[i] = append(hostProblems[i], err)
+			}
+		}(i, host)
+	}
+	wg.Wait()
+
+	for i, errs := range hostProblems {
+		for _, err := range errs {
+			problems = append(problems, ValidationError{Host: cfg.Hosts[i].Host, Err: err})
+		}
+	}
+
+	return problems
+}
+
+// ValidateCommand renders command for every target without running it, so
+// variables no target defines are all reported before any host is contacted.
+func (r *Runner) ValidateCommand(command string) []ValidationError {
+	if _, err := ParseCommandTemplate(command); err != nil {
+		return []ValidationError{{Err: err}}
+	}
+
+	var problems []ValidationError
+	for i, target := range r.Targets {
+		if _, err := r.Render(i, command); err != nil {
+			problems = append(problems, ValidationError{Host: target.Name, Err: err})
+		}
+	}
+
+	return problems
+}
+
+// checkAddr checks a [user@]host[:port] address and returns its host, with
+// the brackets and zone of IPv6 literals removed.
+func checkAddr(addr string) (string, error) {
+	user, hostPort := splitUserHost(addr)
+	if user == "" {
+		return "", fmt.Errorf("empty user in %q", addr)
+	}
+	host, port, err := net.SplitHostPort(buildDialAddr(hostPort, DefaultPort))
+	if err != nil {
+		return "", fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	if i := strings.LastIndex(host, "%"); i >= 0 && net.ParseIP(host[:i]) != nil {
+		return host[:i], nil
+	}
+	if net.ParseIP(host) == nil && !validHostname(host) {
+		return "", fmt.Errorf("invalid host name %q", host)
+	}
+
+	return host, nil
+}
+
+// validHostname reports whether name is a syntactically valid DNS name.
+// Underscores are allowed, as plenty of internal names have them.
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// checkReadable opens path, expanding a leading ~, to see that it can be read.
+func checkReadable(path string) error {
+	if strings.HasPrefix(path, "~") {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return err
+		}
+		path = filepath.Join(home, path[1:])
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,85 @@
+package runner
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// stubLookup resolves only the names in known.
+func stubLookup(known ...string) LookupFunc {
+	return func(ctx context.Context, host string) ([]string, error) {
+		for _, name := range known {
+			if host == name {
+				return []string{"192.0.2.1"}, nil
+			}
+		}
+		return nil, errors.New("no such host")
+	}
+}
+
+func TestValidateConfigAggregates(t *testing.T) {
+	missingKey := filepath.Join(t.TempDir(), "missing_ed25519")
+	cfg := &Config{Hosts: []HostEntry{
+		{Host: "web1.example.com"},
+		{Host: "web_-bad!.example.com"},
+		{Host: "db1.example.com", Key: missingKey},
+		{Host: "gone.example.com"},
+		{Host: "10.0.0.5:99999"},
+		{Host: "[::1]:2222"},
+	}}
+
+	problems := ValidateConfig(cfg, Options{KeyPath: filepath.Join(t.TempDir(), "id_missing")}, stubLookup("web1.example.com", "db1.example.com"))
+	want := []struct{ host, err string }{
+		{"", "key: "},
+		{"web_-bad!.example.com", "invalid host name"},
+		{"db1.example.com", "missing_ed25519"},
+		{"gone.example.com", "no such host"},
+		{"10.0.0.5:99999", "invalid port"},
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("got %d problems, want %d: %v", len(problems), len(want), problems)
+	}
+	for i, w := range want {
+		if problems[i].Host != w.host || !strings.Contains(problems[i].Err.Error(), w.err) {
+			t.Errorf("problem %d = %v, want host %q and %q", i, problems[i], w.host, w.err)
+		}
+	}
+}
+
+func TestValidateConfigWithoutLookups(t *testing.T) {
+	cfg := &Config{Hosts: []HostEntry{{Host: "gone.example.com"}, {Host: "bad name"}}}
+
+	problems := ValidateConfig(cfg, Options{}, nil)
+	if len(problems) != 1 || problems[0].Host != "bad name" {
+		t.Errorf("problems = %v, want only the invalid name", problems)
+	}
+}
+
+func TestValidateCommandUndefinedVariable(t *testing.T) {
+	r := &Runner{
+		Targets: []Target{
+			{Name: "web1", Addr: "web1", Vars: map[string]string{"service": "nginx"}},
+			{Name: "web2", Addr: "web2"},
+			{Name: "web3", Addr: "web3"},
+		},
+	}
+
+	problems := r.ValidateCommand("systemctl restart {{.service}}")
+	if len(problems) != 2 || problems[0].Host != "web2" || problems[1].Host != "web3" {
+		t.Fatalf("problems = %v, want web2 and web3", problems)
+	}
+	if !strings.Contains(problems[0].Error(), "service") {
+		t.Errorf("problem %q doesn't name the variable", problems[0].Error())
+	}
+
+	r.DefaultVars = map[string]string{"service": "apache2"}
+	if problems := r.ValidateCommand("systemctl restart {{.service}}"); len(problems) != 0 {
+		t.Errorf("problems = %v with a default for the variable", problems)
+	}
+	if problems := r.ValidateCommand("{{.service"); len(problems) != 1 || problems[0].Host != "" {
+		t.Errorf("problems = %v, want one syntax error", problems)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "sort"
+
+// Keys accepted by --sort-output.
+var sortKeys = []string{"host", "duration", "status", "config"}
+
+// sortResults returns results ordered by key: host names lexicographically,
+// duration shortest first, status with failures last, or config by their
+// position in order (the hosts' order in the config file). Ties keep the
+// order results arrived in, and "status" orders each half by host.
+func sortResults(results []CommandResult, key string, order map[string]int) []CommandResult {
+	sorted := append([]CommandResult(nil), results...)
+
+	var less func(a, b CommandResult) bool
+	switch key {
+	case "duration":
+		less = func(a, b CommandResult) bool { return a.Duration < b.Duration }
+	case "status":
+		less = func(a, b CommandResult) bool {
+			if failedA, failedB := a.Error != nil, b.Error != nil; failedA != failedB {
+				return failedB
+			}
+			return a.Host < b.Host
+		}
+	case "config":
+		less = func(a, b CommandResult) bool { return order[a.Host] < order[b.Host] }
+	default:
+		less = func(a, b CommandResult) bool { return a.Host < b.Host }
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+
+	return sorted
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"server-manager/runner"
+)
+
+// RunState records the outcome of the last run per host, so a later run can
+// retry only the hosts that failed.
+type RunState struct {
+	Command   string               `json:"command"`
+	Timestamp time.Time            `json:"timestamp"`
+	Hosts     map[string]HostState `json:"hosts"`
+}
+
+type HostState struct {
+	Status    string    `json:"status"`
+	ExitCode  int       `json:"exit_code"`
+	Error     string    `json:"error,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+func NewRunState(command string) *RunState {
+	return &RunState{
+		Command:   command,
+		Timestamp: time.Now(),
+		Hosts:     make(map[string]HostState),
+	}
+}
+
+// LoadRunState reads a state file written by a previous run.
+func LoadRunState(path string) (*RunState, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errors.New("no state file from a previous run at " + path)
+		}
+		return nil, err
+	}
+
+	state := &RunState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.Hosts == nil {
+		state.Hosts = make(map[string]HostState)
+	}
+
+	return state, nil
+}
+
+// Record stores the outcome for a host, replacing any earlier one.
+func (s *RunState) Record(r CommandResult) {
+	hostState := HostState{
+		Status:    "ok",
+		ExitCode:  r.ExitCode,
+		Timestamp: time.Now(),
+	}
+	if r.Error != nil {
+		hostState.Status = "failed"
+		hostState.Error = r.Error.Error()
+	}
+
+	s.Hosts[r.Host] = hostState
+}
+
+// FailedHosts returns the hosts whose last recorded outcome was a failure.
+func (s *RunState) FailedHosts() []string {
+	var hosts []string
+	for host, hostState := range s.Hosts {
+		if hostState.Status != "ok" {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+
+	return hosts
+}
+
+// Save writes the state atomically so concurrent runs never see a torn file.
+func (s *RunState) Save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return runner.WriteFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// selectFailedHosts narrows entries down to the given hosts, keeping their
+// config (vars, etc.) where the host is still listed.
+func selectFailedHosts(entries []runner.HostEntry, failed []string) []runner.HostEntry {
+	known := make(map[string]runner.HostEntry)
+	for _, entry := range entries {
+		known[entry.Host] = entry
+	}
+
+	selected := make([]runner.HostEntry, 0, len(failed))
+	for _, host := range failed {
+		entry, ok := known[host]
+		if !ok {
+			entry = runner.HostEntry{Host: host}
+		}
+		selected = append(selected, entry)
+	}
+
+	return selected
+}
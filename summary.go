@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"server-manager/runner"
+)
+
+// Summary is the overall outcome of a run.
+type Summary struct {
+	Command     string
+	Total       int
+	Succeeded   int
+	Failed      int
+	Excluded    int
+	Unhealthy   int
+	Duplicates  int
+	LimitedFrom int
+	Interrupted bool
+	Duration    time.Duration
+	FailedHosts []string
+	// FailedByKind lists the failed hosts by the kind of their error.
+	FailedByKind map[runner.ErrorKind][]string
+	// Expectations is set when --expect or --expect-not is checked; hosts
+	// that ran are then split into those that met them and those that didn't.
+	Expectations      bool
+	ExpectPassed      int
+	ExpectFailedHosts []string
+}
+
+func (s *Summary) Add(r CommandResult) {
+	s.Total++
+	if r.Error != nil {
+		s.Failed++
+		s.FailedHosts = append(s.FailedHosts, r.Host)
+		kind := r.ErrorKind
+		if kind == "" {
+			kind = runner.ClassifyError(r.Error)
+		}
+		if s.FailedByKind == nil {
+			s.FailedByKind = make(map[runner.ErrorKind][]string)
+		}
+		s.FailedByKind[kind] = append(s.FailedByKind[kind], r.Host)
+	} else {
+		s.Succeeded++
+	}
+
+	if s.Expectations {
+		switch {
+		case r.Error == nil:
+			s.ExpectPassed++
+		case errors.Is(r.Error, ErrExpectationFailed):
+			s.ExpectFailedHosts = append(s.ExpectFailedHosts, r.Host)
+		}
+	}
+}
+
+func (s Summary) String() string {
+	parts := []string{
+		fmt.Sprintf("%d hosts", s.Total),
+		fmt.Sprintf("%d succeeded", s.Succeeded),
+		fmt.Sprintf("%d failed", s.Failed),
+	}
+	for _, kind := range s.failureKinds() {
+		hosts := s.FailedByKind[kind]
+		parts = append(parts, fmt.Sprintf("%s: %d (%s)", kind, len(hosts), strings.Join(hosts, ", ")))
+	}
+	if s.Excluded > 0 {
+		parts = append(parts, fmt.Sprintf("excluded: %d", s.Excluded))
+	}
+	if s.Unhealthy > 0 {
+		parts = append(parts, fmt.Sprintf("skipped as unhealthy: %d", s.Unhealthy))
+	}
+	if s.Duplicates > 0 {
+		parts = append(parts, fmt.Sprintf("duplicates dropped: %d", s.Duplicates))
+	}
+	if s.LimitedFrom > 0 {
+		parts = append(parts, fmt.Sprintf("limited to %d of %d hosts", s.Total, s.LimitedFrom))
+	}
+	if s.Expectations {
+		expect := fmt.Sprintf("expectations: %d passed, %d failed", s.ExpectPassed, len(s.ExpectFailedHosts))
+		if len(s.ExpectFailedHosts) > 0 {
+			expect += " (" + strings.Join(s.ExpectFailedHosts, ", ") + ")"
+		}
+		parts = append(parts, expect)
+	}
+
+	text := strings.Join(parts, ", ") + fmt.Sprintf(" in %s", s.Duration.Round(time.Millisecond))
+	if s.Interrupted {
+		text += " [interrupted]"
+	}
+
+	return text
+}
+
+// LogValue logs the summary as a group of attributes.
+func (s Summary) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.Int("hosts", s.Total),
+		slog.Int("succeeded", s.Succeeded),
+		slog.Int("failed", s.Failed),
+	}
+	if len(s.FailedByKind) > 0 {
+		var kinds []any
+		for _, kind := range s.failureKinds() {
+			kinds = append(kinds, slog.Int(string(kind), len(s.FailedByKind[kind])))
+		}
+		attrs = append(attrs, slog.Group("failed_by_kind", kinds...))
+	}
+	if s.Excluded > 0 {
+		attrs = append(attrs, slog.Int("excluded", s.Excluded))
+	}
+	if s.Unhealthy > 0 {
+		attrs = append(attrs, slog.Int("unhealthy", s.Unhealthy))
+	}
+	if s.Duplicates > 0 {
+		attrs = append(attrs, slog.Int("duplicates", s.Duplicates))
+	}
+	if s.LimitedFrom > 0 {
+		attrs = append(attrs, slog.Int("limited_from", s.LimitedFrom))
+	}
+	if s.Expectations {
+		attrs = append(attrs, slog.Group("expect",
+			slog.Int("passed", s.ExpectPassed),
+			slog.Int("failed", len(s.ExpectFailedHosts)),
+			slog.String("failed_hosts", strings.Join(s.ExpectFailedHosts, ",")),
+		))
+	}
+	if s.Interrupted {
+		attrs = append(attrs, slog.Bool("interrupted", true))
+	}
+	attrs = append(attrs, slog.Duration("duration", s.Duration.Round(time.Millisecond)))
+
+	return slog.GroupValue(attrs...)
+}
+
+// failureKinds returns the kinds of error hosts failed with, the most
+// common first.
+func (s Summary) failureKinds() []runner.ErrorKind {
+	kinds := make([]runner.ErrorKind, 0, len(s.FailedByKind))
+	for kind := range s.FailedByKind {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if a, b := len(s.FailedByKind[kinds[i]]), len(s.FailedByKind[kinds[j]]); a != b {
+			return a > b
+		}
+		return kinds[i] < kinds[j]
+	})
+
+	return kinds
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultSyslogTag = "server-manager"
+
+// Syslog severities (RFC 5424 section 6.2.1) and the facility results are
+// logged under.
+const (
+	syslogErr  = 3
+	syslogInfo = 6
+	syslogUser = 1
+)
+
+// syslogSDID identifies the structured data element carrying the result,
+// under the example enterprise number reserved by RFC 5612.
+const syslogSDID = "result@32473"
+
+// ResultSink receives each result as soon as the host completes.
+type ResultSink interface {
+	WriteResult(r CommandResult) error
+	Close() error
+}
+
+// SyslogSink sends each result to a syslog server as an RFC 5424 message,
+// with host, command and exit_code as structured data. log/syslog only
+// writes BSD-style headers, so messages are formatted here.
+type SyslogSink struct {
+	Tag      string
+	Command  string
+	conn     net.Conn
+	network  string
+	hostname string
+}
+
+// NewSyslogSink connects to addr, given as udp://host[:port] or
+// tcp://host[:port] (port 514 by default).
+func NewSyslogSink(addr, tag, command string) (*SyslogSink, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" {
+		return nil, fmt.Errorf("unsupported syslog address %q (expected udp://host:port or tcp://host:port)", addr)
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "514")
+	}
+
+	conn, err := net.DialTimeout(u.Scheme, host, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "-"
+	}
+
+	return &SyslogSink{
+		Tag:      tag,
+		Command:  command,
+		conn:     conn,
+		network:  u.Scheme,
+		hostname: syslogToken(hostname),
+	}, nil
+}
+
+// WriteResult sends one message, at LOG_INFO for a success and LOG_ERR for a
+// failure.
+func (s *SyslogSink) WriteResult(r CommandResult) error {
+	severity, text := syslogInfo, "succeeded"
+	if r.Error != nil {
+		severity, text = syslogErr, "failed: "+r.Error.Error()
+	}
+
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - [%s host=\"%s\" command=\"%s\" exit_code=\"%d\"] %s",
+		syslogUser*8+severity,
+		time.Now().Format(time.RFC3339Nano),
+		s.hostname,
+		syslogToken(s.Tag),
+		os.Getpid(),
+		syslogSDID,
+		escapeSDParam(r.Host),
+		escapeSDParam(s.Command),
+		r.ExitCode,
+		text,
+	)
+
+	// TCP needs octet-counting framing (RFC 6587), UDP sends one datagram
+	if s.network == "tcp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	_, err := s.conn.Write([]byte(msg))
+	return err
+}
+
+func (s *SyslogSink) Close() error {
+	return s.conn.Close()
+}
+
+// escapeSDParam escapes the characters RFC 5424 reserves in PARAM-VALUE.
+func escapeSDParam(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// syslogToken makes value a valid header field: printable ASCII without
+// spaces, at most 48 characters, "-" if empty.
+func syslogToken(value string) string {
+	var b strings.Builder
+	for _, r := range value {
+		if r > ' ' && r < 0x7f && b.Len() < 48 {
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() == 0 {
+		return "-"
+	}
+
+	return b.String()
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// tableColumns are the columns --output-columns can pick, in their default
+// order.
+var tableColumns = []string{"host", "status", "exit_code", "duration", "output", "error"}
+
+// defaultTableColumns are shown when --output-columns isn't given.
+var defaultTableColumns = []string{"host", "status", "exit_code", "duration", "output"}
+
+// tableColumnGap is the space between table columns.
+const tableColumnGap = 2
+
+// TableFormatter prints results as an aligned table with the given columns,
+// one row per host. Rows are held until Flush, since columns can only be
+// aligned once every row is known. With a positive width, the output column
+// is cut short so rows fit in that many characters.
+type TableFormatter struct {
+	columns []string
+	width   int
+
+	mu   sync.Mutex
+	rows [][]string
+}
+
+// NewTableFormatter checks the column names; nil columns means the default
+// ones.
+func NewTableFormatter(columns []string, width int) (*TableFormatter, error) {
+	if len(columns) == 0 {
+		columns = defaultTableColumns
+	}
+	for _, column := range columns {
+		if !slices.Contains(tableColumns, column) {
+			return nil, fmt.Errorf("unknown output column %q (expected %s)", column, strings.Join(tableColumns, ", "))
+		}
+	}
+
+	return &TableFormatter{columns: columns, width: width}, nil
+}
+
+func (f *TableFormatter) WriteResult(w io.Writer, r CommandResult) error {
+	row := make([]string, len(f.columns))
+	for i, column := range f.columns {
+		row[i] = tableCell(r, column)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rows = append(f.rows, row)
+	return nil
+}
+
+// Flush prints the rows held so far under a header, and forgets them.
+func (f *TableFormatter) Flush(w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.rows) == 0 {
+		return nil
+	}
+
+	header := make([]string, len(f.columns))
+	for i, column := range f.columns {
+		header[i] = strings.ToUpper(column)
+	}
+	rows := append([][]string{header}, f.rows...)
+	f.rows = nil
+	f.truncateOutput(rows)
+
+	tw := tabwriter.NewWriter(w, 0, 0, tableColumnGap, ' ', 0)
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// truncateOutput cuts the output column down to what is left of the width
+// once the other columns are laid out.
+func (f *TableFormatter) truncateOutput(rows [][]string) {
+	output := -1
+	for i, column := range f.columns {
+		if column == "output" {
+			output = i
+		}
+	}
+	if f.width <= 0 || output < 0 {
+		return
+	}
+
+	used := 0
+	for i := range f.columns {
+		if i == output {
+			continue
+		}
+		widest := 0
+		for _, row := range rows {
+			if n := len([]rune(row[i])); n > widest {
+				widest = n
+			}
+		}
+		used += widest + tableColumnGap
+	}
+	// Keep a little of the output however narrow the terminal
+	room := f.width - used
+	if room < 10 {
+		room = 10
+	}
+	for _, row := range rows {
+		if cell := []rune(row[output]); len(cell) > room {
+			row[output] = string(cell[:room-3]) + "..."
+		}
+	}
+}
+
+func tableCell(r CommandResult, column string) string {
+	switch column {
+	case "host":
+		return r.Host
+	case "status":
+		if r.Error != nil {
+			return "failed"
+		}
+		return "ok"
+	case "exit_code":
+		return strconv.Itoa(r.ExitCode)
+	case "duration":
+		return r.Duration.Round(time.Millisecond).String()
+	case "output":
+		return oneLine(printableOutput(r.Output))
+	case "error":
+		if r.Error != nil {
+			return oneLine(r.Error.Error())
+		}
+	}
+
+	return ""
+}
+
+// oneLine puts s on a single line, so it stays in its table cell.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}